@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/audit"
+	"github.com/tumblr/docker-registry-pruner/pkg/config"
+	"github.com/tumblr/docker-registry-pruner/pkg/report"
+)
+
+// SearchAudit writes the deletions in the config's audit log matching the query to stdout, as a
+// table, or as JSON lines with -output json
+func SearchAudit(cfg *config.Config, query audit.Query, output string) {
+	if cfg.AuditLog == "" {
+		log.Fatalf("audit-search needs audit_log set in the config")
+	}
+	if output != report.FormatTable && output != report.FormatJSON {
+		log.Fatalf("audit-search only supports -output %s or %s", report.FormatTable, report.FormatJSON)
+	}
+	records, err := audit.Search(cfg.AuditLog, query)
+	if err != nil {
+		log.Fatalf("Unable to search audit log %s: %s", cfg.AuditLog, err)
+	}
+
+	if output == report.FormatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "time\trun_id\tmode\timage\ttag\tdigest\toutcome\trules\terror\n")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.RunID, r.Mode, r.Repo, r.Tag, r.Digest, r.Outcome, strings.Join(r.Rules, ","), r.Error)
+	}
+	w.Flush()
+	log.Infof("Found %d deletions in %s", len(records), cfg.AuditLog)
+}
+
+// parseTimeOrDate parses an RFC3339 time, or a date as midnight UTC. Empty is the zero time.
+func parseTimeOrDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
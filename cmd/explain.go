@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/client"
+	"github.com/tumblr/docker-registry-pruner/pkg/report"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+// ExplainImages writes why each image of repo, or only its tag if tag is not empty, is kept, deleted,
+// pending deletion or protected: the rules that decided, and what protects it. Nothing is marked pending.
+func ExplainImages(hub *client.Client, repo, tag string, clock rules.Clock) {
+	if repo == "" {
+		log.Fatalf("-repo is required in explain mode")
+	}
+	log.Infof("Querying for manifests of %s. This may take a while...", repo)
+	_, matches, d, protectedBy, g, pinFlags := FetchImagesAndApplyRules(hub, []string{repo}, clock, false)
+	explain(BuildReport(hub.Config.Rules, matches, d, protectedBy, g, pinFlags, clock), repo, tag)
+}
+
+// explain writes the report's explanation of the images of repo, or only its tag if tag is not empty
+func explain(r *report.Report, repo, tag string) {
+	if err := r.Explain(os.Stdout, repo, tag); err != nil {
+		ref := repo
+		if tag != "" {
+			ref += ":" + tag
+		}
+		log.Fatalf("Unable to explain %s: %s", ref, err)
+	}
+}
@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"text/tabwriter"
 	"time"
 
+	"github.com/tumblr/docker-registry-pruner/pkg/audit"
 	"github.com/tumblr/docker-registry-pruner/pkg/client"
 	"github.com/tumblr/docker-registry-pruner/pkg/config"
+	"github.com/tumblr/docker-registry-pruner/pkg/grace"
+	"github.com/tumblr/docker-registry-pruner/pkg/limits"
+	"github.com/tumblr/docker-registry-pruner/pkg/pins"
+	"github.com/tumblr/docker-registry-pruner/pkg/plan"
+	"github.com/tumblr/docker-registry-pruner/pkg/protect"
 	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/report"
 	"github.com/tumblr/docker-registry-pruner/pkg/rules"
 	"go.uber.org/zap"
 )
@@ -20,6 +26,19 @@ var (
 	log       = logger.Sugar()
 )
 
+// exit codes
+const (
+	ExitOK = 0
+	// ExitDeleteFailed is when some deletes failed
+	ExitDeleteFailed = 2
+	// ExitLimitExceeded is when nothing was deleted, because the config's limits would have been exceeded
+	ExitLimitExceeded = 3
+	// ExitUndoFailed is when some images of the run being undone could not be restored
+	ExitUndoFailed = 4
+	// ExitScriptFailed is when a rule's script failed, so the images it selected were neither kept nor deleted
+	ExitScriptFailed = 5
+)
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -34,20 +53,94 @@ func main() {
 	var (
 		configFile string
 		mode       string
+		now        string
+		noCache    bool
+		out        string
+		snap       string
+		planFile   string
+		planMaxAge time.Duration
+		force      bool
+		output     string
+		query      audit.Query
+		since      string
+		until      string
 	)
 	flag.StringVar(&configFile, "config", "config.yaml", "Config yaml")
 	flag.StringVar(&mode, "mode", "report", "Select operation mode")
+	flag.StringVar(&now, "now", "", "Evaluate rules as of this RFC3339 time (i.e. 2026-11-01T00:00:00Z) instead of the current time. Report and explain modes only")
+	flag.BoolVar(&noCache, "no-cache", false, "Fetch every manifest from the registry, ignoring the manifest cache and state")
+	flag.StringVar(&out, "out", "", "File to write to in snapshot mode (.json for JSON, otherwise YAML) and plan mode")
+	flag.StringVar(&snap, "snapshot", "", "Report or explain from this snapshot file instead of the registry")
+	flag.StringVar(&planFile, "plan", "", "Plan file to delete in apply mode")
+	flag.DurationVar(&planMaxAge, "plan-max-age", plan.DefaultMaxAge, "Refuse to apply plans older than this")
+	flag.BoolVar(&force, "force", false, "Delete even if the config's limits would be exceeded, or restore or undo over a tag that was pushed again")
+	flag.StringVar(&output, "output", report.FormatTable, fmt.Sprintf("Format of the report in report mode; one of %s", strings.Join(report.Formats, ", ")))
+	flag.StringVar(&query.Repo, "repo", "", "Only find deletions of this repo in audit-search mode, the repo to restore in restore mode, or the repo to explain in explain mode")
+	flag.StringVar(&query.Tag, "tag", "", "Only find deletions of this tag in audit-search mode, the tag to restore in restore mode, or the tag to explain in explain mode (all of the repo's if empty)")
+	flag.StringVar(&query.Digest, "digest", "", "Only find deletions of this digest in audit-search mode")
+	flag.StringVar(&query.RunID, "run", "", "Only find deletions by this run in audit-search mode, or the run to undo in undo mode")
+	flag.StringVar(&since, "since", "", "Only find deletions at or after this RFC3339 time or date (i.e. 2026-11-01) in audit-search mode")
+	flag.StringVar(&until, "until", "", "Only find deletions before this RFC3339 time or date in audit-search mode")
 	flag.Parse()
 
+	if !report.ValidFormat(output) {
+		log.Fatalf("Unsupported -output %s: %s", output, report.ErrUnknownFormat)
+	}
+
+	clock := rules.SystemClock
+	if now != "" {
+		if mode != "report" && mode != "explain" {
+			log.Fatalf("-now is only supported in report and explain modes")
+		}
+		t, err := time.Parse(time.RFC3339, now)
+		if err != nil {
+			log.Fatalf("Unable to parse -now %q: %s", now, err)
+		}
+		clock = rules.FixedClock(t)
+		log.Infof("Evaluating rules as of %s", t.Format(time.RFC3339))
+	}
+
 	cfg, err := config.LoadFromFile(configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	for _, rule := range cfg.Rules {
+		log.Infof("Loaded rule: %s", rule.String())
+	}
+
+	if mode == "audit-search" {
+		// the audit log is local; the registry is never contacted
+		if query.Since, err = parseTimeOrDate(since); err != nil {
+			log.Fatalf("Unable to parse -since %q: %s", since, err)
+		}
+		if query.Until, err = parseTimeOrDate(until); err != nil {
+			log.Fatalf("Unable to parse -until %q: %s", until, err)
+		}
+		SearchAudit(cfg, query, output)
+		return
+	}
+
+	if snap != "" {
+		// everything comes from the snapshot; the registry is never contacted
+		switch mode {
+		case "report":
+			ReportFromSnapshot(cfg, snap, now != "", clock, output)
+		case "explain":
+			ExplainFromSnapshot(cfg, snap, now != "", clock, query.Repo, query.Tag)
+		default:
+			log.Fatalf("-snapshot is only supported in report and explain modes")
+		}
+		return
+	}
+
+	cfg.NoCache = noCache
 	hub, err := client.New(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer hub.Close()
+	hub.Mode = mode
 
 	log.Infof("Created Registry client for %s", cfg.RegistryURL)
 
@@ -63,51 +156,111 @@ func main() {
 		repos = append(repos, repo)
 	}
 
-	for _, rule := range hub.Config.Rules {
-		log.Infof("Loaded rule: %s", rule.String())
-	}
-
 	switch mode {
 	case "report":
 		log.Infof("Building image report for images: %s", strings.Join(repos, ", "))
-		ShowMatchingRepos(hub, repos)
+		exit(hub, ShowMatchingRepos(hub, repos, clock, output))
+	case "explain":
+		ExplainImages(hub, query.Repo, query.Tag, clock)
 	case "prune":
 		log.Infof("Pruning tags for images: %s", strings.Join(repos, ", "))
-		ok := DeleteMatchingImages(hub, repos)
-		if !ok {
-			os.Exit(2)
+		exit(hub, PurgeQuarantine(hub, DeleteMatchingImages(hub, repos, clock, force)))
+	case "plan":
+		if out == "" {
+			log.Fatalf("-out is required in plan mode")
+		}
+		log.Infof("Planning deletion of tags for images: %s", strings.Join(repos, ", "))
+		exit(hub, MakePlan(hub, repos, clock, out))
+	case "apply":
+		if planFile == "" {
+			log.Fatalf("-plan is required in apply mode")
+		}
+		exit(hub, PurgeQuarantine(hub, ApplyPlan(hub, planFile, planMaxAge, force)))
+	case "undo":
+		exit(hub, Undo(hub, query.RunID, force))
+	case "restore":
+		RestoreImage(hub, query.Repo, query.Tag, force)
+	case "snapshot":
+		if out == "" {
+			log.Fatalf("-out is required in snapshot mode")
 		}
+		log.Infof("Taking snapshot of images: %s", strings.Join(repos, ", "))
+		TakeSnapshot(hub, repos, out)
 	default:
 		log.Fatalf("Unsupported mode %s", mode)
 	}
 
 }
 
-func PrintTableManifests(matches map[string][]*registry.Manifest) {
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-	fmt.Fprintf(w, "action\timage\ttag\tparsed_version\tage_days\n")
-	for action, manifests := range matches {
-		for _, m := range manifests {
-			daysOld := int64(time.Since(m.LastModified).Hours() / 24.0)
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", action, m.Name, m.Tag, m.Version.String(), daysOld)
-		}
+// exit closes the client, so everything it holds back is written out, and exits with code
+func exit(hub *client.Client, code int) {
+	if err := hub.Close(); err != nil {
+		log.Errorw("unable to close client", "error", err)
 	}
-	w.Flush()
+	os.Exit(code)
 }
 
-func FetchImagesAndApplyRules(hub *client.Client, repos []string) map[string][]*registry.Manifest {
+// FetchImages fetches the manifests of every tag of the repos
+func FetchImages(hub *client.Client, repos []string) []*registry.Manifest {
 	repoTags, err := hub.RepoTags(repos)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	selectors := rules.RulesToSelectors(hub.Config.Rules)
 	allManifests, err := hub.Manifests(repoTags)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return allManifests
+}
+
+// ApplyRulesToImages selects the manifests any rule applies to, and applies the rules to them. Manifests
+// the protectors protect are kept. Also returns why the rules kept and deleted each manifest, as
+// rules.ApplyRulesWithDecisions does, and the protections of the manifests kept by the protectors.
+func ApplyRulesToImages(ruleset []*rules.Rule, protectors []rules.Protector, allManifests []*registry.Manifest, clock rules.Clock) (matches map[string][]*registry.Manifest, d *rules.Decisions, protectedBy map[string][]rules.Protection) {
+	keep, delete, d := rules.ApplyRulesWithDecisions(ruleset, SelectImages(ruleset, allManifests, clock), clock)
+	keep, delete, protectedBy = rules.ApplyProtections(protectors, allManifests, keep, delete)
+	matches = map[string][]*registry.Manifest{
+		"keep":   keep,
+		"delete": delete,
+	}
+	return matches, d, protectedBy
+}
+
+// LoadProtectors finds the images the config's protect sources depend on, and the images the config's
+// pins have not expired for as of the clock. If any source fails, nothing is known to be safe to delete,
+// so this exits.
+func LoadProtectors(cfg *config.Config, clock rules.Clock) []rules.Protector {
+	protectors := []rules.Protector{}
+	sources, err := cfg.Protect.Sources()
+	if err != nil {
+		log.Fatalf("Unable to load protected images: %s", err)
+	}
+	if len(sources) > 0 {
+		p, err := protect.New(cfg.RegistryURL, sources)
+		if err != nil {
+			log.Fatalf("Unable to load protected images: %s", err)
+		}
+		protectors = append(protectors, p)
+	}
+	if len(cfg.Pins) > 0 {
+		protectors = append(protectors, pins.New(cfg.Pins, clock.Now()))
+	}
+	return protectors
+}
 
-	filteredManifestsByRepo := rules.FilterManifests(allManifests, selectors)
+// CheckPins flags the config's pins that expired as of the clock, or match none of allManifests, the
+// manifests of repos (every repo if empty), and warns about each, so their owners can renew or remove them
+func CheckPins(cfg *config.Config, allManifests []*registry.Manifest, repos []string, clock rules.Clock) []*pins.Flag {
+	flags := pins.New(cfg.Pins, clock.Now()).Check(allManifests, repos)
+	for _, f := range flags {
+		log.Warnw("pin needs attention", "pin", f.Image, "owner", f.Owner, "expires", f.Expires, "problem", f.Problem)
+	}
+	return flags
+}
+
+// SelectImages returns the manifests any rule's selector matches, by their age from the rule's age source
+func SelectImages(ruleset []*rules.Rule, allManifests []*registry.Manifest, clock rules.Clock) []*registry.Manifest {
+	filteredManifestsByRepo := rules.FilterManifestsByRules(allManifests, ruleset, clock)
 	filteredManifests := []*registry.Manifest{}
 	filteredCount := 0
 	for n, manifests := range filteredManifestsByRepo {
@@ -118,28 +271,145 @@ func FetchImagesAndApplyRules(hub *client.Client, repos []string) map[string][]*
 		}
 	}
 	log.Debugf("Selector filtering %d manifests to %d manifests", len(allManifests), len(filteredManifests))
+	return filteredManifests
+}
 
-	keep, delete := rules.ApplyRules(hub.Config.Rules, filteredManifests)
-	matches := map[string][]*registry.Manifest{
-		"keep":   keep,
-		"delete": delete,
+// FetchImagesAndApplyRules fetches the images of the repos, and applies the rules and protections to them.
+// Images the rules delete that are still in their grace period are held back from matches["delete"], as
+// returned in the grace.Result. If persist is true, images are marked pending deletion in the state. Also
+// returns every manifest fetched, and the pins that need attention, as CheckPins does.
+func FetchImagesAndApplyRules(hub *client.Client, repos []string, clock rules.Clock, persist bool) (allManifests []*registry.Manifest, matches map[string][]*registry.Manifest, d *rules.Decisions, protectedBy map[string][]rules.Protection, g *grace.Result, pinFlags []*pins.Flag) {
+	protectors := LoadProtectors(hub.Config, clock)
+	allManifests = FetchImages(hub, repos)
+	pinFlags = CheckPins(hub.Config, allManifests, repos, clock)
+	matches, d, protectedBy = ApplyRulesToImages(hub.Config.Rules, protectors, allManifests, clock)
+	// decisions made as of a simulated time are not worth remembering
+	if hub.State != nil && clock == rules.SystemClock {
+		if err := hub.State.RecordDecisions(matches["keep"], matches["delete"], clock.Now()); err != nil {
+			log.Warnw("unable to record decisions in state", "error", err)
+		}
+	}
+	g, err := grace.Apply(hub.State, hub.Config.Rules, hub.Config.GracePeriodDays, allManifests, matches["delete"], d.DeletedBy, clock.Now(), persist && clock == rules.SystemClock)
+	if err != nil {
+		log.Fatalf("Unable to apply grace period: %s", err)
 	}
-	return matches
+	if len(g.Pending) > 0 {
+		log.Infof("Holding back deletion of %d images in their grace period", len(g.Pending))
+	}
+	matches["delete"] = g.Due
+	return allManifests, matches, d, protectedBy, g, pinFlags
 }
 
-func ShowMatchingRepos(hub *client.Client, repos []string) {
+// ShowMatchingRepos reports the images of the repos the rules keep and delete, and returns the exit code
+func ShowMatchingRepos(hub *client.Client, repos []string, clock rules.Clock, output string) int {
 	log.Infof("Querying for manifests. This may take a while...")
-	matches := FetchImagesAndApplyRules(hub, repos)
-	deletes, keeps := len(matches["delete"]), len(matches["keep"])
-	PrintTableManifests(matches)
-	fmt.Fprintf(os.Stderr, "deleting %d images, keeping %d images\n", deletes, keeps)
+	_, matches, d, protectedBy, g, pinFlags := FetchImagesAndApplyRules(hub, repos, clock, false)
+	ShowReport(hub.Config.Rules, matches, d, protectedBy, g, pinFlags, clock, output)
+	return decidedCode(d)
+}
+
+// decidedCode is ExitScriptFailed if any rule's script failed deciding, or ExitOK
+func decidedCode(d *rules.Decisions) int {
+	if d.ScriptsFailed() {
+		log.Errorf("A rule's script failed, so its images were neither kept nor deleted; see their %s issues", rules.IssueScriptFailed)
+		return ExitScriptFailed
+	}
+	return ExitOK
+}
+
+// ShowReport writes the report of images to keep and delete, and of the pins that need attention, to stdout
+// in the output format. g may be nil if no grace period was applied.
+func ShowReport(ruleset []*rules.Rule, matches map[string][]*registry.Manifest, d *rules.Decisions, protectedBy map[string][]rules.Protection, g *grace.Result, pinFlags []*pins.Flag, clock rules.Clock, output string) {
+	WriteReport(BuildReport(ruleset, matches, d, protectedBy, g, pinFlags, clock), output)
+}
+
+// WriteReport writes the report to stdout in the output format
+func WriteReport(r *report.Report, output string) {
+	if err := r.Write(os.Stdout, output); err != nil {
+		log.Fatal(err)
+	}
+	log.Infow("reported images", "keep", r.Keep, "delete", r.Delete, "delete_size", r.DeleteSize, "protected", r.Protected, "pending", r.Pending, "rescued", len(r.Rescued), "pins_flagged", len(r.Pins))
 }
 
-func DeleteMatchingImages(hub *client.Client, repos []string) bool {
+// BuildReport is the report of images to keep and delete, and of the pins that need attention. g may be nil
+// if no grace period was applied.
+func BuildReport(ruleset []*rules.Rule, matches map[string][]*registry.Manifest, d *rules.Decisions, protectedBy map[string][]rules.Protection, g *grace.Result, pinFlags []*pins.Flag, clock rules.Clock) *report.Report {
+	if g == nil {
+		g = &grace.Result{Due: matches["delete"]}
+	}
+	r := report.New(ruleset, matches["keep"], g, d, protectedBy, clock.Now())
+	r.Pins = append(r.Pins, pinFlags...)
+	return r
+}
+
+// DeleteMatchingImages deletes the images the rules decide to delete, and returns the exit code
+func DeleteMatchingImages(hub *client.Client, repos []string, clock rules.Clock, force bool) int {
 	log.Infof("Querying for manifests. This may take a while...")
-	matches := FetchImagesAndApplyRules(hub, repos)
-	log.Infof("Beginning deletion of %d images", len(matches["delete"]))
-	deleted, errs := hub.DeleteManifestsParallel(matches["delete"])
-	log.Infof("Deleted %d images, encountered %d errors", deleted, len(errs))
-	return len(errs) == 0
+	allManifests, matches, d, _, _, _ := FetchImagesAndApplyRules(hub, repos, clock, true)
+	if !WithinLimits(hub, matches["delete"], allManifests, force) {
+		return ExitLimitExceeded
+	}
+	log.Infof("Beginning deletion of %d images, as run %s", len(matches["delete"]), hub.RunID)
+	deleted, errs := hub.DeleteManifestsParallel(matches["delete"], rules.RuleNames(hub.Config.Rules, d.DeletedBy))
+	log.Infof("Deleted %d images, encountered %d errors", len(deleted), len(errs))
+	ClearPending(hub, deleted)
+	if len(errs) > 0 {
+		return ExitDeleteFailed
+	}
+	return decidedCode(d)
+}
+
+// ClearPending unmarks the deleted images pending deletion in the state, so the images that were due but
+// not deleted are due again next run
+func ClearPending(hub *client.Client, deleted []*registry.Manifest) {
+	if err := grace.Deleted(hub.State, hub.Config.Rules, hub.Config.GracePeriodDays, deleted); err != nil {
+		log.Warnw("unable to unmark deleted images pending deletion in state", "error", err)
+	}
+}
+
+// PurgeQuarantine deletes the quarantined images whose quarantine expired, in every quarantine repo, after
+// a run exiting with code, if images are quarantined. Nothing is purged if the run exceeded its limits, as
+// then nothing may be deleted. Returns code, or ExitDeleteFailed if any purge failed.
+func PurgeQuarantine(hub *client.Client, code int) int {
+	if hub.Config.Disposition != config.DispositionQuarantine || hub.Config.Quarantine.PurgeAfterDays == 0 || code == ExitLimitExceeded {
+		return code
+	}
+	purged, errs := hub.PurgeQuarantine(time.Now())
+	log.Infof("Purged %d expired quarantined images, encountered %d errors", purged, len(errs))
+	if len(errs) > 0 {
+		return ExitDeleteFailed
+	}
+	return code
+}
+
+// WithinLimits checks deleting the manifests would not exceed any of the config's limits, before anything
+// is deleted. all are the manifests the deletions were decided on, of every repo being deleted from; if nil,
+// they are fetched. Every limit exceeded is logged. With force, exceeded limits are logged but not enforced.
+func WithinLimits(hub *client.Client, delete []*registry.Manifest, all []*registry.Manifest, force bool) bool {
+	if hub.Config.Limits == (limits.Limits{}) || len(delete) == 0 {
+		return true
+	}
+	if all == nil {
+		all = FetchImages(hub, reposOf(delete))
+	}
+	// deleting by digest deletes every tag on it, so the limits count those tags too
+	tagCounts := map[string]int{}
+	for _, m := range all {
+		tagCounts[m.Name]++
+	}
+	delete = limits.Expand(delete, all)
+
+	violations := hub.Config.Limits.Check(delete, tagCounts)
+	for _, v := range violations {
+		if force {
+			log.Warnw("deletion limit exceeded, continuing because of -force", "limit", v.String())
+		} else {
+			log.Errorw("deletion limit exceeded", "limit", v.String())
+		}
+	}
+	if len(violations) > 0 && !force {
+		log.Errorf("Refusing to delete %d tags because %d limits would be exceeded. Review the report, and rerun with -force if this is intended", len(delete), len(violations))
+		return false
+	}
+	return true
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/client"
+	"github.com/tumblr/docker-registry-pruner/pkg/limits"
+	"github.com/tumblr/docker-registry-pruner/pkg/plan"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+// MakePlan writes the deletions the config decides on to the plan file out, for review before applying it.
+// Returns the exit code.
+func MakePlan(hub *client.Client, repos []string, clock rules.Clock, out string) int {
+	log.Infof("Querying for manifests. This may take a while...")
+	_, matches, d, _, g, _ := FetchImagesAndApplyRules(hub, repos, clock, true)
+	delete := matches["delete"]
+	p := plan.New(hub.Config.RegistryURL, hub.Config.Hash, hub.Config.Rules, delete, d.DeletedBy, clock.Now())
+	if err := p.WriteFile(out, hub.Config.PlanKey); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Wrote plan to delete %d images (keeping %d, %d pending deletion) to %s", len(delete), len(matches["keep"]), len(g.Pending), out)
+	return decidedCode(d)
+}
+
+// ApplyPlan deletes exactly the images in the plan file, if it is unaltered, fresh, and made with the
+// current config. Images whose tag moved to another digest since the plan was made are not deleted, nor
+// are images that became protected since, including by another tag on their digest. Without a plan key, only
+// the planned images the rules still delete are deleted, as StillDeleted has them. Returns the exit code.
+func ApplyPlan(hub *client.Client, file string, maxAge time.Duration, force bool) int {
+	p, err := plan.Load(file, hub.Config.PlanKey)
+	if err != nil {
+		log.Fatalf("Refusing to apply plan %s: %s", file, err)
+	}
+	if err := p.Verify(hub.Config.RegistryURL, hub.Config.Hash, time.Now(), maxAge); err != nil {
+		log.Fatalf("Refusing to apply plan %s made at %s: %s", file, p.CreatedAt, err)
+	}
+	delete := p.Manifests()
+	protectors := LoadProtectors(hub.Config, rules.SystemClock)
+	unsigned := len(hub.Config.PlanKey) == 0
+	var all []*registry.Manifest
+	if (unsigned || len(protectors) > 0 || hub.Config.Limits != (limits.Limits{})) && len(delete) > 0 {
+		// the tags now on the planned digests, which are deleted along with them, fetched once for the
+		// rules, the protections and the limits
+		all = FetchImages(hub, reposOf(delete))
+	}
+	if unsigned {
+		delete = StillDeleted(hub.Config.Rules, delete, all, rules.SystemClock)
+	}
+	_, delete, protectedBy := rules.ApplyProtections(protectors, all, []*registry.Manifest{}, delete)
+	if len(protectedBy) > 0 {
+		log.Warnf("Not deleting %d planned images that are protected since the plan was made", len(protectedBy))
+	}
+	if !WithinLimits(hub, delete, all, force) {
+		return ExitLimitExceeded
+	}
+	log.Infof("Beginning deletion of %d images planned at %s, as run %s", len(delete), p.CreatedAt, hub.RunID)
+	deleted, errs := hub.DeleteManifestsParallel(delete, p.DeletedBy())
+	log.Infof("Deleted %d images, encountered %d errors", len(deleted), len(errs))
+	ClearPending(hub, deleted)
+	if len(errs) > 0 {
+		return ExitDeleteFailed
+	}
+	return ExitOK
+}
+
+// StillDeleted are the planned manifests the ruleset deletes from all, as of the clock. Anyone who can write
+// a plan without a plan key can recompute its checksum, so its entries are only trusted as far as the rules
+// still agree with them; the rest are logged, and not deleted.
+func StillDeleted(ruleset []*rules.Rule, planned []*registry.Manifest, all []*registry.Manifest, clock rules.Clock) []*registry.Manifest {
+	_, _, d := rules.ApplyRulesWithDecisions(ruleset, SelectImages(ruleset, all, clock), clock)
+	deleted := []*registry.Manifest{}
+	for _, m := range planned {
+		if _, ok := d.DeletedBy[m.Reference()]; ok {
+			deleted = append(deleted, m)
+		} else {
+			log.Warnw("not deleting planned image the rules do not delete now", "repo", m.Name, "tag", m.Tag, "digest", m.Digest)
+		}
+	}
+	if n := len(planned) - len(deleted); n > 0 {
+		log.Warnf("Not deleting %d planned images the rules no longer delete. Set plan_key_file to sign plans, so they are applied as planned", n)
+	}
+	return deleted
+}
+
+// reposOf are the repos of the manifests, in the order they first appear
+func reposOf(manifests []*registry.Manifest) []string {
+	repos := []string{}
+	seen := map[string]bool{}
+	for _, m := range manifests {
+		if !seen[m.Name] {
+			seen[m.Name] = true
+			repos = append(repos, m.Name)
+		}
+	}
+	return repos
+}
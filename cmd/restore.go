@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/tumblr/docker-registry-pruner/pkg/archive"
+	"github.com/tumblr/docker-registry-pruner/pkg/client"
+)
+
+// RestoreImage pushes the image archived as repo:tag back to the registry under its original tag. If the
+// tag has since been pushed again, it is only overwritten with force.
+func RestoreImage(hub *client.Client, repo, tag string, force bool) {
+	if hub.Archive == nil {
+		log.Fatalf("restore needs archive set in the config")
+	}
+	if repo == "" || tag == "" {
+		log.Fatalf("-repo and -tag are required in restore mode")
+	}
+	archived, err := archive.ManifestDigest(hub.Archive, repo, tag)
+	if err != nil {
+		log.Fatalf("Unable to restore %s:%s: %s", repo, tag, err)
+	}
+	if current, err := hub.ManifestDescriptor(repo, tag); err == nil && current.Digest != archived && !force {
+		log.Fatalf("%s:%s now points at %s, not the archived %s. Rerun with -force to overwrite it", repo, tag, current.Digest, archived)
+	}
+	if _, err := archive.Copy(hub.Archive, archive.NewRegistryStore(&hub.Registry), repo, tag, tag); err != nil {
+		log.Fatalf("Unable to restore %s:%s: %s", repo, tag, err)
+	}
+	log.Infow("restored image", "repo", repo, "tag", tag, "digest", archived)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/client"
+	"github.com/tumblr/docker-registry-pruner/pkg/config"
+	"github.com/tumblr/docker-registry-pruner/pkg/grace"
+	"github.com/tumblr/docker-registry-pruner/pkg/report"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"github.com/tumblr/docker-registry-pruner/pkg/snapshot"
+)
+
+// TakeSnapshot writes every manifest of the repos to the file out
+func TakeSnapshot(hub *client.Client, repos []string, out string) {
+	log.Infof("Querying for manifests. This may take a while...")
+	manifests := FetchImages(hub, repos)
+	s := snapshot.New(hub.Config.RegistryURL, manifests, time.Now())
+	if err := s.WriteFile(out); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Wrote snapshot of %d images to %s", len(s.Manifests), out)
+}
+
+// ReportFromSnapshot reports what the config would do to the images in a snapshot file. Unless
+// the time was overridden with -now, rules are evaluated as of when the snapshot was taken.
+func ReportFromSnapshot(cfg *config.Config, file string, nowOverridden bool, clock rules.Clock, output string) {
+	WriteReport(reportFromSnapshot(cfg, file, nowOverridden, clock), output)
+}
+
+// ExplainFromSnapshot explains what the config would do to the images of repo in a snapshot file, as
+// ExplainImages does, as of when the snapshot was taken unless the time was overridden with -now
+func ExplainFromSnapshot(cfg *config.Config, file string, nowOverridden bool, clock rules.Clock, repo, tag string) {
+	if repo == "" {
+		log.Fatalf("-repo is required in explain mode")
+	}
+	explain(reportFromSnapshot(cfg, file, nowOverridden, clock), repo, tag)
+}
+
+// reportFromSnapshot is the report of what the config would do to the images in a snapshot file
+func reportFromSnapshot(cfg *config.Config, file string, nowOverridden bool, clock rules.Clock) *report.Report {
+	s, err := snapshot.Load(file)
+	if err != nil {
+		log.Fatalf("Unable to load snapshot %s: %s", file, err)
+	}
+	manifests, err := s.RegistryManifests()
+	if err != nil {
+		log.Fatalf("Unable to load snapshot %s: %s", file, err)
+	}
+	if s.Registry != cfg.RegistryURL {
+		log.Warnw("snapshot was taken of a different registry than the config's", "snapshot", s.Registry, "config", cfg.RegistryURL)
+	}
+	if !nowOverridden {
+		t, _ := s.Time()
+		clock = rules.FixedClock(t)
+	}
+	log.Infof("Building image report from snapshot %s of %d images, as of %s", file, len(manifests), clock.Now().Format(time.RFC3339))
+	if grace.Enabled(cfg.Rules, cfg.GracePeriodDays) {
+		log.Warnw("grace periods are not applied to reports from snapshots; images are reported as deleted as soon as they are marked")
+	}
+	matches, d, protectedBy := ApplyRulesToImages(cfg.Rules, LoadProtectors(cfg, clock), manifests, clock)
+	return BuildReport(cfg.Rules, matches, d, protectedBy, nil, CheckPins(cfg, manifests, reposOf(manifests), clock), clock)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/archive"
+	"github.com/tumblr/docker-registry-pruner/pkg/client"
+	"github.com/tumblr/docker-registry-pruner/pkg/undo"
+)
+
+// The outcomes of undoing a deletion
+const (
+	UndoRestored       = "restored"
+	UndoAlreadyPresent = "already present"
+	UndoTagMoved       = "tag moved"
+	UndoBlobsCollected = "blobs collected"
+	UndoFailed         = "failed"
+)
+
+// Undo pushes the manifests a run deleted back to the registry under their tags, and reports what
+// happened to each. Manifests whose blobs were garbage collected since can not be restored. Tags that
+// were pushed again since are only overwritten with force. Returns the exit code.
+func Undo(hub *client.Client, runID string, force bool) int {
+	dir := hub.Config.UndoDir
+	if dir == "" {
+		log.Fatalf("undo needs undo_dir set in the config")
+	}
+	if runID == "" {
+		log.Fatalf("-run is required in undo mode")
+	}
+	entries, err := undo.Load(dir, runID)
+	if err != nil {
+		log.Fatalf("Unable to undo run %s: %s", runID, err)
+	}
+	log.Infof("Undoing deletion of %d images by run %s", len(entries), runID)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "image\ttag\tdigest\toutcome\tdetail\n")
+	failed := 0
+	for _, e := range entries {
+		outcome, detail := undoEntry(hub, dir, runID, e, force)
+		if outcome != UndoRestored && outcome != UndoAlreadyPresent {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Repo, e.Tag, e.Digest, outcome, detail)
+	}
+	w.Flush()
+	log.Infof("Restored %d of %d images deleted by run %s", len(entries)-failed, len(entries), runID)
+	if failed > 0 {
+		return ExitUndoFailed
+	}
+	return ExitOK
+}
+
+// undoEntry pushes the manifest of the entry back, returning the outcome and any detail about it
+func undoEntry(hub *client.Client, dir, runID string, e *undo.Entry, force bool) (string, string) {
+	if current, err := hub.ManifestDescriptor(e.Repo, e.Tag); err == nil {
+		if current.Digest == e.Digest {
+			return UndoAlreadyPresent, ""
+		}
+		if !force {
+			return UndoTagMoved, fmt.Sprintf("now points at %s; rerun with -force to overwrite it", current.Digest)
+		}
+	}
+	payload, err := e.Manifest(dir, runID)
+	if err != nil {
+		return UndoFailed, err.Error()
+	}
+	missing, err := missingReferences(hub, e.Repo, e.MediaType, payload)
+	if err != nil {
+		return UndoFailed, err.Error()
+	}
+	if len(missing) > 0 {
+		return UndoBlobsCollected, fmt.Sprintf("%d of the blobs it references are gone, i.e. %s", len(missing), missing[0])
+	}
+	if err := archive.NewRegistryStore(&hub.Registry).PutManifest(e.Repo, e.Tag, e.MediaType, payload); err != nil {
+		return UndoFailed, err.Error()
+	}
+	return UndoRestored, ""
+}
+
+// missingReferences returns what the manifest references that is no longer in the repo: blobs, or for
+// manifest lists, the manifests of each platform
+func missingReferences(hub *client.Client, repo, mediaType string, payload []byte) ([]digest.Digest, error) {
+	m, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return nil, err
+	}
+	missing := []digest.Digest{}
+	for _, ref := range m.References() {
+		var present bool
+		switch {
+		case ref.MediaType == schema2.MediaTypeForeignLayer:
+			continue
+		case mediaType == manifestlist.MediaTypeManifestList:
+			_, err := hub.ManifestDescriptor(repo, ref.Digest.String())
+			present = err == nil
+		default:
+			if present, err = hub.HasBlob(repo, ref.Digest); err != nil {
+				return nil, err
+			}
+		}
+		if !present {
+			missing = append(missing, ref.Digest)
+		}
+	}
+	return missing, nil
+}
@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"fmt"
 	"reflect"
 	"sort"
 	"testing"
@@ -14,10 +15,15 @@ import (
 
 // helper function to make a test fixture manifest
 func mkmanifest(r, t string, daysOld int64, labels map[string]string) *registry.Manifest {
+	return mkmanifestAt(tNow, r, t, time.Duration(daysOld*24)*time.Hour, labels)
+}
+
+// helper function to make a test fixture manifest that is age old as of now
+func mkmanifestAt(now time.Time, r, t string, age time.Duration, labels map[string]string) *registry.Manifest {
 	if labels == nil {
 		labels = map[string]string{}
 	}
-	return must(registry.NewManifest(r, t, tNow.Add(time.Duration(-daysOld*24)*time.Hour), labels))
+	return must(registry.NewManifest(r, t, now.Add(-age), labels))
 }
 
 func must(m *registry.Manifest, err error) *registry.Manifest {
@@ -62,7 +68,7 @@ func TestApplyRules(t *testing.T) {
 			t.FailNow()
 		}
 
-		keep, delete := rules.ApplyRules(cfg.Rules, tc.Manifests)
+		keep, delete, d := rules.ApplyRulesWithDecisions(cfg.Rules, tc.Manifests, rules.FixedClock(tc.Now))
 		keep_tags := manifestsAsImageMap(keep)
 		delete_tags := manifestsAsImageMap(delete)
 		if test.Config == "test/fixtures/rules/labels-devel-3-versions.yaml" {
@@ -79,9 +85,47 @@ func TestApplyRules(t *testing.T) {
 			t.Errorf("%s: expected delete images tags to be %v but was actually %v", test.Config, test.Expected.Delete, delete_tags)
 			t.FailNow()
 		}
+		if skipped_tags := manifestsAsImageMap(d.Skipped); test.Expected.Skipped != nil && !reflect.DeepEqual(test.Expected.Skipped, skipped_tags) {
+			t.Errorf("%s: expected skipped images tags to be %v but was actually %v", test.Config, test.Expected.Skipped, skipped_tags)
+			t.FailNow()
+		}
+		if issues := issuesAsImageMap(tc.Manifests, d.Issues); test.Expected.Issues != nil && !reflect.DeepEqual(test.Expected.Issues, issues) {
+			t.Errorf("%s: expected issues to be %v but was actually %v", test.Config, test.Expected.Issues, issues)
+			t.FailNow()
+		}
+		if groups := groupsAsImageMap(d.Groups); test.Expected.Groups != nil && !reflect.DeepEqual(test.Expected.Groups, groups) {
+			t.Errorf("%s: expected group counts to be %v but was actually %v", test.Config, test.Expected.Groups, groups)
+			t.FailNow()
+		}
 	}
 }
 
+// turn the counts of each group into a map of repo->list of "group: keep N, delete N"
+func groupsAsImageMap(groups []*rules.GroupCount) map[string][]string {
+	res := map[string][]string{}
+	for _, g := range groups {
+		res[g.Repo] = append(res[g.Repo], fmt.Sprintf("%s: keep %d, delete %d", g.Group, g.Keep, g.Delete))
+	}
+	return res
+}
+
+// turn the issues rules found into a map of repo->list of "tag: kind"
+func issuesAsImageMap(ms []*registry.Manifest, issues map[string][]rules.Issue) map[string][]string {
+	res := map[string][]string{}
+	for _, m := range ms {
+		for _, issue := range issues[m.Reference()] {
+			res[m.Name] = append(res[m.Name], m.Tag+": "+issue.Kind)
+		}
+		sort.Strings(res[m.Name])
+	}
+	for repo, tags := range res {
+		if len(tags) == 0 {
+			delete(res, repo)
+		}
+	}
+	return res
+}
+
 // turn a list of Manifest into a map of repo->list of tags
 func manifestsAsImageMap(ms []*registry.Manifest) map[string][]string {
 	res := map[string][]string{}
@@ -94,3 +138,96 @@ func manifestsAsImageMap(ms []*registry.Manifest) map[string][]string {
 	}
 	return res
 }
+
+// TestKeepSchedule applies keep_schedule rules as of the fixture's fixed clock, because
+// which images a schedule keeps depends on where day, week and month boundaries fall
+func TestKeepSchedule(t *testing.T) {
+	tc, err := loadTestConfig("test/fixtures/manifest_tests/keep-schedule.yaml")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	for _, test := range tc.Tests {
+		for _, tags := range test.Expected.Keep {
+			sort.Strings(tags)
+		}
+		for _, tags := range test.Expected.Delete {
+			sort.Strings(tags)
+		}
+		cfg, err := config.LoadFromFile(test.Config)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		keep, delete := rules.ApplyRules(cfg.Rules, tc.Manifests, rules.FixedClock(tc.Now))
+		keep_tags := manifestsAsImageMap(keep)
+		delete_tags := manifestsAsImageMap(delete)
+
+		if !reflect.DeepEqual(test.Expected.Keep, keep_tags) {
+			t.Errorf("%s: expected keep images to be %v but was actually %v", test.Config, test.Expected.Keep, keep_tags)
+		}
+		if !reflect.DeepEqual(test.Expected.Delete, delete_tags) {
+			t.Errorf("%s: expected delete images tags to be %v but was actually %v", test.Config, test.Expected.Delete, delete_tags)
+		}
+	}
+}
+
+// TestFilterManifestsByRules selects images by their age from each rule's age source, so an expr on
+// age_days sees the same age when selecting as when the rule is applied
+func TestFilterManifestsByRules(t *testing.T) {
+	tc, err := loadTestConfig("test/fixtures/manifest_tests/apply-rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFromFile("test/fixtures/rules/rebuilt-expr-created.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := []*registry.Manifest{}
+	for _, ms := range rules.FilterManifestsByRules(tc.Manifests, cfg.Rules, rules.FixedClock(tc.Now)) {
+		selected = append(selected, ms...)
+	}
+	// cr-new is 100 days old by its history, but was created 2 days ago; cr-old is the other way around
+	expected := map[string][]string{"tumblr/rebuilt": {"cr-new"}}
+	if tags := manifestsAsImageMap(selected); !reflect.DeepEqual(expected, tags) {
+		t.Errorf("expected %v selected by their created age, got %v", expected, tags)
+	}
+	keep, delete := rules.ApplyRules(cfg.Rules, selected, rules.FixedClock(tc.Now))
+	if len(keep) != 1 || len(delete) != 0 || keep[0].Tag != "cr-new" {
+		t.Errorf("expected cr-new kept, got keep %v and delete %v", manifestsAsImageMap(keep), manifestsAsImageMap(delete))
+	}
+}
+
+// TestExprVersionScheme evaluates version in an expr, and in a script, with the rule's version_regex and
+// version_scheme, not the default semver parse of the whole tag
+func TestExprVersionScheme(t *testing.T) {
+	cfg, err := config.LoadFromFile("test/fixtures/rules/expr-version-calver.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := []*registry.Manifest{
+		mkmanifest("tumblr/calver", "build-2024.06.17", 1, nil),
+		mkmanifest("tumblr/calver", "build-2023.01.02", 1, nil),
+		mkmanifest("tumblr/calver", "2024.06.17", 1, nil),
+	}
+	selected := []*registry.Manifest{}
+	for _, ms := range rules.FilterManifestsByRules(manifests, cfg.Rules, rules.FixedClock(tNow)) {
+		selected = append(selected, ms...)
+	}
+	expected := map[string][]string{"tumblr/calver": {"build-2024.06.17"}}
+	if tags := manifestsAsImageMap(selected); !reflect.DeepEqual(expected, tags) {
+		t.Errorf("expected %v selected by their calver version, got %v", expected, tags)
+	}
+
+	// scripts see the same version
+	cfg, err = config.LoadFromFile("test/fixtures/rules/scripted-calver.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, delete := rules.ApplyRules(cfg.Rules, manifests[:2], rules.FixedClock(tNow))
+	if len(keep) != 1 || len(delete) != 1 || keep[0].Tag != "build-2024.06.17" {
+		t.Errorf("expected the script to keep build-2024.06.17 by its calver version, got keep %v and delete %v", manifestsAsImageMap(keep), manifestsAsImageMap(delete))
+	}
+}
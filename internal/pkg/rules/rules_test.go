@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	_ "github.com/tumblr/docker-registry-pruner/internal/pkg/testing"
 	"github.com/tumblr/docker-registry-pruner/pkg/config"
@@ -18,10 +19,14 @@ import (
 	"github.com/tumblr/docker-registry-pruner/pkg/rules"
 )
 
-func manifestObjectsToManifests(objs []*manifestObject) []*registry.Manifest {
+func manifestObjectsToManifests(objs []*manifestObject, now time.Time) []*registry.Manifest {
 	ms := []*registry.Manifest{}
 	for _, o := range objs {
-		m := mkmanifest(o.Name, o.Tag, o.DaysOld, o.Labels)
+		age := time.Duration(o.DaysOld*24+o.HoursOld) * time.Hour
+		m := mkmanifestAt(now, o.Name, o.Tag, age, o.Labels)
+		if o.CreatedDaysOld != 0 {
+			m.Created = now.Add(-time.Duration(o.CreatedDaysOld*24) * time.Hour)
+		}
 		ms = append(ms, m)
 	}
 	return ms
@@ -30,8 +35,11 @@ func manifestObjectsToManifests(objs []*manifestObject) []*registry.Manifest {
 // testConfig is a configuration that defines a set of test. It is comprised of:
 // * SourceManifests: all Manifests that will be parsed into a registry.Manifest via mkmanifest. These are source material for the test suite
 // * Tests: List of `testCase`
+// * Now: optionally, a fixed RFC3339 time the manifests' ages are relative to. Defaults to the current time
 type testConfig struct {
 	SourceFile      string
+	Now             time.Time `yaml:"-"`
+	NowString       string    `yaml:"now"`
 	Manifests       []*registry.Manifest
 	SourceManifests []*manifestObject `yaml:"source_manifests"`
 	Tests           []testCase        `yaml:"tests"`
@@ -40,20 +48,28 @@ type testConfig struct {
 // manifestObject will be parsed from test configs, and then pumped into mkmanifest()
 // to turn it into a registry.Manifest.
 type manifestObject struct {
-	Name    string
-	Tag     string
-	DaysOld int64             `yaml:"days_old"`
-	Labels  map[string]string `yaml:"labels"`
+	Name     string
+	Tag      string
+	DaysOld  int64 `yaml:"days_old"`
+	HoursOld int64 `yaml:"hours_old"`
+	// CreatedDaysOld is the age of the image config's created time, if different from its history
+	CreatedDaysOld int64             `yaml:"created_days_old"`
+	Labels         map[string]string `yaml:"labels"`
 }
 
 // testCase is a struct to define a specific test case. It is comprised of:
 // * Config: the yaml config that contains the Rule sets
-// * Expected: The map[repo][]tags that the rest should produce from the testConfig.Manifests as input
+// * Expected: The map[repo][]tags that the rest should produce from the testConfig.Manifests as input.
+// Expected.Skipped, Expected.Issues (map[repo][]"tag: kind") and Expected.Groups (map[repo][]"group: keep N, delete N")
+// are only checked if the test case sets them
 type testCase struct {
 	Config   string `yaml:"config"`
 	Expected struct {
-		Keep   map[string][]string `yaml:"keep"`
-		Delete map[string][]string `yaml:"delete"`
+		Keep    map[string][]string `yaml:"keep"`
+		Delete  map[string][]string `yaml:"delete"`
+		Skipped map[string][]string `yaml:"skipped"`
+		Issues  map[string][]string `yaml:"issues"`
+		Groups  map[string][]string `yaml:"groups"`
 	} `yaml:"expected"`
 }
 
@@ -69,7 +85,14 @@ func loadTestConfig(cfg string) (*testConfig, error) {
 		return nil, err
 	}
 	tc.SourceFile = cfg
-	tc.Manifests = manifestObjectsToManifests(tc.SourceManifests)
+	tc.Now = tNow
+	if tc.NowString != "" {
+		tc.Now, err = time.Parse(time.RFC3339, tc.NowString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tc.Manifests = manifestObjectsToManifests(tc.SourceManifests, tc.Now)
 
 	return &tc, nil
 }
@@ -141,7 +164,7 @@ func TestFilterRepoTags(t *testing.T) {
 		}
 		selectors := rules.RulesToSelectors(cfg.Rules)
 
-		actualManifests := rules.FilterManifests(tc.Manifests, selectors)
+		actualManifests := rules.FilterManifests(tc.Manifests, selectors, rules.FixedClock(tc.Now))
 		// construct a map[string]map[string][]string from actualManifests to aid in comparison
 		actualManifestsTags := map[string][]string{}
 		for repo, ms := range actualManifests {
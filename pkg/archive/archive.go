@@ -0,0 +1,170 @@
+package archive
+
+// archive copies images out of the registry before they are deleted, with their manifest, config and
+// layers, so they outlive registry GC. Images are archived to an OCI image layout on disk, or to another
+// registry, and can be copied back to restore them.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema" // register the OCI manifest with distribution.UnmarshalManifest
+	_ "github.com/docker/distribution/manifest/schema1"   // register the schema1 manifests with distribution.UnmarshalManifest
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.uber.org/zap"
+)
+
+var (
+	logger, _ = zap.NewProduction()
+	log       = logger.Sugar()
+
+	// ErrArchiveDestination is returned when an archive config has no destination, or more than one
+	ErrArchiveDestination = fmt.Errorf("archive needs exactly one of oci_layout or registry")
+	// ErrManifestListUnsupported is returned when archiving a manifest list; only single images can be archived
+	ErrManifestListUnsupported = fmt.Errorf("manifest lists can not be archived")
+	// ErrDigestMismatch is returned when a blob's content does not match its digest
+	ErrDigestMismatch = fmt.Errorf("blob content does not match its digest")
+	// ErrNotArchived is returned when restoring an image that is not in the archive
+	ErrNotArchived = fmt.Errorf("image is not in the archive")
+)
+
+// Config is where images are archived before they are deleted. Only one of OCILayout or Registry may be set.
+type Config struct {
+	// OCILayout is a directory, or a file ending in .tar, holding an OCI image layout
+	OCILayout string `yaml:"oci_layout"`
+	// Registry is the URL of a registry images are pushed to, under the same repo and tag
+	Registry     string `yaml:"registry"`
+	Username     string
+	Password     string
+	UsernameFile string `yaml:"username_file"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// Validate checks the config has one destination
+func (c *Config) Validate() error {
+	if (c.OCILayout == "") == (c.Registry == "") {
+		return ErrArchiveDestination
+	}
+	return nil
+}
+
+// Store is somewhere images can be copied from and to
+type Store interface {
+	// Manifest returns the media type and content of the manifest of repo:reference, where reference is a tag or digest
+	Manifest(repo, reference string) (string, []byte, error)
+	// PutManifest stores the manifest as repo:tag
+	PutManifest(repo, tag, mediaType string, payload []byte) error
+	// Blob returns the content of the blob
+	Blob(repo string, dgst digest.Digest) (io.ReadCloser, error)
+	// HasBlob is true if the store has the blob
+	HasBlob(repo string, dgst digest.Digest) (bool, error)
+	// PutBlob stores the blob read from r, or returns ErrDigestMismatch if it does not have the digest dgst
+	PutBlob(repo string, dgst digest.Digest, r io.Reader) error
+	// Close releases the store, writing out anything it holds back
+	Close() error
+}
+
+// Syncer is a Store that holds back what it stores, i.e. to pack it into a tarball, until it is synced
+type Syncer interface {
+	// Sync writes out everything stored so far, durably
+	Sync() error
+}
+
+// Open opens the store the config archives to
+func Open(c *Config) (Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.OCILayout != "" {
+		return OpenOCILayout(c.OCILayout)
+	}
+	return OpenRegistry(c.Registry, c.Username, c.Password)
+}
+
+// Copy copies the image repo:reference in from, and every blob it references, to repo:tag in to. Blobs
+// to already has are not copied again. Returns the digest of the manifest.
+func Copy(from, to Store, repo, reference, tag string) (digest.Digest, error) {
+	mediaType, payload, err := from.Manifest(repo, reference)
+	if err != nil {
+		return "", err
+	}
+	if mediaType == manifestlist.MediaTypeManifestList || mediaType == ocispec.MediaTypeImageIndex {
+		return "", ErrManifestListUnsupported
+	}
+	m, desc, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return "", err
+	}
+
+	copied := map[digest.Digest]bool{}
+	for _, ref := range m.References() {
+		// foreign layers are not stored in registries, so there is nothing to copy
+		if copied[ref.Digest] || ref.MediaType == schema2.MediaTypeForeignLayer {
+			continue
+		}
+		copied[ref.Digest] = true
+		if err := copyBlob(from, to, repo, ref.Digest); err != nil {
+			return "", fmt.Errorf("copying blob %s: %v", ref.Digest, err)
+		}
+	}
+	if err := to.PutManifest(repo, tag, mediaType, payload); err != nil {
+		return "", err
+	}
+	log.Debugw("copied image", "repo", repo, "reference", reference, "tag", tag, "digest", desc.Digest, "blobs", len(copied))
+	return desc.Digest, nil
+}
+
+// ManifestDigest is the digest of the manifest of repo:reference in the store
+func ManifestDigest(s Store, repo, reference string) (digest.Digest, error) {
+	mediaType, payload, err := s.Manifest(repo, reference)
+	if err != nil {
+		return "", err
+	}
+	_, desc, err := distribution.UnmarshalManifest(mediaType, payload)
+	return desc.Digest, err
+}
+
+func copyBlob(from, to Store, repo string, dgst digest.Digest) error {
+	has, err := to.HasBlob(repo, dgst)
+	if err != nil || has {
+		return err
+	}
+	r, err := from.Blob(repo, dgst)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return to.PutBlob(repo, dgst, r)
+}
+
+// spool writes r to a new temp file in dir, making sure its content has the digest dgst. The caller removes the file.
+func spool(dir string, dgst digest.Digest, r io.Reader) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, ".blob-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(io.MultiWriter(f, verifier), r); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if !verifier.Verified() {
+		os.Remove(f.Name())
+		return "", ErrDigestMismatch
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,247 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	r "github.com/nokia/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// memStore is a registry in memory
+type memStore struct {
+	manifests map[string][]byte
+	types     map[string]string
+	blobs     map[digest.Digest][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{manifests: map[string][]byte{}, types: map[string]string{}, blobs: map[digest.Digest][]byte{}}
+}
+
+func (s *memStore) Manifest(repo, reference string) (string, []byte, error) {
+	payload, ok := s.manifests[repo+":"+reference]
+	if !ok {
+		return "", nil, ErrNotArchived
+	}
+	return s.types[repo+":"+reference], payload, nil
+}
+
+func (s *memStore) PutManifest(repo, tag, mediaType string, payload []byte) error {
+	s.manifests[repo+":"+tag] = payload
+	s.types[repo+":"+tag] = mediaType
+	return nil
+}
+
+func (s *memStore) Blob(repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.blobs[dgst])), nil
+}
+
+func (s *memStore) HasBlob(repo string, dgst digest.Digest) (bool, error) {
+	_, ok := s.blobs[dgst]
+	return ok, nil
+}
+
+func (s *memStore) PutBlob(repo string, dgst digest.Digest, r io.Reader) error {
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if digest.FromBytes(d) != dgst {
+		return ErrDigestMismatch
+	}
+	s.blobs[dgst] = d
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// pushImage pushes an image with a config and two layers to the store, returning its manifest digest
+func pushImage(t *testing.T, s *memStore, repo, tag string) digest.Digest {
+	descriptor := func(mediaType string, content string) distribution.Descriptor {
+		d := []byte(content)
+		s.blobs[digest.FromBytes(d)] = d
+		return distribution.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(d), Size: int64(len(d))}
+	}
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    descriptor(schema2.MediaTypeImageConfig, `{"created":"2026-06-15T12:00:00Z"}`),
+		Layers: []distribution.Descriptor{
+			descriptor(schema2.MediaTypeLayer, "base layer "+repo),
+			descriptor(schema2.MediaTypeLayer, "app layer "+repo+":"+tag),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, payload, _ := m.Payload()
+	s.PutManifest(repo, tag, mediaType, payload)
+	return digest.FromBytes(payload)
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pruner-archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestArchiveAndRestore(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, path := range []string{filepath.Join(dir, "layout"), filepath.Join(dir, "archive.tar")} {
+		reg := newMemStore()
+		dgst := pushImage(t, reg, "tumblr/fleeble", "v1.0.0")
+		pushImage(t, reg, "tumblr/fleeble", "v1.1.0")
+
+		archive, err := OpenOCILayout(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+			if _, err := Copy(reg, archive, "tumblr/fleeble", tag, tag); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s: expected the archive to be written: %v", path, err)
+		}
+
+		// the registry loses the image to GC; restore it from a reopened archive
+		lost := newMemStore()
+		archive, err = OpenOCILayout(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if archived, err := ManifestDigest(archive, "tumblr/fleeble", "v1.0.0"); err != nil || archived != dgst {
+			t.Errorf("%s: expected archived digest %s, got %s: %v", path, dgst, archived, err)
+		}
+		restored, err := Copy(archive, lost, "tumblr/fleeble", "v1.0.0", "v1.0.0")
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		archive.Close()
+		if restored != dgst {
+			t.Errorf("%s: expected to restore %s, got %s", path, dgst, restored)
+		}
+		_, payload, _ := reg.Manifest("tumblr/fleeble", "v1.0.0")
+		if _, restoredPayload, _ := lost.Manifest("tumblr/fleeble", "v1.0.0"); !bytes.Equal(payload, restoredPayload) {
+			t.Errorf("%s: restored manifest differs from the original", path)
+		}
+		// config, the shared base layer, and the app layer
+		if len(lost.blobs) != 3 {
+			t.Errorf("%s: expected 3 blobs restored, got %d", path, len(lost.blobs))
+		}
+		if _, _, err := lost.Manifest("tumblr/fleeble", "v1.1.0"); err == nil {
+			t.Errorf("%s: expected only v1.0.0 to be restored", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "layout", "oci-layout")); err != nil {
+		t.Errorf("expected an oci-layout file: %v", err)
+	}
+}
+
+func TestSyncWritesTarball(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "archive.tar")
+	reg := newMemStore()
+	dgst := pushImage(t, reg, "tumblr/fleeble", "v1.0.0")
+
+	archive, err := OpenOCILayout(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if _, err := Copy(reg, archive, "tumblr/fleeble", "v1.0.0", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.(Syncer).Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tarball has the image before the archive is closed, i.e. if the run dies after deleting it
+	synced, err := OpenOCILayout(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer synced.Close()
+	if archived, err := ManifestDigest(synced, "tumblr/fleeble", "v1.0.0"); err != nil || archived != dgst {
+		t.Errorf("expected the synced tarball to have %s, got %s: %v", dgst, archived, err)
+	}
+}
+
+func TestArchiveErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	archive, err := OpenOCILayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if err := archive.PutBlob("tumblr/fleeble", digest.FromString("expected"), strings.NewReader("actual")); err != ErrDigestMismatch {
+		t.Errorf("expected %v putting a blob with the wrong digest, got %v", ErrDigestMismatch, err)
+	}
+	if _, _, err := archive.Manifest("tumblr/fleeble", "v1.0.0"); err != ErrNotArchived {
+		t.Errorf("expected %v for an image never archived, got %v", ErrNotArchived, err)
+	}
+
+	reg := newMemStore()
+	reg.PutManifest("tumblr/fleeble", "multiarch", manifestlist.MediaTypeManifestList, []byte(`{}`))
+	if _, err := Copy(reg, archive, "tumblr/fleeble", "multiarch", "multiarch"); err != ErrManifestListUnsupported {
+		t.Errorf("expected %v archiving a manifest list, got %v", ErrManifestListUnsupported, err)
+	}
+
+	for _, c := range []Config{{}, {OCILayout: dir, Registry: "https://backup.foo.bar"}} {
+		if err := c.Validate(); err != ErrArchiveDestination {
+			t.Errorf("%+v: expected %v, got %v", c, ErrArchiveDestination, err)
+		}
+	}
+}
+
+// TestRegistryStoreOCIManifest fetches an OCI manifest from a registry, and expects it as the registry sent it
+func TestRegistryStoreOCIManifest(t *testing.T) {
+	payload := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)
+	dgst := digest.FromBytes(payload)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		accepted := strings.Join(req.Header.Values("Accept"), ",")
+		if req.URL.Path != "/v2/tumblr/fleeble/manifests/"+dgst.String() || !strings.Contains(accepted, ocispec.MediaTypeImageManifest) {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Write(payload)
+	}))
+	defer srv.Close()
+	s := NewRegistryStore(&r.Registry{URL: srv.URL, Client: srv.Client(), Logf: r.Quiet})
+
+	mediaType, got, err := s.Manifest("tumblr/fleeble", dgst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != ocispec.MediaTypeImageManifest || !bytes.Equal(got, payload) {
+		t.Errorf("expected the OCI manifest as served, got %s %s", mediaType, got)
+	}
+	if _, _, err := s.Manifest("tumblr/fleeble", "missing"); err == nil {
+		t.Errorf("expected fetching a missing manifest to fail")
+	}
+}
@@ -0,0 +1,359 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Annotations on the images in an OCI layout archive, besides the ref name of repo:tag
+const (
+	// AnnotationRepo is the repo an archived image was in
+	AnnotationRepo = "com.tumblr.docker-registry-pruner.repo"
+	// AnnotationArchived is when an image was archived, as RFC3339
+	AnnotationArchived = "com.tumblr.docker-registry-pruner.archived"
+)
+
+// ErrUnsafeTarPath is returned when an archive tarball has a file outside of the layout
+var ErrUnsafeTarPath = fmt.Errorf("archive tarball has a path outside of the layout")
+
+// ociLayout is an OCI image layout directory. Every image is in the one index.json, named repo:tag.
+type ociLayout struct {
+	mu  sync.Mutex
+	dir string
+	// tarball is the file the layout is written to on Sync and Close, if archiving to a tarball
+	tarball string
+	// dirty is true if anything was archived since the last Sync
+	dirty bool
+}
+
+// OpenOCILayout opens, or creates, the OCI image layout at path. If path ends in .tar, the layout is
+// unpacked from it to a temp directory, and packed back into it on Sync and Close if anything was archived.
+func OpenOCILayout(path string) (Store, error) {
+	l := ociLayout{dir: path}
+	if strings.HasSuffix(path, ".tar") {
+		dir, err := ioutil.TempDir("", "pruner-archive")
+		if err != nil {
+			return nil, err
+		}
+		l.dir, l.tarball = dir, path
+		if err := untar(path, dir); err != nil && !os.IsNotExist(err) {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	if err := l.init(); err != nil {
+		if l.tarball != "" {
+			os.RemoveAll(l.dir)
+		}
+		return nil, err
+	}
+	return &l, nil
+}
+
+// init writes the oci-layout file and an empty index, if they are missing
+func (l *ociLayout) init() error {
+	if err := os.MkdirAll(filepath.Join(l.dir, "blobs"), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(l.dir, ocispec.ImageLayoutFile)); os.IsNotExist(err) {
+		if err := writeJSON(filepath.Join(l.dir, ocispec.ImageLayoutFile), ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(l.indexPath()); os.IsNotExist(err) {
+		return writeJSON(l.indexPath(), ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: []ocispec.Descriptor{}})
+	}
+	return nil
+}
+
+func (l *ociLayout) indexPath() string {
+	return filepath.Join(l.dir, "index.json")
+}
+
+func (l *ociLayout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(l.dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (l *ociLayout) readIndex() (*ocispec.Index, error) {
+	d, err := ioutil.ReadFile(l.indexPath())
+	if err != nil {
+		return nil, err
+	}
+	index := ocispec.Index{}
+	return &index, json.Unmarshal(d, &index)
+}
+
+// Manifest returns the manifest archived as repo:reference, or with the digest reference
+func (l *ociLayout) Manifest(repo, reference string) (string, []byte, error) {
+	l.mu.Lock()
+	index, err := l.readIndex()
+	l.mu.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+	// the newest match wins, though PutManifest never leaves more than one per name
+	for i := len(index.Manifests) - 1; i >= 0; i-- {
+		desc := index.Manifests[i]
+		if desc.Annotations[ocispec.AnnotationRefName] == fmt.Sprintf("%s:%s", repo, reference) ||
+			(desc.Annotations[AnnotationRepo] == repo && desc.Digest.String() == reference) {
+			d, err := ioutil.ReadFile(l.blobPath(desc.Digest))
+			return desc.MediaType, d, err
+		}
+	}
+	return "", nil, ErrNotArchived
+}
+
+// PutManifest stores the manifest as a blob, and names it repo:tag in the index, replacing any image archived under that name before
+func (l *ociLayout) PutManifest(repo, tag, mediaType string, payload []byte) error {
+	dgst := digest.FromBytes(payload)
+	if err := l.PutBlob(repo, dgst, strings.NewReader(string(payload))); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	index, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s:%s", repo, tag)
+	manifests := []ocispec.Descriptor{}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ocispec.AnnotationRefName] != name {
+			manifests = append(manifests, desc)
+		}
+	}
+	index.Manifests = append(manifests, ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(payload)),
+		Annotations: map[string]string{
+			ocispec.AnnotationRefName: name,
+			AnnotationRepo:            repo,
+			AnnotationArchived:        time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	l.dirty = true
+	return writeJSON(l.indexPath(), index)
+}
+
+// Blob opens the blob
+func (l *ociLayout) Blob(repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	return os.Open(l.blobPath(dgst))
+}
+
+// HasBlob is true if the blob is in the layout. Blobs are shared by all repos.
+func (l *ociLayout) HasBlob(repo string, dgst digest.Digest) (bool, error) {
+	_, err := os.Stat(l.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PutBlob writes the blob to the layout, once it is verified
+func (l *ociLayout) PutBlob(repo string, dgst digest.Digest, r io.Reader) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	dir := filepath.Dir(l.blobPath(dgst))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := spool(dir, dgst, r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.dirty = true
+	l.mu.Unlock()
+	return os.Rename(tmp, l.blobPath(dgst))
+}
+
+// Sync makes sure everything archived so far is on disk at the layout's path, so the images can be
+// deleted from the registry: a tarball is packed back up, and replaced atomically. The whole layout is
+// packed each time anything was archived since the last Sync.
+func (l *ociLayout) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	if l.tarball == "" {
+		// blobs and the index are synced as they are written, but not the directories naming them
+		dirs := []string{l.dir, filepath.Join(l.dir, "blobs")}
+		algs, err := ioutil.ReadDir(filepath.Join(l.dir, "blobs"))
+		if err != nil {
+			return err
+		}
+		for _, alg := range algs {
+			dirs = append(dirs, filepath.Join(l.dir, "blobs", alg.Name()))
+		}
+		for _, dir := range dirs {
+			if err := syncPath(dir); err != nil {
+				return err
+			}
+		}
+	} else {
+		tmp := l.tarball + ".tmp"
+		err := writeTar(l.dir, tmp)
+		if err == nil {
+			err = os.Rename(tmp, l.tarball)
+		}
+		if err == nil {
+			err = syncPath(filepath.Dir(l.tarball))
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("unable to write archive tarball %s: %v", l.tarball, err)
+		}
+	}
+	l.dirty = false
+	return nil
+}
+
+// Close packs the layout back into its tarball, if it has one and anything was archived since the last
+// Sync. If that fails, the unpacked layout is left in place, so nothing archived is lost.
+func (l *ociLayout) Close() error {
+	if l.tarball == "" {
+		return nil
+	}
+	if err := l.Sync(); err != nil {
+		return fmt.Errorf("%v, the archive is left in %s", err, l.dir)
+	}
+	l.tarball = ""
+	return os.RemoveAll(l.dir)
+}
+
+// syncPath flushes the file or directory at path to disk
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// writeJSON writes v to path as JSON, replacing the file atomically
+func writeJSON(path string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeTar packs the files in dir into a tarball at path, leaving out blobs and index files still being written
+func writeTar(dir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".blob-") || strings.HasSuffix(info.Name(), ".tmp") {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// untar unpacks the tarball at path into dir
+func untar(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return ErrUnsafeTarPath
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, tr)
+			dst.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
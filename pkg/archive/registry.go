@@ -0,0 +1,123 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	r "github.com/nokia/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	// manifestMediaTypes are every kind of manifest the registry may store, so it returns them as stored
+	manifestMediaTypes = []string{
+		schema2.MediaTypeManifest,
+		schema1.MediaTypeSignedManifest,
+		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
+		manifestlist.MediaTypeManifestList,
+	}
+
+	// ErrManifestNotFetched is returned when the registry does not return a manifest
+	ErrManifestNotFetched = fmt.Errorf("registry did not return the manifest")
+)
+
+// registryStore is a registry, as a Store. It is both what images are archived from, and optionally
+// the backup registry they are archived to.
+type registryStore struct {
+	*r.Registry
+}
+
+// NewRegistryStore makes a Store of a registry client
+func NewRegistryStore(reg *r.Registry) Store {
+	return &registryStore{reg}
+}
+
+// OpenRegistry connects to the registry at url
+func OpenRegistry(url, username, password string) (Store, error) {
+	reg, err := r.NewCustom(url, r.Options{
+		Username:      username,
+		Password:      password,
+		Logf:          func(format string, args ...interface{}) { log.Debugf(format, args...) },
+		DoInitialPing: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewRegistryStore(reg), nil
+}
+
+// Manifest fetches the manifest, manifest list, or OCI manifest or index, as stored. The payload and media
+// type are returned exactly as the registry sent them, so the manifest keeps its digest.
+func (s *registryStore) Manifest(repo, reference string) (string, []byte, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", s.URL, repo, reference)
+	s.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repo, reference)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, mediaType := range manifestMediaTypes {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%s %s:%s: %s", ErrManifestNotFetched, repo, reference, resp.Status)
+	}
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Header.Get("Content-Type"), payload, nil
+}
+
+// PutManifest pushes the manifest as repo:tag
+func (s *registryStore) PutManifest(repo, tag, mediaType string, payload []byte) error {
+	m, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return err
+	}
+	return s.Registry.PutManifest(repo, tag, m)
+}
+
+// Blob downloads the blob
+func (s *registryStore) Blob(repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	return s.DownloadBlob(repo, dgst)
+}
+
+// HasBlob is true if the blob is already in the repo
+func (s *registryStore) HasBlob(repo string, dgst digest.Digest) (bool, error) {
+	return s.Registry.HasBlob(repo, dgst)
+}
+
+// PutBlob uploads the blob to the repo. The blob is spooled to a temp file first, so it is verified
+// before it is uploaded, and the upload can be retried when the registry asks for a token.
+func (s *registryStore) PutBlob(repo string, dgst digest.Digest, content io.Reader) error {
+	tmp, err := spool("", dgst, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.UploadBlob(repo, dgst, f, func() (io.ReadCloser, error) { return os.Open(tmp) })
+}
+
+// Close does nothing; registries hold nothing back
+func (s *registryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package audit
+
+// audit is an append-only log of every deletion the pruner attempted, one JSON record per line, so
+// "who deleted my image and why" can be answered long after the run's logs are gone.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"go.uber.org/zap"
+)
+
+var (
+	logger, _ = zap.NewProduction()
+	log       = logger.Sugar()
+
+	// ErrLogNotOpen is returned when recording to a Log that was closed
+	ErrLogNotOpen = fmt.Errorf("audit log is not open")
+)
+
+// The outcomes of a deletion
+const (
+	OutcomeDeleted = "deleted"
+	OutcomeFailed  = "failed"
+	// OutcomeQuarantined is an image moved to quarantine, instead of being deleted
+	OutcomeQuarantined = "quarantined"
+)
+
+// Record is one attempted deletion
+type Record struct {
+	Time time.Time `json:"time"`
+	// RunID identifies the run that attempted the deletion; every record of a run has the same one
+	RunID string `json:"run_id"`
+	// Mode is the mode the run was in, i.e. prune or apply
+	Mode     string `json:"mode"`
+	Registry string `json:"registry"`
+	Repo     string `json:"repo"`
+	Tag      string `json:"tag"`
+	Digest   string `json:"digest"`
+	// Rules are the rules that decided to delete the image
+	Rules   []string `json:"rules"`
+	Outcome string   `json:"outcome"`
+	Error   string   `json:"error,omitempty"`
+	// QuarantinedAs is the repo:tag a quarantined image was moved to
+	QuarantinedAs string `json:"quarantined_as,omitempty"`
+}
+
+// NewRecord is the record of attempting to delete m at tNow, which failed if err is not nil
+func NewRecord(tNow time.Time, runID, mode, registryURL string, m *registry.Manifest, rules []string, err error) Record {
+	r := Record{
+		Time:     tNow.UTC(),
+		RunID:    runID,
+		Mode:     mode,
+		Registry: registryURL,
+		Repo:     m.Name,
+		Tag:      m.Tag,
+		Digest:   m.Digest.String(),
+		Rules:    rules,
+		Outcome:  OutcomeDeleted,
+	}
+	if r.Rules == nil {
+		r.Rules = []string{}
+	}
+	if err != nil {
+		r.Outcome = OutcomeFailed
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// NewRunID makes an ID for a run, starting with when it started so IDs sort by time
+func NewRunID(tNow time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", tNow.UTC().Format("20060102T150405Z"), hex.EncodeToString(b))
+}
+
+// Log appends Records to a file. It is safe to use from multiple goroutines.
+type Log struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Open opens, or creates, the audit log at path for appending
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{f: f}, nil
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return ErrLogNotOpen
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Record appends the record to the log as one line
+func (l *Log) Record(r Record) error {
+	d, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return ErrLogNotOpen
+	}
+	// one write per record, so concurrent pruners appending to the same file don't interleave lines
+	_, err = l.f.Write(append(d, '\n'))
+	return err
+}
+
+// Query selects records. Empty fields and zero times match any record.
+type Query struct {
+	Repo   string
+	Tag    string
+	Digest string
+	RunID  string
+	// Since and Until bound when the deletion was attempted; Until is exclusive
+	Since time.Time
+	Until time.Time
+}
+
+// Match is true if the record satisfies the query
+func (q Query) Match(r *Record) bool {
+	switch {
+	case q.Repo != "" && q.Repo != r.Repo:
+		return false
+	case q.Tag != "" && q.Tag != r.Tag:
+		return false
+	case q.Digest != "" && q.Digest != r.Digest:
+		return false
+	case q.RunID != "" && q.RunID != r.RunID:
+		return false
+	case !q.Since.IsZero() && r.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !r.Time.Before(q.Until):
+		return false
+	default:
+		return true
+	}
+}
+
+// Search returns the records in the audit log at path matching the query, oldest first. Lines that are
+// not records, i.e. one cut short by a crash, are skipped with a warning.
+func Search(path string, q Query) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*Record{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warnw("skipping malformed audit record", "file", path, "line", line, "error", err)
+			continue
+		}
+		if q.Match(&r) {
+			records = append(records, &r)
+		}
+	}
+	return records, scanner.Err()
+}
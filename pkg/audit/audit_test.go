@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var tNow = time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+
+func openLog(t *testing.T) (*Log, string, func()) {
+	dir, err := ioutil.TempDir("", "pruner-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, path, func() { os.RemoveAll(dir) }
+}
+
+func TestRecordAndSearch(t *testing.T) {
+	l, path, cleanup := openLog(t)
+	defer cleanup()
+
+	runID := NewRunID(tNow)
+	// record from many goroutines at once, as the delete workers do
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, _ := registry.NewManifest("tumblr/fleeble", fmt.Sprintf("v1.%d.0", i), tNow, map[string]string{})
+			m.Digest = digest.Digest(fmt.Sprintf("sha256:%04d", i))
+			var err error
+			if i == 3 {
+				err = fmt.Errorf("registry said no")
+			}
+			if rerr := l.Record(NewRecord(tNow.Add(time.Duration(i)*time.Hour), runID, "prune", "https://foo.bar", m, []string{"rule 0"}, err)); rerr != nil {
+				t.Error(rerr)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(Record{}); err != ErrLogNotOpen {
+		t.Errorf("expected %v recording to a closed log, got %v", ErrLogNotOpen, err)
+	}
+
+	// a later run appends, and a crash mid-write leaves a partial line
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2026-06-16T00:00:00Z","repo":"tumblr/fl` + "\n")
+	f.Close()
+
+	tests := []struct {
+		query    Query
+		expected int
+	}{
+		{Query{}, 20},
+		{Query{Repo: "tumblr/fleeble"}, 20},
+		{Query{Repo: "tumblr/plumbus"}, 0},
+		{Query{Tag: "v1.3.0"}, 1},
+		{Query{Digest: "sha256:0007"}, 1},
+		{Query{RunID: runID}, 20},
+		{Query{RunID: "nope"}, 0},
+		{Query{Since: tNow.Add(10 * time.Hour)}, 10},
+		{Query{Until: tNow.Add(10 * time.Hour)}, 10},
+		{Query{Since: tNow.Add(5 * time.Hour), Until: tNow.Add(7 * time.Hour)}, 2},
+	}
+	for _, test := range tests {
+		records, err := Search(path, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != test.expected {
+			t.Errorf("%+v: expected %d records, got %d", test.query, test.expected, len(records))
+		}
+	}
+
+	records, err := Search(path, Query{Tag: "v1.3.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := records[0]
+	if r.Outcome != OutcomeFailed || r.Error != "registry said no" || r.Mode != "prune" || r.Registry != "https://foo.bar" || len(r.Rules) != 1 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
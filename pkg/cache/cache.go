@@ -0,0 +1,121 @@
+package cache
+
+// cache is an on-disk cache of the manifests fetched from a registry. Manifests are content addressed,
+// so whatever was fetched for a repo and digest never changes, no matter which tags point at it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// OpenTimeout is how long to wait for another pruner holding the cache file to release it
+	OpenTimeout = 10 * time.Second
+
+	manifestsBucket = []byte("manifests")
+
+	// ErrCacheNotOpen is returned when using a Cache that was closed
+	ErrCacheNotOpen = fmt.Errorf("manifest cache is not open")
+)
+
+// Cache is a bbolt file holding an Entry for each repo and digest
+type Cache struct {
+	db *bolt.DB
+}
+
+// Entry are the fields of a registry.Manifest that come from its manifest and config
+type Entry struct {
+	LastModified time.Time         `json:"last_modified"`
+	Created      time.Time         `json:"created"`
+	Labels       map[string]string `json:"labels"`
+	Size         int64             `json:"size,omitempty"`
+}
+
+// Open opens, or creates, the cache file at path
+func Open(path string) (*Cache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(manifestsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Cache{db: db}, nil
+}
+
+// Close closes the cache file
+func (c *Cache) Close() error {
+	if c.db == nil {
+		return ErrCacheNotOpen
+	}
+	err := c.db.Close()
+	c.db = nil
+	return err
+}
+
+func key(repo string, dgst digest.Digest) []byte {
+	return []byte(fmt.Sprintf("%s@%s", repo, dgst))
+}
+
+// Get returns the manifest for repo:tag at dgst, or nil if it is not cached
+func (c *Cache) Get(repo, tag string, dgst digest.Digest) (*registry.Manifest, error) {
+	if c.db == nil {
+		return nil, ErrCacheNotOpen
+	}
+	if dgst == "" {
+		return nil, nil
+	}
+	var entry *Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(manifestsBucket).Get(key(repo, dgst))
+		if v == nil {
+			return nil
+		}
+		entry = &Entry{}
+		return json.Unmarshal(v, entry)
+	})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	m, err := registry.NewManifest(repo, tag, entry.LastModified, entry.Labels)
+	if err != nil {
+		return nil, err
+	}
+	m.Digest = dgst
+	m.Created = entry.Created
+	m.Size = entry.Size
+	return m, nil
+}
+
+// Put caches the manifest under its repo and digest. Puts from concurrent fetch workers are batched
+// into shared transactions.
+func (c *Cache) Put(m *registry.Manifest) error {
+	if c.db == nil {
+		return ErrCacheNotOpen
+	}
+	if m.Digest == "" {
+		return nil
+	}
+	v, err := json.Marshal(Entry{
+		LastModified: m.LastModified,
+		Created:      m.Created,
+		Labels:       m.Labels,
+		Size:         m.Size,
+	})
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(manifestsBucket).Put(key(m.Name, m.Digest), v)
+	})
+}
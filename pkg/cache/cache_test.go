@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+func TestCacheByDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pruner-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := Open(filepath.Join(dir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lm := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	m, _ := registry.NewManifest("tumblr/fleeble", "v1.0.0", lm, map[string]string{"team": "web"})
+	m.Digest = "sha256:aaaa"
+	m.Created = lm.Add(-time.Hour)
+	if err := c.Put(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same digest under another tag is a hit, because the manifest is content addressed
+	hit, err := c.Get("tumblr/fleeble", "latest", "sha256:aaaa")
+	if err != nil || hit == nil {
+		t.Fatalf("expected a cache hit, got %v, %v", hit, err)
+	}
+	if hit.Tag != "latest" || !hit.LastModified.Equal(lm) || !hit.Created.Equal(m.Created) || hit.Labels["team"] != "web" || hit.Digest != m.Digest {
+		t.Errorf("expected the cached manifest to match what was put, got %+v", hit)
+	}
+
+	for _, miss := range []struct{ repo, digest string }{
+		{"tumblr/fleeble", "sha256:bbbb"},
+		{"tumblr/plumbus", "sha256:aaaa"},
+		{"tumblr/fleeble", ""},
+	} {
+		m, err := c.Get(miss.repo, "v1.0.0", digest.Digest(miss.digest))
+		if err != nil || m != nil {
+			t.Errorf("expected a cache miss for %s@%s, got %v, %v", miss.repo, miss.digest, m, err)
+		}
+	}
+}
@@ -3,21 +3,60 @@ package client
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/docker/distribution/manifest/schema2"
 	r "github.com/nokia/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/archive"
+	"github.com/tumblr/docker-registry-pruner/pkg/audit"
+	"github.com/tumblr/docker-registry-pruner/pkg/cache"
 	"github.com/tumblr/docker-registry-pruner/pkg/config"
 	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/state"
+	"github.com/tumblr/docker-registry-pruner/pkg/undo"
 	"go.uber.org/zap"
 )
 
 var (
 	logger, _ = zap.NewProduction()
 	log       = logger.Sugar()
+
+	// ErrDigestChanged is returned when deleting a manifest whose tag no longer points at the digest it was seen at
+	ErrDigestChanged = fmt.Errorf("tag no longer points at the digest it was decided on")
 )
 
 type Client struct {
 	r.Registry
 	Config *config.Config
+	// State is the inventory of tags seen in previous runs, if the config has a state_file
+	State *state.Store
+	// Cache holds the manifests fetched in previous runs by digest, if the config has a cache_file
+	Cache *cache.Cache
+	// Audit records every attempted deletion, if the config has an audit_log
+	Audit *audit.Log
+	// Archive is where images are copied before they are deleted, if the config has an archive
+	Archive archive.Store
+	// Undo holds the manifests this run deleted, if the config has an undo_dir. It is created on the first deletion
+	Undo *undo.Backup
+	// RunID identifies this run in the audit log and undo_dir
+	RunID string
+	// Mode is the mode this run is in, as recorded in the audit log
+	Mode string
+
+	hits, misses int64
+	// started is when the run started, which quarantined tags are dated by
+	started  time.Time
+	undoOnce sync.Once
+	undoErr  error
+}
+
+// CacheStats counts how many manifests were reused from the cache or state (hits), and how many
+// had to be fetched from the registry (misses)
+type CacheStats struct {
+	Hits   int64
+	Misses int64
 }
 
 type repoTagList struct {
@@ -30,6 +69,11 @@ type repoTag struct {
 	Tag  string
 }
 
+type deleteResult struct {
+	Manifest *registry.Manifest
+	Err      error
+}
+
 func LogCallback(format string, args ...interface{}) {
 	log.Debugf(format, args...)
 }
@@ -52,13 +96,96 @@ func New(c *config.Config) (*Client, error) {
 		return nil, err
 	}
 
+	started := time.Now()
 	client := Client{
 		Registry: *hub,
 		Config:   c,
+		RunID:    audit.NewRunID(started),
+		started:  started,
+	}
+	if c.StateFile != "" {
+		client.State, err = state.Open(c.StateFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.CacheFile != "" && !c.NoCache {
+		client.Cache, err = cache.Open(c.CacheFile)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if c.Archive != nil {
+		client.Archive, err = archive.Open(c.Archive)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if c.AuditLog != "" {
+		client.Audit, err = audit.Open(c.AuditLog)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
 	}
 	return &client, nil
 }
 
+// Close releases the state, cache, audit, archive and undo files, if any
+func (hub *Client) Close() error {
+	var err error
+	if hub.State != nil {
+		err = hub.State.Close()
+	}
+	if hub.Cache != nil {
+		if cerr := hub.Cache.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	if hub.Audit != nil {
+		if aerr := hub.Audit.Close(); aerr != nil {
+			err = aerr
+		}
+	}
+	if hub.Archive != nil {
+		if aerr := hub.Archive.Close(); aerr != nil {
+			err = aerr
+		}
+	}
+	if hub.Undo != nil {
+		if uerr := hub.Undo.Close(); uerr != nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// audit records attempting to delete m, for the rules in deletedBy, in the audit log if there is one
+func (hub *Client) audit(m *registry.Manifest, deletedBy map[string][]string, err error) {
+	if hub.Audit == nil {
+		return
+	}
+	r := audit.NewRecord(time.Now(), hub.RunID, hub.Mode, hub.Config.RegistryURL, m, deletedBy[m.Reference()], err)
+	if err == nil && hub.Config.Disposition == config.DispositionQuarantine {
+		repo, tag := hub.quarantineRef(m)
+		r.Outcome = audit.OutcomeQuarantined
+		r.QuarantinedAs = fmt.Sprintf("%s:%s", repo, tag)
+	}
+	if aerr := hub.Audit.Record(r); aerr != nil {
+		log.Errorw("unable to record deletion in audit log", "repo", m.Name, "tag", m.Tag, "error", aerr)
+	}
+}
+
+// CacheStats returns how many manifests were reused or fetched so far
+func (hub *Client) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&hub.hits),
+		Misses: atomic.LoadInt64(&hub.misses),
+	}
+}
+
 // given a channel of repos, go get the tags for each one
 func (hub *Client) tagFetchWorker(id int, workCh <-chan string, resultCh chan<- repoTagList) {
 
@@ -91,21 +218,33 @@ func (hub *Client) manifestFetchWorker(id int, workCh <-chan repoTag, resultCh c
 	log.Debugf("%d: manifest fetcher exiting", id)
 }
 
-func (hub *Client) deleteManifestWorker(id int, workCh <-chan *registry.Manifest, resultCh chan<- error) {
+func (hub *Client) deleteManifestWorker(id int, workCh <-chan *registry.Manifest, resultCh chan<- deleteResult, deletedBy map[string][]string) {
 	for m := range workCh {
 		log.Infof("%d: deleting manifest for %s:%s", id, m.Name, m.Tag)
 		err := hub.DeleteManifest(m)
+		hub.audit(m, deletedBy, err)
 		if err != nil {
 			log.Errorf("%d: error deleting manifest for %s:%s: %v", id, m.Name, m.Tag, err)
-			resultCh <- fmt.Errorf("error deleting manifest %s:%s: %v", m.Name, m.Tag, err)
+			resultCh <- deleteResult{Manifest: m, Err: fmt.Errorf("error deleting manifest %s:%s: %v", m.Name, m.Tag, err)}
 		} else {
 			log.Infof("%d: manifest %s:%s successfully deleted", id, m.Name, m.Tag)
-			resultCh <- nil
+			resultCh <- deleteResult{Manifest: m}
 		}
 	}
 	log.Debugf("%d: delete manifest worker exiting", id)
 }
 
+// withoutQuarantine is repos, without the quarantine repos
+func (hub *Client) withoutQuarantine(repos []string) []string {
+	res := []string{}
+	for _, repo := range repos {
+		if !hub.Config.Quarantine.Contains(repo) {
+			res = append(res, repo)
+		}
+	}
+	return res
+}
+
 func (hub *Client) RepoTags(repos []string) (map[string][]string, error) {
 	var err error
 	repositories := repos
@@ -114,6 +253,10 @@ func (hub *Client) RepoTags(repos []string) (map[string][]string, error) {
 		if err != nil {
 			return nil, err
 		}
+		// quarantined images are only purged once they expire; rules must not prune or quarantine them again
+		if hub.Config.Disposition == config.DispositionQuarantine {
+			repositories = hub.withoutQuarantine(repositories)
+		}
 	}
 
 	// because this is a slow process, lets speed itup by making this a workqueue
@@ -155,12 +298,79 @@ func (hub *Client) RepoTags(repos []string) (map[string][]string, error) {
 }
 
 func (hub *Client) Manifest(repo, tag string) (*registry.Manifest, error) {
-	m, err := hub.ManifestV1(repo, tag)
+	// the digest of the schema1 manifest is not the digest the image is referenced and deleted by,
+	// so ask the registry for the descriptor of the manifest as it is stored
+	desc, err := hub.Registry.ManifestDescriptor(repo, tag)
 	if err != nil {
 		return nil, err
 	}
 
-	return registry.FromSignedManifest(m)
+	manifest, err := hub.reuseManifest(repo, tag, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		atomic.AddInt64(&hub.hits, 1)
+		log.Debugf("%s:%s unchanged at %s, reusing manifest", repo, tag, desc.Digest)
+	} else {
+		atomic.AddInt64(&hub.misses, 1)
+		m, err := hub.ManifestV1(repo, tag)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err = registry.FromSignedManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Digest = desc.Digest
+		manifest.Size = hub.imageSize(repo, tag, desc.MediaType)
+		if hub.Cache != nil {
+			if err := hub.Cache.Put(manifest); err != nil {
+				log.Warnw("unable to cache manifest", "repo", repo, "tag", tag, "digest", desc.Digest, "error", err)
+			}
+		}
+	}
+
+	if hub.State != nil {
+		return manifest, hub.State.Observe(manifest, time.Now())
+	}
+	return manifest, nil
+}
+
+// imageSize is the size of the config and layers of the image repo:tag, if it is stored as a schema2
+// manifest. The schema1 manifest the rest of the Manifest comes from does not have sizes.
+func (hub *Client) imageSize(repo, tag, mediaType string) int64 {
+	if mediaType != schema2.MediaTypeManifest {
+		return 0
+	}
+	m, err := hub.ManifestV2(repo, tag)
+	if err != nil {
+		log.Debugf("unable to fetch schema2 manifest of %s:%s for its size: %v", repo, tag, err)
+		return 0
+	}
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size
+}
+
+// reuseManifest returns the manifest at dgst from the cache, or from the state if the tag pointed at dgst
+// last time it was seen. It is nil if the manifest has to be fetched.
+func (hub *Client) reuseManifest(repo, tag string, dgst digest.Digest) (*registry.Manifest, error) {
+	if hub.Config.NoCache {
+		return nil, nil
+	}
+	if hub.Cache != nil {
+		manifest, err := hub.Cache.Get(repo, tag, dgst)
+		if err != nil || manifest != nil {
+			return manifest, err
+		}
+	}
+	if hub.State != nil {
+		return hub.State.Lookup(repo, tag, dgst)
+	}
+	return nil, nil
 }
 
 func (hub *Client) Manifests(repoTags map[string][]string) ([]*registry.Manifest, error) {
@@ -203,24 +413,28 @@ func (hub *Client) Manifests(repoTags map[string][]string) ([]*registry.Manifest
 		manifests = append(manifests, res)
 	}
 
+	stats := hub.CacheStats()
+	log.Infow("fetched manifests", "manifests", len(manifests), "cache_hits", stats.Hits, "cache_misses", stats.Misses)
 	return manifests, nil
 }
 
-func (hub *Client) DeleteManifestsParallel(manifests []*registry.Manifest) (int, []error) {
+// DeleteManifestsParallel deletes the manifests, returning those that were deleted and the errors deleting the rest.
+// deletedBy are the names of the rules that decided to delete each manifest, by Reference, for the audit log.
+func (hub *Client) DeleteManifestsParallel(manifests []*registry.Manifest, deletedBy map[string][]string) ([]*registry.Manifest, []error) {
 	// TODO(gabe) we should figure out how to abstract this parallel worker pattern into a generic system
 
 	wg := sync.WaitGroup{}
 	workCh := make(chan *registry.Manifest)
-	resultCh := make(chan error)
+	resultCh := make(chan deleteResult)
 	nWorkers := hub.Config.Parallelism
 	if nWorkers <= 0 {
 		nWorkers = 1
 	}
-	go func(wg *sync.WaitGroup, resultCh chan error, workCh chan *registry.Manifest) {
+	go func(wg *sync.WaitGroup, resultCh chan deleteResult, workCh chan *registry.Manifest) {
 		for i := 0; i < nWorkers; i++ {
 			wg.Add(1)
 			go func(i int, wg *sync.WaitGroup) {
-				hub.deleteManifestWorker(i, workCh, resultCh)
+				hub.deleteManifestWorker(i, workCh, resultCh, deletedBy)
 				wg.Done()
 			}(i, wg)
 		}
@@ -238,22 +452,24 @@ func (hub *Client) DeleteManifestsParallel(manifests []*registry.Manifest) (int,
 	}(workCh, manifests)
 
 	errs := []error{}
-	deleted := 0
-	for err := range resultCh {
-		if err != nil {
-			errs = append(errs, err)
+	deleted := []*registry.Manifest{}
+	for res := range resultCh {
+		if res.Err != nil {
+			errs = append(errs, res.Err)
 		} else {
-			deleted = deleted + 1
+			deleted = append(deleted, res.Manifest)
 		}
 	}
 
 	return deleted, errs
 }
 
-func (hub *Client) DeleteManifests(manifests []*registry.Manifest) []error {
+// DeleteManifests is DeleteManifestsParallel, one manifest at a time
+func (hub *Client) DeleteManifests(manifests []*registry.Manifest, deletedBy map[string][]string) []error {
 	errs := []error{}
 	for _, m := range manifests {
 		err := hub.DeleteManifest(m)
+		hub.audit(m, deletedBy, err)
 		if err != nil {
 			log.Errorf("unable to delete %s:%s: %v", m.Name, m.Tag, err)
 			errs = append(errs, err)
@@ -262,10 +478,57 @@ func (hub *Client) DeleteManifests(manifests []*registry.Manifest) []error {
 	return errs
 }
 
+// DeleteManifest deletes the manifest the tag points at. If the manifest has a Digest, the tag
+// must still point at it, otherwise the manifest is not deleted and ErrDigestChanged is returned.
+// If there is an Archive, the image is archived first, and with an undo_dir its manifest is saved first.
+// With the quarantine disposition, the image is copied to its quarantine repo first. If any of these
+// fail, the image is not deleted.
 func (hub *Client) DeleteManifest(m *registry.Manifest) error {
 	desc, err := hub.Registry.ManifestDescriptor(m.Name, m.Tag)
 	if err != nil {
 		return err
 	}
+	if m.Digest != "" && desc.Digest != m.Digest {
+		log.Warnw("tag moved since it was decided on, not deleting", "repo", m.Name, "tag", m.Tag, "decided", m.Digest, "current", desc.Digest)
+		return ErrDigestChanged
+	}
+	if hub.Archive != nil {
+		if _, err := archive.Copy(archive.NewRegistryStore(&hub.Registry), hub.Archive, m.Name, desc.Digest.String(), m.Tag); err != nil {
+			return fmt.Errorf("unable to archive, not deleting: %v", err)
+		}
+		// the image must be on disk in the archive before it is gone from the registry
+		if s, ok := hub.Archive.(archive.Syncer); ok {
+			if err := s.Sync(); err != nil {
+				return fmt.Errorf("unable to write archive, not deleting: %v", err)
+			}
+		}
+		log.Infow("archived image", "repo", m.Name, "tag", m.Tag, "digest", desc.Digest)
+	}
+	if err := hub.saveForUndo(m, desc.Digest); err != nil {
+		return fmt.Errorf("unable to save manifest for undo, not deleting: %v", err)
+	}
+	if hub.Config.Disposition == config.DispositionQuarantine {
+		if err := hub.quarantine(m, desc.Digest); err != nil {
+			return fmt.Errorf("unable to quarantine, not deleting: %v", err)
+		}
+	}
 	return hub.Registry.DeleteManifest(m.Name, desc.Digest)
 }
+
+// saveForUndo saves the manifest of m at dgst in the run's directory in the undo_dir, if the config has one
+func (hub *Client) saveForUndo(m *registry.Manifest, dgst digest.Digest) error {
+	if hub.Config.UndoDir == "" {
+		return nil
+	}
+	hub.undoOnce.Do(func() {
+		hub.Undo, hub.undoErr = undo.Create(hub.Config.UndoDir, hub.RunID)
+	})
+	if hub.undoErr != nil {
+		return hub.undoErr
+	}
+	mediaType, payload, err := archive.NewRegistryStore(&hub.Registry).Manifest(m.Name, dgst.String())
+	if err != nil {
+		return err
+	}
+	return hub.Undo.Save(m.Name, m.Tag, dgst, mediaType, payload)
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/tumblr/docker-registry-pruner/pkg/archive"
+	"github.com/tumblr/docker-registry-pruner/pkg/audit"
+	"github.com/tumblr/docker-registry-pruner/pkg/quarantine"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+// quarantineRef is the repo and tag m is quarantined as in this run
+func (hub *Client) quarantineRef(m *registry.Manifest) (string, string) {
+	return hub.Config.Quarantine.Repo(m.Name), quarantine.Tag(m.Tag, hub.started)
+}
+
+// quarantine copies the image at dgst to its quarantine repo, mounting its blobs from its repo so nothing
+// is uploaded again, and pushing its manifest under the quarantined tag
+func (hub *Client) quarantine(m *registry.Manifest, dgst digest.Digest) error {
+	repo, tag := hub.quarantineRef(m)
+	mediaType, payload, err := archive.NewRegistryStore(&hub.Registry).Manifest(m.Name, dgst.String())
+	if err != nil {
+		return err
+	}
+	if mediaType == manifestlist.MediaTypeManifestList || mediaType == ocispec.MediaTypeImageIndex {
+		return archive.ErrManifestListUnsupported
+	}
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return err
+	}
+	mounted := map[digest.Digest]bool{}
+	for _, ref := range manifest.References() {
+		// foreign layers are not stored in registries, so there is nothing to mount
+		if mounted[ref.Digest] || ref.MediaType == schema2.MediaTypeForeignLayer {
+			continue
+		}
+		mounted[ref.Digest] = true
+		if err := hub.mountBlob(m.Name, repo, ref.Digest); err != nil {
+			return fmt.Errorf("mounting blob %s: %v", ref.Digest, err)
+		}
+	}
+	if err := hub.Registry.PutManifest(repo, tag, manifest); err != nil {
+		return err
+	}
+	log.Infow("quarantined image", "repo", m.Name, "tag", m.Tag, "digest", dgst, "quarantined_as", fmt.Sprintf("%s:%s", repo, tag))
+	return nil
+}
+
+// mountBlob makes the blob in repo from available in repo to, with a cross repo mount. Registries that
+// don't mount start an upload instead; the blob is then copied, and the started upload left to expire.
+func (hub *Client) mountBlob(from, to string, dgst digest.Digest) error {
+	q := url.Values{}
+	q.Set("mount", dgst.String())
+	q.Set("from", from)
+	mountURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/?%s", hub.Registry.URL, to, q.Encode())
+	resp, err := hub.Registry.Client.Post(mountURL, "application/octet-stream", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+	log.Debugw("registry did not mount blob, copying it", "from", from, "to", to, "digest", dgst, "status", resp.StatusCode)
+	store := archive.NewRegistryStore(&hub.Registry)
+	blob, err := store.Blob(from, dgst)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	return store.PutBlob(to, dgst, blob)
+}
+
+// PurgeQuarantine deletes the quarantined images whose quarantine expired at tNow, from every repo under the
+// quarantine prefix, and returns how many were deleted and the errors deleting the rest. An image is only
+// deleted once every quarantined tag on its digest expired, as deleting the digest deletes them all. Every
+// deletion is audited.
+func (hub *Client) PurgeQuarantine(tNow time.Time) (int, []error) {
+	deleted, errs := 0, []error{}
+	repos, err := hub.Repositories()
+	if err != nil {
+		return deleted, []error{fmt.Errorf("error listing quarantine repos: %v", err)}
+	}
+	for _, qrepo := range repos {
+		if !hub.Config.Quarantine.Contains(qrepo) {
+			continue
+		}
+		tags, err := hub.Tags(qrepo)
+		if err != nil {
+			log.Errorw("unable to list quarantined tags", "repo", qrepo, "error", err)
+			errs = append(errs, fmt.Errorf("error listing %s: %v", qrepo, err))
+			continue
+		}
+		tagsByDigest, err := hub.tagsByDigest(qrepo, tags)
+		if err != nil {
+			// without every tag's digest, a digest might be deleted from under a tag that did not expire
+			log.Errorw("unable to find digests of quarantined tags", "repo", qrepo, "error", err)
+			errs = append(errs, fmt.Errorf("error purging %s: %v", qrepo, err))
+			continue
+		}
+		for _, dgst := range hub.Config.Quarantine.Purgeable(tagsByDigest, tNow) {
+			err := hub.Registry.DeleteManifest(qrepo, digest.Digest(dgst))
+			for _, tag := range tagsByDigest[dgst] {
+				if hub.Audit == nil {
+					break
+				}
+				m, merr := registry.NewManifest(qrepo, tag, time.Time{}, map[string]string{})
+				if merr != nil {
+					log.Errorw("unable to record deletion in audit log", "repo", qrepo, "tag", tag, "error", merr)
+					continue
+				}
+				m.Digest = digest.Digest(dgst)
+				if aerr := hub.Audit.Record(audit.NewRecord(time.Now(), hub.RunID, hub.Mode, hub.Config.RegistryURL, m, []string{"quarantine"}, err)); aerr != nil {
+					log.Errorw("unable to record deletion in audit log", "repo", qrepo, "tag", tag, "error", aerr)
+				}
+			}
+			if err != nil {
+				log.Errorw("unable to purge quarantined image", "repo", qrepo, "tags", tagsByDigest[dgst], "digest", dgst, "error", err)
+				errs = append(errs, fmt.Errorf("error purging %s@%s: %v", qrepo, dgst, err))
+				continue
+			}
+			log.Infow("purged quarantined image", "repo", qrepo, "tags", tagsByDigest[dgst], "digest", dgst)
+			deleted += len(tagsByDigest[dgst])
+		}
+	}
+	return deleted, errs
+}
+
+// tagsByDigest groups the tags of repo by the digest they point to
+func (hub *Client) tagsByDigest(repo string, tags []string) (map[string][]string, error) {
+	byDigest := map[string][]string{}
+	for _, tag := range tags {
+		desc, err := hub.Registry.ManifestDescriptor(repo, tag)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %v", repo, tag, err)
+		}
+		byDigest[desc.Digest.String()] = append(byDigest[desc.Digest.String()], tag)
+	}
+	return byDigest, nil
+}
@@ -1,11 +1,20 @@
 package config
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/tumblr/docker-registry-pruner/pkg/archive"
+	"github.com/tumblr/docker-registry-pruner/pkg/limits"
+	"github.com/tumblr/docker-registry-pruner/pkg/pins"
+	"github.com/tumblr/docker-registry-pruner/pkg/protect"
+	"github.com/tumblr/docker-registry-pruner/pkg/quarantine"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
 	"github.com/tumblr/docker-registry-pruner/pkg/rules"
 	"gopkg.in/yaml.v2"
 )
@@ -17,6 +26,20 @@ var (
 	ErrMissingRegistry = fmt.Errorf("missing 'registry' key")
 	// ErrNoRulesLoaded
 	ErrNoRulesLoaded = fmt.Errorf("no rules loaded - did you forget to specify the 'rules' list?")
+	// ErrMultiplePolicies is returned when a rule's policy map has more than one entry
+	ErrMultiplePolicies = fmt.Errorf("policy must have exactly one entry")
+	// ErrGracePeriodNeedsState is returned when a grace period is set without a state_file to remember pending images in
+	ErrGracePeriodNeedsState = fmt.Errorf("grace_period_days needs a state_file")
+	// ErrUnknownDisposition is returned when disposition is not one of the Disposition constants
+	ErrUnknownDisposition = fmt.Errorf("disposition must be %s or %s", DispositionDelete, DispositionQuarantine)
+)
+
+// What is done to the images the rules decide to delete
+const (
+	// DispositionDelete deletes them
+	DispositionDelete = "delete"
+	// DispositionQuarantine moves them to a quarantine repo, and deletes them from there once they expire
+	DispositionQuarantine = "quarantine"
 )
 
 type Config struct {
@@ -26,24 +49,114 @@ type Config struct {
 	UsernameFile string `yaml:"username_file"`
 	PasswordFile string `yaml:"password_file"`
 	Parallelism  int    `yaml:"parallel_workers"`
+	// StateFile is where the inventory of tags seen across runs is kept. If empty, nothing is kept
+	StateFile string `yaml:"state_file"`
+	// CacheFile is where manifests are cached by digest across runs. If empty, nothing is cached
+	CacheFile string `yaml:"cache_file"`
+	// NoCache fetches every manifest from the registry, ignoring the cache and state
+	NoCache bool `yaml:"-"`
+	// PlanKeyFile holds a secret key plans are signed with, so plans can't be altered without it
+	PlanKeyFile string `yaml:"plan_key_file"`
+	PlanKey     []byte `yaml:"-"`
+	// AuditLog is where every attempted deletion is appended, as JSON lines. If empty, deletions are only logged
+	AuditLog string `yaml:"audit_log"`
+	// UndoDir is where the manifests each run deletes are saved, in a directory per run, so the run can be undone.
+	// If empty, manifests are not saved
+	UndoDir string `yaml:"undo_dir"`
+	// Archive is where images are copied before they are deleted. If nil, they are not archived
+	Archive *archive.Config `yaml:"archive"`
+	// Disposition is what is done to images the rules decide to delete; DispositionDelete (default) or DispositionQuarantine
+	Disposition string `yaml:"disposition"`
+	// Quarantine is where images are moved to, with DispositionQuarantine
+	Quarantine quarantine.Config `yaml:"quarantine"`
+	// GracePeriodDays is how many days images must stay marked for deletion, in consecutive runs, before
+	// they are deleted. Rules may set their own. If 0, images are deleted as soon as they are marked
+	GracePeriodDays int `yaml:"grace_period_days"`
+	// Protect finds the images that are never deleted, whatever the rules decide, because something depends on them
+	Protect protect.Config `yaml:"protect"`
+	// Pins are images that are never deleted, until they expire. They are applied after all rules
+	Pins []*pins.Pin `yaml:"pins"`
+	// PinsFile is a file with more pins, under a pins key as in the config, so pins can be kept apart from it
+	PinsFile string `yaml:"pins_file"`
+	// Limits bound how much a single run may delete
+	Limits limits.Limits `yaml:"limits"`
+	// Hash is the sha256 digest of the config file, its pins_file and its rules' scripts, so plans can tell
+	// if what the config decides changed
+	Hash string `yaml:"-"`
 	// ConfigRules are the loaded rules from the config - these are parsed into actual []rules.Rule
 	ConfigRules []*ConfigRule `yaml:"rules"`
 	Rules       []*rules.Rule `yaml:"-"`
 }
 
 type ConfigRule struct {
+	// Name identifies the rule in reports. If empty, rules are identified by their position
+	Name   string `yaml:"name"`
 	Repos  []string
 	Labels map[string]string
 	// IgnoreTags will ignore all manifests with the matching tags (regex)
 	IgnoreTags []string `yaml:"ignore_tags"`
 	// MatchTags will restrict the rule to only apply to manifests matching the regex tag
 	MatchTags []string `yaml:"match_tags"`
+	// Expr is a CEL expression over repo, tag, version, age_days, labels and digest that manifests must satisfy
+	Expr string `yaml:"expr"`
 	// KeepVersions is how many of the latest images to keep, sorted by version
 	KeepVersions int `yaml:"keep_versions"`
 	// KeepDays is how many days of the images to keep, sorted by last modified
 	KeepDays int `yaml:"keep_days"`
 	// KeepMostRecent keeps the latest N images, sorted by last modified
 	KeepMostRecent int `yaml:"keep_recent"`
+	// KeepSchedule keeps images on a grandfather-father-son schedule. See rules.KeepSchedulePolicy
+	KeepSchedule interface{} `yaml:"keep_schedule"`
+	// LabelPolicy lets each image declare its own retention with labels. See rules.LabelPolicy
+	LabelPolicy interface{} `yaml:"label_policy"`
+	// Script delegates retention to a Starlark script. See ConfigScript and rules.Script
+	Script interface{} `yaml:"script"`
+	// Policy is a RetentionPolicy registered with rules.RegisterPolicy, as a single entry map of name to its config
+	Policy map[string]interface{} `yaml:"policy"`
+	// Match are Matchers registered with rules.RegisterMatcher, as a map of name to their config. Images must match all of them
+	Match map[string]interface{} `yaml:"match"`
+	// MinKeep always keeps the latest N images, sorted by last modified, regardless of the action
+	MinKeep int `yaml:"min_keep"`
+	// MaxAgeDays deletes images older than N days, even if the action would keep them
+	MaxAgeDays int `yaml:"max_age_days"`
+	// VersionRegex extracts the version from a tag with a (?P<version>...) capture group, for keep_versions and expr
+	VersionRegex string `yaml:"version_regex"`
+	// VersionScheme is how versions are parsed and ordered for keep_versions; for keep_versions and expr; one of semver (default), calver, integer, natural
+	VersionScheme string `yaml:"version_scheme"`
+	// GroupBy partitions the selected images, and applies the action within each partition
+	GroupBy *ConfigGroupBy `yaml:"group_by"`
+	// AgeSource is where the age of images comes from, instead of their history
+	AgeSource *ConfigAgeSource `yaml:"age_source"`
+	// GracePeriodDays overrides the config's grace_period_days for images this rule deletes
+	GracePeriodDays int `yaml:"grace_period_days"`
+}
+
+// ConfigGroupBy is how a rule partitions the images it selects. Only one of Tag or Label may be set.
+type ConfigGroupBy struct {
+	// Tag is a regex with a (?P<group>...) capture group, extracting the group from the tag
+	Tag string
+	// Label is the name of a label whose value is the group
+	Label string
+}
+
+// ConfigScript is a rule's script. See rules.Script
+type ConfigScript struct {
+	// File is the path of the script, relative to the config file unless it is absolute
+	File string
+	// MaxSteps limits how many steps the script may execute per evaluation. If 0, rules.DefaultScriptMaxSteps
+	MaxSteps uint64 `yaml:"max_steps"`
+}
+
+// ConfigAgeSource is where a rule takes the age of images from. See rules.AgeSource
+type ConfigAgeSource struct {
+	// Source is one of history (default), created, label, tag, or first_seen
+	Source string
+	// Label is the label holding an RFC3339 timestamp, for the label source
+	Label string
+	// TagRegex is a regex with a (?P<timestamp>...) capture group, for the tag source
+	TagRegex string `yaml:"tag_regex"`
+	// TagFormat is the Go time layout of the timestamp in the tag, or unix (default) for unix seconds
+	TagFormat string `yaml:"tag_format"`
 }
 
 func LoadFromFile(file string) (*Config, error) {
@@ -57,6 +170,8 @@ func LoadFromFile(file string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	hash := sha256.New()
+	hash.Write(d)
 
 	// Support reading username/password from files if present
 	if c.UsernameFile != "" {
@@ -73,16 +188,58 @@ func LoadFromFile(file string) (*Config, error) {
 		}
 		c.Password = strings.TrimSpace(string(s))
 	}
+	if c.Archive != nil && c.Archive.UsernameFile != "" {
+		s, err := ioutil.ReadFile(c.Archive.UsernameFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Archive.Username = strings.TrimSpace(string(s))
+	}
+	if c.Archive != nil && c.Archive.PasswordFile != "" {
+		s, err := ioutil.ReadFile(c.Archive.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Archive.Password = strings.TrimSpace(string(s))
+	}
+	if c.PlanKeyFile != "" {
+		s, err := ioutil.ReadFile(c.PlanKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.PlanKey = []byte(strings.TrimSpace(string(s)))
+	}
+	if c.PinsFile != "" {
+		ps, err := pins.LoadFile(c.PinsFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Pins = append(c.Pins, ps...)
+		pd, err := ioutil.ReadFile(c.PinsFile)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write(pd)
+	}
 
-	rs, err := rulesFromConfigRules(c.ConfigRules)
+	rs, err := rulesFromConfigRules(c.ConfigRules, filepath.Dir(file))
 	if err != nil {
 		return nil, err
 	}
 	c.Rules = rs
+	for _, r := range c.Rules {
+		if s, ok := r.Policy.(*rules.Script); ok {
+			hash.Write(s.Source)
+		}
+	}
+	c.Hash = fmt.Sprintf("sha256:%x", hash.Sum(nil))
 
 	if c.Parallelism == 0 {
 		c.Parallelism = DefaultParallelism
 	}
+	if c.Disposition == "" {
+		c.Disposition = DispositionDelete
+	}
 
 	return &c, c.Validate()
 }
@@ -100,16 +257,49 @@ func (c *Config) Validate() error {
 	if len(c.Rules) == 0 {
 		return ErrNoRulesLoaded
 	}
-	return nil
+	if c.Archive != nil {
+		if err := c.Archive.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Protect.Validate(); err != nil {
+		return err
+	}
+	for _, p := range c.Pins {
+		if err := p.Parse(); err != nil {
+			return err
+		}
+	}
+	if c.Disposition != DispositionDelete && c.Disposition != DispositionQuarantine {
+		return ErrUnknownDisposition
+	}
+	if err := c.Quarantine.Validate(); err != nil {
+		return err
+	}
+	if c.GracePeriodDays < 0 {
+		return rules.ErrGracePeriodDaysMustBePositive
+	}
+	if c.StateFile == "" {
+		if c.GracePeriodDays > 0 {
+			return ErrGracePeriodNeedsState
+		}
+		for _, r := range c.Rules {
+			if r.GracePeriodDays > 0 {
+				return ErrGracePeriodNeedsState
+			}
+		}
+	}
+	return c.Limits.Validate()
 }
 
-func rulesFromConfigRules(crs []*ConfigRule) ([]*rules.Rule, error) {
+// rulesFromConfigRules builds the rules of a config in dir, which their scripts are relative to
+func rulesFromConfigRules(crs []*ConfigRule, dir string) ([]*rules.Rule, error) {
 	rules := make([]*rules.Rule, len(crs))
 	for i, cr := range crs {
 		if !contains(cr.IgnoreTags, "latest") {
 			cr.IgnoreTags = append(cr.IgnoreTags, "^latest$")
 		}
-		r, err := ruleFromConfigRule(cr)
+		r, err := ruleFromConfigRule(cr, dir)
 		if err != nil {
 			return nil, err
 		}
@@ -127,8 +317,9 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func ruleFromConfigRule(cr *ConfigRule) (*rules.Rule, error) {
+func ruleFromConfigRule(cr *ConfigRule, dir string) (*rules.Rule, error) {
 	r := rules.Rule{
+		Name: cr.Name,
 		Selector: rules.Selector{
 			Repos:      cr.Repos,
 			Labels:     cr.Labels,
@@ -138,6 +329,10 @@ func ruleFromConfigRule(cr *ConfigRule) (*rules.Rule, error) {
 		KeepDays:       cr.KeepDays,
 		KeepVersions:   cr.KeepVersions,
 		KeepMostRecent: cr.KeepMostRecent,
+		MinKeep:        cr.MinKeep,
+		MaxAgeDays:     cr.MaxAgeDays,
+
+		GracePeriodDays: cr.GracePeriodDays,
 	}
 	if r.Selector.Labels == nil {
 		r.Selector.Labels = map[string]string{}
@@ -156,5 +351,129 @@ func ruleFromConfigRule(cr *ConfigRule) (*rules.Rule, error) {
 		}
 		r.IgnoreTags = append(r.IgnoreTags, x)
 	}
+	scheme, err := registry.VersionSchemeByName(cr.VersionScheme)
+	if err != nil {
+		return nil, err
+	}
+	r.VersionScheme = scheme
+	if cr.Expr != "" {
+		x, err := rules.CompileExpression(cr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		r.Expr = x
+	}
+	names := []string{}
+	for name := range cr.Match {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m, err := rules.NewMatcher(name, unmarshalerFor(cr.Match[name]))
+		if err != nil {
+			return nil, err
+		}
+		r.Matchers = append(r.Matchers, m)
+	}
+	if len(cr.Policy) > 1 {
+		return nil, ErrMultiplePolicies
+	}
+	// keep_schedule, label_policy and script are built in policies, with their own keys
+	policies := map[string]interface{}{}
+	if cr.KeepSchedule != nil {
+		policies["keep_schedule"] = cr.KeepSchedule
+	}
+	if cr.LabelPolicy != nil {
+		policies["label_policy"] = cr.LabelPolicy
+	}
+	if cr.Script != nil {
+		policies["script"] = cr.Script
+	}
+	for name, pc := range cr.Policy {
+		policies[name] = pc
+	}
+	if len(policies) > 1 {
+		return nil, rules.ErrMultipleActionPolicy
+	}
+	for name, pc := range policies {
+		var p rules.RetentionPolicy
+		var err error
+		if name == "script" {
+			p, err = loadScript(unmarshalerFor(pc), dir)
+		} else {
+			p, err = rules.NewPolicy(name, unmarshalerFor(pc))
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Policy = p
+	}
+	if cr.GroupBy != nil {
+		r.GroupByLabel = cr.GroupBy.Label
+		if cr.GroupBy.Tag != "" {
+			x, err := regexp.Compile(cr.GroupBy.Tag)
+			if err != nil {
+				return nil, err
+			}
+			r.GroupByTag = x
+		}
+	}
+	if cr.AgeSource != nil {
+		r.AgeSource = &rules.AgeSource{
+			Source:    cr.AgeSource.Source,
+			Label:     cr.AgeSource.Label,
+			TagFormat: cr.AgeSource.TagFormat,
+		}
+		if r.AgeSource.Source == "" {
+			r.AgeSource.Source = registry.AgeSourceHistory
+		}
+		if r.AgeSource.TagFormat == "" {
+			r.AgeSource.TagFormat = rules.AgeSourceUnixFormat
+		}
+		if cr.AgeSource.TagRegex != "" {
+			x, err := regexp.Compile(cr.AgeSource.TagRegex)
+			if err != nil {
+				return nil, err
+			}
+			r.AgeSource.TagRegex = x
+		}
+	}
+	if cr.VersionRegex != "" {
+		x, err := regexp.Compile(cr.VersionRegex)
+		if err != nil {
+			return nil, err
+		}
+		r.VersionRegex = x
+	}
+	if r.Expr != nil {
+		r.Expr.VersionRegex, r.Expr.VersionScheme = r.VersionRegex, r.VersionScheme
+	}
+	if s, ok := r.Policy.(*rules.Script); ok {
+		s.VersionRegex, s.VersionScheme = r.VersionRegex, r.VersionScheme
+	}
 	return &r, nil
 }
+
+// loadScript loads a rule's script, from a file relative to the config's dir unless it is absolute
+func loadScript(unmarshal rules.Unmarshaler, dir string) (*rules.Script, error) {
+	c := ConfigScript{}
+	if err := unmarshal(&c); err != nil {
+		return nil, err
+	}
+	file := c.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	return rules.LoadScript(file, c.MaxSteps)
+}
+
+// unmarshalerFor decodes the raw yaml of a Matcher or RetentionPolicy's config into its own type
+func unmarshalerFor(raw interface{}) rules.Unmarshaler {
+	return func(v interface{}) error {
+		d, err := yaml.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		return yaml.Unmarshal(d, v)
+	}
+}
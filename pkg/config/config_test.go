@@ -1,9 +1,19 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/tumblr/docker-registry-pruner/internal/pkg/testing"
+	"github.com/tumblr/docker-registry-pruner/pkg/archive"
+	"github.com/tumblr/docker-registry-pruner/pkg/limits"
+	"github.com/tumblr/docker-registry-pruner/pkg/pins"
+	"github.com/tumblr/docker-registry-pruner/pkg/protect"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
 	"github.com/tumblr/docker-registry-pruner/pkg/rules"
 )
 
@@ -44,6 +54,86 @@ var (
 			file:     "invalid-rule-duplicate-action-versions-latest.yaml",
 			expected: rules.ErrMultipleActionLatestVersions,
 		},
+		{
+			file:     "invalid-rule-version-regex-missing-group.yaml",
+			expected: rules.ErrVersionRegexMissingGroup,
+		},
+		{
+			file:     "invalid-rule-unknown-version-scheme.yaml",
+			expected: registry.ErrUnknownVersionScheme,
+		},
+		{
+			file:     "invalid-rule-negative-min-keep.yaml",
+			expected: rules.ErrMinKeepMustBePositive,
+		},
+		{
+			file:     "invalid-rule-group-by-tag-and-label.yaml",
+			expected: rules.ErrGroupByTagAndLabel,
+		},
+		{
+			file:     "invalid-rule-group-by-missing-group.yaml",
+			expected: rules.ErrGroupByRegexMissingGroup,
+		},
+		{
+			file:     "invalid-rule-label-policy-and-keep-days.yaml",
+			expected: rules.ErrMultipleActionPolicy,
+		},
+		{
+			file:     "invalid-rule-expr-not-bool.yaml",
+			expected: rules.ErrExprMustBeBool,
+		},
+		{
+			file:     "invalid-rule-script-missing-retain.yaml",
+			expected: rules.ErrScriptMissingEntrypoint,
+		},
+		{
+			file:     "invalid-rule-unknown-policy.yaml",
+			expected: rules.ErrUnknownPolicy,
+		},
+		{
+			file:     "invalid-rule-multiple-policies.yaml",
+			expected: ErrMultiplePolicies,
+		},
+		{
+			file:     "invalid-rule-keep-schedule-empty.yaml",
+			expected: rules.ErrKeepScheduleEmpty,
+		},
+		{
+			file:     "invalid-rule-unknown-age-source.yaml",
+			expected: rules.ErrUnknownAgeSource,
+		},
+		{
+			file:     "invalid-rule-age-source-tag-missing-group.yaml",
+			expected: rules.ErrAgeSourceTagRegexMissingGroup,
+		},
+		{
+			file:     "invalid-limits-percent.yaml",
+			expected: limits.ErrMaxDeletePercentTooLarge,
+		},
+		{
+			file:     "invalid-archive-destination.yaml",
+			expected: archive.ErrArchiveDestination,
+		},
+		{
+			file:     "invalid-grace-period-without-state.yaml",
+			expected: ErrGracePeriodNeedsState,
+		},
+		{
+			file:     "invalid-rule-negative-grace-period.yaml",
+			expected: rules.ErrGracePeriodDaysMustBePositive,
+		},
+		{
+			file:     "invalid-disposition.yaml",
+			expected: ErrUnknownDisposition,
+		},
+		{
+			file:     "invalid-protect-unknown-extractor.yaml",
+			expected: protect.ErrUnknownExtractor,
+		},
+		{
+			file:     "invalid-pin-expiry.yaml",
+			expected: pins.ErrInvalidExpiry,
+		},
 	}
 )
 
@@ -61,12 +151,21 @@ func TestLoadInvalidConfigs(t *testing.T) {
 
 func TestLoadRules(t *testing.T) {
 	tests := map[string]int{
-		"fleeble-ignore-some.yaml":   2,
-		"fleeble-match-version.yaml": 2,
-		"fleeble-match-all.yaml":     2,
-		"plumbus-pr.yaml":            1,
-		"fleeble-multiple.yaml":      3,
-		"multiple-repos.yaml":        3,
+		"fleeble-ignore-some.yaml":     2,
+		"fleeble-match-version.yaml":   2,
+		"fleeble-match-all.yaml":       2,
+		"plumbus-pr.yaml":              1,
+		"fleeble-multiple.yaml":        3,
+		"multiple-repos.yaml":          3,
+		"donut-version-regex.yaml":     1,
+		"version-schemes.yaml":         3,
+		"group-by.yaml":                2,
+		"self-service-labels.yaml":     1,
+		"secure-expr.yaml":             1,
+		"scripted-weekly-monthly.yaml": 1,
+		"releases-schedule.yaml":       1,
+		"rebuilt-age-sources.yaml":     3,
+		"pinned.yaml":                  1,
 	}
 	for f, nExpected := range tests {
 		cfg, err := LoadFromFile(rulesDir + "/" + f)
@@ -81,3 +180,127 @@ func TestLoadRules(t *testing.T) {
 		t.Logf("Loaded %d rules\n", len(cfg.Rules))
 	}
 }
+
+func TestLoadPins(t *testing.T) {
+	cfg, err := LoadFromFile(rulesDir + "/pinned.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []string{}
+	for _, p := range cfg.Pins {
+		images = append(images, p.Image)
+	}
+	// pins from the pins_file come after the config's own
+	expected := "tumblr/fleeble:v1.2.3 tumblr/plumbus@sha256:cbbf2f9a99b47fc460d422812b6a5adff7dfee951d8fa2e4a98caa0382cfbdbf tumblr/*:release-*"
+	if strings.Join(images, " ") != expected {
+		t.Errorf("expected pins %s but got %s", expected, strings.Join(images, " "))
+	}
+	if cfg.Pins[0].Owner != "fleeble-team" {
+		t.Errorf("expected the first pin to be owned by fleeble-team but got %q", cfg.Pins[0].Owner)
+	}
+}
+
+// TestHashCoversReferencedFiles changes the pins_file and script of a config, and expects its hash to
+// change, so plans made before can't be applied
+func TestHashCoversReferencedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pruner-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script, err := ioutil.ReadFile("test/fixtures/scripts/weekly-then-monthly.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pinsFile := write("pins.yaml", "pins:\n  - image: tumblr/fleeble:v1\n")
+	scriptFile := write("retain.star", string(script))
+	cfgFile := write("config.yaml", "registry: https://foo.bar\npins_file: "+pinsFile+"\nrules:\n  - repos:\n      - tumblr/scripted\n    script:\n      file: "+scriptFile+"\n")
+
+	hashes := map[string]bool{}
+	for _, change := range []func(){
+		func() {},
+		func() { write("pins.yaml", "pins:\n  - image: tumblr/fleeble:v2\n") },
+		func() { write("retain.star", string(script)+"\n# changed\n") },
+	} {
+		change()
+		cfg, err := LoadFromFile(cfgFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[cfg.Hash] = true
+	}
+	if len(hashes) != 3 {
+		t.Errorf("expected the hash to change with the pins_file and the script, got %v", hashes)
+	}
+}
+
+func TestLoadExprTypeErrors(t *testing.T) {
+	f := fixtureDirectory + "/invalid-rule-expr-undeclared.yaml"
+	_, err := LoadFromFile(f)
+	if err == nil {
+		t.Errorf("Expected loading %s to fail type checking, but it loaded", f)
+	}
+}
+
+type tagPrefixMatcher struct {
+	Prefix string
+}
+
+func (m *tagPrefixMatcher) Match(manifest *registry.Manifest) bool {
+	return strings.HasPrefix(manifest.Tag, m.Prefix)
+}
+
+type keepFirstPolicy struct {
+	Count int
+}
+
+func (p *keepFirstPolicy) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	for i, m := range manifests {
+		if i < p.Count {
+			keep = append(keep, m)
+		} else {
+			delete = append(delete, m)
+		}
+	}
+	return
+}
+
+// the plugins are registered once, as an embedding program would, since registering twice panics
+func init() {
+	rules.RegisterMatcher("tag_prefix", func(unmarshal rules.Unmarshaler) (rules.Matcher, error) {
+		m := tagPrefixMatcher{}
+		return &m, unmarshal(&m)
+	})
+	rules.RegisterPolicy("keep_first", func(unmarshal rules.Unmarshaler) (rules.RetentionPolicy, error) {
+		p := keepFirstPolicy{}
+		return &p, unmarshal(&p)
+	})
+}
+
+func TestLoadCustomPlugins(t *testing.T) {
+	f := rulesDir + "/custom-plugins.yaml"
+	cfg, err := LoadFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.Rules[0]
+	if len(r.Matchers) != 1 || r.Matchers[0].(*tagPrefixMatcher).Prefix != "release-" {
+		t.Errorf("%s: expected tag_prefix matcher with prefix release-, got %v", f, r.Matchers)
+	}
+	if p, ok := r.Policy.(*keepFirstPolicy); !ok || p.Count != 2 {
+		t.Errorf("%s: expected keep_first policy keeping 2, got %v", f, r.Policy)
+	}
+	if !r.Match(&registry.Manifest{Name: "tumblr/fleeble", Tag: "release-1"}) {
+		t.Errorf("%s: expected rule to match release-1", f)
+	}
+	if r.Match(&registry.Manifest{Name: "tumblr/fleeble", Tag: "pr-1"}) {
+		t.Errorf("%s: expected rule not to match pr-1", f)
+	}
+}
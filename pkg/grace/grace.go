@@ -0,0 +1,108 @@
+package grace
+
+// grace holds back deletions until an image has been marked for deletion in consecutive runs spanning a
+// grace period, so a bad rule change can be noticed and reverted before anything is lost.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"github.com/tumblr/docker-registry-pruner/pkg/state"
+)
+
+// ErrNoState is returned when applying a grace period without a state store to remember pending images in
+var ErrNoState = fmt.Errorf("a grace period needs a state_file to remember images pending deletion")
+
+// Pending is an image marked for deletion that is still in its grace period
+type Pending struct {
+	*registry.Manifest
+	// Since is when the image was first marked for deletion
+	Since time.Time
+	// DeleteAt is when the image will be deleted, if it stays marked until then
+	DeleteAt time.Time
+}
+
+// Result splits the images the rules decided to delete into those due for deletion and those pending
+type Result struct {
+	Due     []*registry.Manifest
+	Pending []*Pending
+	// Rescued are images that were pending deletion, that the rules no longer delete
+	Rescued []*state.PendingRecord
+}
+
+// Enabled is true if the global grace period, or any rule's, is set
+func Enabled(ruleset []*rules.Rule, globalDays int) bool {
+	if globalDays > 0 {
+		return true
+	}
+	for _, r := range ruleset {
+		if r.GracePeriodDays > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Days is the grace period of an image deleted by the rules at indices deletedBy: the longest of
+// theirs, with globalDays standing in for rules without one
+func Days(ruleset []*rules.Rule, globalDays int, deletedBy []int) int {
+	days := 0
+	for _, i := range deletedBy {
+		d := ruleset[i].GracePeriodDays
+		if d == 0 {
+			d = globalDays
+		}
+		if d > days {
+			days = d
+		}
+	}
+	if len(deletedBy) == 0 {
+		days = globalDays
+	}
+	return days
+}
+
+// Apply marks the images to delete as pending in the store, and returns which are due for deletion at
+// tNow. seen are all the images fetched in this run; pending images of their repos that are no longer
+// marked start over. deletedBy is as in rules.Decisions. Due images stay marked
+// until Deleted is called with them. If persist is false, the store is not changed, i.e. for reports.
+func Apply(store *state.Store, ruleset []*rules.Rule, globalDays int, seen []*registry.Manifest, delete []*registry.Manifest, deletedBy map[string][]int, tNow time.Time, persist bool) (*Result, error) {
+	res := Result{Due: []*registry.Manifest{}, Pending: []*Pending{}, Rescued: []*state.PendingRecord{}}
+	if !Enabled(ruleset, globalDays) {
+		res.Due = delete
+		return &res, nil
+	}
+	if store == nil {
+		return nil, ErrNoState
+	}
+	marked, rescued, err := store.MarkPending(delete, seen, tNow, persist)
+	if err != nil {
+		return nil, err
+	}
+	res.Rescued = rescued
+	for _, m := range delete {
+		since := marked[state.PendingKey(m)].Since
+		deleteAt := since.Add(time.Duration(Days(ruleset, globalDays, deletedBy[m.Reference()])) * 24 * time.Hour)
+		if deleteAt.After(tNow) {
+			res.Pending = append(res.Pending, &Pending{Manifest: m, Since: since, DeleteAt: deleteAt})
+		} else {
+			res.Due = append(res.Due, m)
+		}
+	}
+	return &res, nil
+}
+
+// Deleted unmarks the images that were deleted. Due images that were not deleted, i.e. because a limit was
+// exceeded or their deletion failed, stay marked since they were first marked, so they are due next run.
+// Does nothing without a grace period.
+func Deleted(store *state.Store, ruleset []*rules.Rule, globalDays int, deleted []*registry.Manifest) error {
+	if !Enabled(ruleset, globalDays) || len(deleted) == 0 {
+		return nil
+	}
+	if store == nil {
+		return ErrNoState
+	}
+	return store.ClearPending(deleted)
+}
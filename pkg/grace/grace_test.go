@@ -0,0 +1,132 @@
+package grace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"github.com/tumblr/docker-registry-pruner/pkg/state"
+)
+
+func openTestStore(t *testing.T) (*state.Store, func()) {
+	dir, err := ioutil.TempDir("", "pruner-grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := state.Open(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func manifest(tag, dgst string) *registry.Manifest {
+	m, _ := registry.NewManifest("tumblr/fleeble", tag, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), map[string]string{})
+	m.Digest = digest.Digest(dgst)
+	return m
+}
+
+func tags(manifests []*registry.Manifest) []string {
+	ts := []string{}
+	for _, m := range manifests {
+		ts = append(ts, m.Tag)
+	}
+	return ts
+}
+
+func TestGracePeriod(t *testing.T) {
+	s, cleanup := openTestStore(t)
+	defer cleanup()
+
+	ruleset := []*rules.Rule{{}, {GracePeriodDays: 14}}
+	a, b := manifest("v1.0.0", "sha256:aaaa"), manifest("v1.1.0", "sha256:bbbb")
+	seen := []*registry.Manifest{a, b}
+	deletedBy := map[string][]int{a.Reference(): {0}, b.Reference(): {0, 1}}
+	day := func(n int) time.Time { return time.Date(2026, 6, n, 0, 0, 0, 0, time.UTC) }
+
+	// marked on day 1 by a report, which doesn't remember it
+	res, err := Apply(s, ruleset, 7, seen, seen, deletedBy, day(1), false)
+	if err != nil || len(res.Due) != 0 || len(res.Pending) != 2 {
+		t.Fatalf("expected everything pending on the first run, got %+v: %v", res, err)
+	}
+	if res, _ = Apply(s, ruleset, 7, seen, seen, deletedBy, day(8), true); len(res.Due) != 0 {
+		t.Fatalf("expected a report not to start the grace period, got %v due", tags(res.Due))
+	}
+
+	// a is due 7 days later; b has the longest grace period of its rules, 14 days
+	res, err = Apply(s, ruleset, 7, seen, seen, deletedBy, day(15), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Due) != 1 || res.Due[0] != a || len(res.Pending) != 1 || !res.Pending[0].DeleteAt.Equal(day(22)) {
+		t.Errorf("expected v1.0.0 due and v1.1.0 pending until %s, got %v due and %+v", day(22), tags(res.Due), res.Pending)
+	}
+	if err := Deleted(s, ruleset, 7, res.Due); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rule change keeps b before its grace period ends; when it is marked again, it starts over
+	res, err = Apply(s, ruleset, 7, seen, []*registry.Manifest{}, deletedBy, day(16), true)
+	if err != nil || len(res.Rescued) != 1 || res.Rescued[0].Tag != "v1.1.0" || !res.Rescued[0].Since.Equal(day(8)) {
+		t.Fatalf("expected v1.1.0 rescued, got %+v: %v", res, err)
+	}
+	res, _ = Apply(s, ruleset, 7, seen, []*registry.Manifest{b}, deletedBy, day(30), true)
+	if len(res.Due) != 0 || !res.Pending[0].Since.Equal(day(30)) {
+		t.Errorf("expected v1.1.0 pending since %s again, got %+v", day(30), res.Pending)
+	}
+
+	// with no grace period, everything is due, and no state is needed
+	if res, err = Apply(nil, []*rules.Rule{{}}, 0, seen, seen, deletedBy, day(1), true); err != nil || len(res.Due) != 2 {
+		t.Errorf("expected everything due without a grace period, got %+v: %v", res, err)
+	}
+	if _, err = Apply(nil, ruleset, 7, seen, seen, deletedBy, day(1), true); err != ErrNoState {
+		t.Errorf("expected %v without a state, got %v", ErrNoState, err)
+	}
+}
+
+func TestDueStaysMarkedUntilDeleted(t *testing.T) {
+	s, cleanup := openTestStore(t)
+	defer cleanup()
+
+	ruleset := []*rules.Rule{{}}
+	a, b := manifest("v1.0.0", "sha256:aaaa"), manifest("v1.1.0", "sha256:bbbb")
+	seen := []*registry.Manifest{a, b}
+	deletedBy := map[string][]int{a.Reference(): {0}, b.Reference(): {0}}
+	day := func(n int) time.Time { return time.Date(2026, 6, n, 0, 0, 0, 0, time.UTC) }
+
+	if _, err := Apply(s, ruleset, 7, seen, seen, deletedBy, day(1), true); err != nil {
+		t.Fatal(err)
+	}
+	// due on day 8, but the run exceeded its limits, so nothing was deleted
+	res, err := Apply(s, ruleset, 7, seen, seen, deletedBy, day(8), true)
+	if err != nil || len(res.Due) != 2 {
+		t.Fatalf("expected both due, got %+v: %v", res, err)
+	}
+	if err := Deleted(s, ruleset, 7, []*registry.Manifest{}); err != nil {
+		t.Fatal(err)
+	}
+	// the next run, deleting a fails
+	res, err = Apply(s, ruleset, 7, seen, seen, deletedBy, day(9), true)
+	if err != nil || len(res.Due) != 2 || len(res.Pending) != 0 {
+		t.Fatalf("expected both still due since %s, got %+v: %v", day(1), res, err)
+	}
+	if err := Deleted(s, ruleset, 7, []*registry.Manifest{b}); err != nil {
+		t.Fatal(err)
+	}
+	// a is still due, marked since day 1; b was deleted, and is marked anew if it is pushed again
+	res, err = Apply(s, ruleset, 7, seen, seen, deletedBy, day(10), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Due) != 1 || res.Due[0] != a || len(res.Pending) != 1 || !res.Pending[0].Since.Equal(day(10)) {
+		t.Errorf("expected v1.0.0 due and v1.1.0 pending since %s, got %v due and %+v", day(10), tags(res.Due), res.Pending)
+	}
+}
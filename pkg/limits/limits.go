@@ -0,0 +1,118 @@
+package limits
+
+// limits are guardrails on how much a single run may delete, so a typo in a rule can't wipe out a repo
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var (
+	// ErrLimitsMustBePositive
+	ErrLimitsMustBePositive = fmt.Errorf("limits must be positive")
+	// ErrMaxDeletePercentTooLarge
+	ErrMaxDeletePercentTooLarge = fmt.Errorf("limits max_delete_percent must not be greater than 100")
+)
+
+// Limits bound what a run may delete. A limit of 0 is not enforced.
+type Limits struct {
+	// MaxDeletePercent is the most of a repo's tags, in percent, a run may delete
+	MaxDeletePercent float64 `yaml:"max_delete_percent"`
+	// MaxDeleteCount is the most tags a run may delete, across all repos
+	MaxDeleteCount int `yaml:"max_delete_count"`
+	// MaxDeleteCountPerRepo is the most tags a run may delete from one repo
+	MaxDeleteCountPerRepo int `yaml:"max_delete_count_per_repo"`
+	// MinRemaining is the fewest tags a run may leave in a repo it deletes from
+	MinRemaining int `yaml:"min_remaining"`
+}
+
+// Violation is a limit a run would exceed
+type Violation struct {
+	// Repo is the repo that would exceed the limit, or empty for limits across all repos
+	Repo string
+	// Limit is the name of the limit in the config
+	Limit string
+	// Value is what the run would do, and Max the limit on it. For min_remaining, Value is
+	// how many tags would remain, and Max the minimum
+	Value float64
+	Max   float64
+}
+
+func (v Violation) String() string {
+	s := fmt.Sprintf("%s: %g exceeds %g", v.Limit, v.Value, v.Max)
+	if v.Limit == "min_remaining" {
+		s = fmt.Sprintf("%s: %g would remain, fewer than %g", v.Limit, v.Value, v.Max)
+	}
+	if v.Repo != "" {
+		s = fmt.Sprintf("%s: %s", v.Repo, s)
+	}
+	return s
+}
+
+// Validate checks the limits make sense
+func (l *Limits) Validate() error {
+	switch {
+	case l.MaxDeletePercent < 0 || l.MaxDeleteCount < 0 || l.MaxDeleteCountPerRepo < 0 || l.MinRemaining < 0:
+		return ErrLimitsMustBePositive
+	case l.MaxDeletePercent > 100:
+		return ErrMaxDeletePercentTooLarge
+	default:
+		return nil
+	}
+}
+
+// Expand is delete, with every manifest in all on the digest of a manifest in delete, as deleting a
+// manifest by its digest deletes every tag on it. Check counts what Expand returns, not only the tags the
+// rules deleted.
+func Expand(delete []*registry.Manifest, all []*registry.Manifest) []*registry.Manifest {
+	digests := map[string]bool{}
+	for _, m := range delete {
+		if m.Digest != "" {
+			digests[m.Name+"@"+m.Digest.String()] = true
+		}
+	}
+	expanded := append([]*registry.Manifest{}, delete...)
+	for _, m := range all {
+		if m.Digest != "" && digests[m.Name+"@"+m.Digest.String()] {
+			expanded = append(expanded, m)
+		}
+	}
+	return registry.DedupeManifests(expanded)
+}
+
+// Check returns every limit deleting the manifests would exceed. tagCounts is how many tags each repo has.
+func (l *Limits) Check(delete []*registry.Manifest, tagCounts map[string]int) []Violation {
+	violations := []Violation{}
+	if l.MaxDeleteCount > 0 && len(delete) > l.MaxDeleteCount {
+		violations = append(violations, Violation{Limit: "max_delete_count", Value: float64(len(delete)), Max: float64(l.MaxDeleteCount)})
+	}
+
+	deletesByRepo := map[string]int{}
+	for _, m := range registry.DedupeManifests(append([]*registry.Manifest{}, delete...)) {
+		deletesByRepo[m.Name]++
+	}
+	repos := []string{}
+	for repo := range deletesByRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		deletes, total := deletesByRepo[repo], tagCounts[repo]
+		if total < deletes {
+			// the repo has fewer tags than we are deleting from it; assume the worst
+			total = deletes
+		}
+		if l.MaxDeleteCountPerRepo > 0 && deletes > l.MaxDeleteCountPerRepo {
+			violations = append(violations, Violation{Repo: repo, Limit: "max_delete_count_per_repo", Value: float64(deletes), Max: float64(l.MaxDeleteCountPerRepo)})
+		}
+		if percent := 100 * float64(deletes) / float64(total); l.MaxDeletePercent > 0 && percent > l.MaxDeletePercent {
+			violations = append(violations, Violation{Repo: repo, Limit: "max_delete_percent", Value: percent, Max: l.MaxDeletePercent})
+		}
+		if remaining := total - deletes; l.MinRemaining > 0 && remaining < l.MinRemaining {
+			violations = append(violations, Violation{Repo: repo, Limit: "min_remaining", Value: float64(remaining), Max: float64(l.MinRemaining)})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,70 @@
+package limits
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+func mkdeletes(repo string, n int) []*registry.Manifest {
+	ms := []*registry.Manifest{}
+	for i := 0; i < n; i++ {
+		m, _ := registry.NewManifest(repo, string(rune('a'+i)), time.Now(), nil)
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+func TestCheck(t *testing.T) {
+	delete := append(mkdeletes("tumblr/fleeble", 19), mkdeletes("tumblr/plumbus", 2)...)
+	tagCounts := map[string]int{"tumblr/fleeble": 20, "tumblr/plumbus": 10}
+
+	tests := []struct {
+		limits   Limits
+		expected []string
+	}{
+		{Limits{}, []string{}},
+		{Limits{MaxDeleteCount: 21}, []string{}},
+		{Limits{MaxDeleteCount: 20}, []string{"max_delete_count: 21 exceeds 20"}},
+		{Limits{MaxDeleteCountPerRepo: 5}, []string{"tumblr/fleeble: max_delete_count_per_repo: 19 exceeds 5"}},
+		{Limits{MaxDeletePercent: 50}, []string{"tumblr/fleeble: max_delete_percent: 95 exceeds 50"}},
+		{Limits{MinRemaining: 3}, []string{"tumblr/fleeble: min_remaining: 1 would remain, fewer than 3"}},
+		{Limits{MaxDeletePercent: 95, MinRemaining: 1}, []string{}},
+	}
+	for _, test := range tests {
+		actual := []string{}
+		for _, v := range test.limits.Check(delete, tagCounts) {
+			actual = append(actual, v.String())
+		}
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("%+v: expected violations %v, got %v", test.limits, test.expected, actual)
+		}
+	}
+}
+
+func TestCheckUnknownTagCount(t *testing.T) {
+	// a repo we could not count the tags of is treated as if we were deleting all of it
+	l := Limits{MinRemaining: 1}
+	if vs := l.Check(mkdeletes("tumblr/fleeble", 2), map[string]int{}); len(vs) != 1 {
+		t.Errorf("expected min_remaining to trip for a repo with unknown tag count, got %v", vs)
+	}
+}
+
+func TestCheckCountsEveryTagOnDeletedDigests(t *testing.T) {
+	all := mkdeletes("tumblr/fleeble", 4)
+	// a and b share a digest, so deleting a deletes b too
+	for i, dgst := range []string{"sha256:aaaa", "sha256:aaaa", "sha256:cccc", "sha256:dddd"} {
+		all[i].Digest = digest.Digest(dgst)
+	}
+	delete := Expand(all[:1], all)
+	if len(delete) != 2 || delete[1].Tag != "b" {
+		t.Fatalf("expected deleting a to delete b too, got %v", delete)
+	}
+	l := Limits{MinRemaining: 3}
+	if vs := l.Check(delete, map[string]int{"tumblr/fleeble": 4}); len(vs) != 1 || vs[0].String() != "tumblr/fleeble: min_remaining: 2 would remain, fewer than 3" {
+		t.Errorf("expected min_remaining to count both tags on the deleted digest, got %v", vs)
+	}
+}
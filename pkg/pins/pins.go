@@ -0,0 +1,198 @@
+package pins
+
+// pins are images people have asked never to be deleted, by exact tag or digest, or by pattern, each
+// with who asked and until when. Pins are applied after all rules.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"gopkg.in/yaml.v2"
+)
+
+// ReasonPinned is what pinned images are reported as
+const ReasonPinned = "protected-pinned"
+
+// The problems a pin can be flagged with
+const (
+	// ProblemExpired is a pin past its expiry, which no longer protects anything
+	ProblemExpired = "expired"
+	// ProblemUnmatched is a pin that matches none of the images in the registry
+	ProblemUnmatched = "matches nothing"
+)
+
+var (
+	// ErrMissingImage is returned when a pin has no image
+	ErrMissingImage = fmt.Errorf("pin must have an image")
+	// ErrInvalidExpiry is returned when a pin's expires is not a date or RFC3339 time
+	ErrInvalidExpiry = fmt.Errorf("pin expires must be a date (i.e. 2026-12-31) or RFC3339 time")
+
+	dateFormat = "2006-01-02"
+)
+
+// Pin protects the images matching Image, until it Expires
+type Pin struct {
+	// Image is repo:tag, repo@sha256:..., or a repo on its own for all of its tags. The repo and tag may be
+	// patterns, as in path.Match, i.e. tumblr/*:release-*
+	Image string `yaml:"image"`
+	// Expires is the date, or RFC3339 time, the pin stops protecting images. If empty, it never does
+	Expires string `yaml:"expires"`
+	// Owner is who to ask about the pin
+	Owner string `yaml:"owner"`
+	// Reason is why the images are pinned
+	Reason string `yaml:"reason"`
+
+	repo    string
+	tag     string
+	digest  digest.Digest
+	expires time.Time
+}
+
+// Parse checks the pin, and prepares it for matching
+func (p *Pin) Parse() error {
+	if p.Image == "" {
+		return ErrMissingImage
+	}
+	p.repo, p.tag, p.digest = p.Image, "*", ""
+	if i := strings.Index(p.Image, "@"); i >= 0 {
+		p.repo, p.tag, p.digest = p.Image[:i], "", digest.Digest(p.Image[i+1:])
+		if err := p.digest.Validate(); err != nil {
+			return fmt.Errorf("pin %s: %v", p.Image, err)
+		}
+	} else if i := strings.LastIndex(p.Image, ":"); i > strings.LastIndex(p.Image, "/") {
+		p.repo, p.tag = p.Image[:i], p.Image[i+1:]
+	}
+	for _, pattern := range []string{p.repo, p.tag} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pin %s: %v", p.Image, err)
+		}
+	}
+	if p.Expires != "" {
+		t, err := time.Parse(dateFormat, p.Expires)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, p.Expires); err != nil {
+				return ErrInvalidExpiry
+			}
+		} else {
+			// a pin expiring on a date protects through the end of that day
+			t = t.Add(24 * time.Hour)
+		}
+		p.expires = t
+	}
+	return nil
+}
+
+// Expired is true if the pin stopped protecting images by tNow
+func (p *Pin) Expired(tNow time.Time) bool {
+	return !p.expires.IsZero() && !tNow.Before(p.expires)
+}
+
+// Match is true if the pin matches the manifest, whether or not it expired
+func (p *Pin) Match(m *registry.Manifest) bool {
+	if ok, _ := path.Match(p.repo, m.Name); !ok {
+		return false
+	}
+	if p.digest != "" {
+		return m.Digest == p.digest
+	}
+	ok, _ := path.Match(p.tag, m.Tag)
+	return ok
+}
+
+// covered is true if the pin's repo is one of repos, or repos is empty for every repo
+func (p *Pin) covered(repos []string) bool {
+	if len(repos) == 0 {
+		return true
+	}
+	for _, repo := range repos {
+		if ok, _ := path.Match(p.repo, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the pin, with its owner if it has one
+func (p *Pin) String() string {
+	if p.Owner == "" {
+		return "pin " + p.Image
+	}
+	return fmt.Sprintf("pin %s (%s)", p.Image, p.Owner)
+}
+
+// LoadFile loads the pins in a pins file, a YAML file with a list of pins under pins, as in a config
+func LoadFile(file string) ([]*Pin, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	f := struct {
+		Pins []*Pin `yaml:"pins"`
+	}{}
+	if err := yaml.Unmarshal(d, &f); err != nil {
+		return nil, err
+	}
+	return f.Pins, nil
+}
+
+// Set protects the images matching any of its pins that have not expired. It implements rules.Protector.
+type Set struct {
+	pins []*Pin
+	tNow time.Time
+}
+
+// New is the set of parsed pins, as of tNow
+func New(pins []*Pin, tNow time.Time) *Set {
+	return &Set{pins: pins, tNow: tNow}
+}
+
+// Protections are the pins protecting the manifest
+func (s *Set) Protections(m *registry.Manifest) []rules.Protection {
+	protections := []rules.Protection{}
+	for _, p := range s.pins {
+		if !p.Expired(s.tNow) && p.Match(m) {
+			protections = append(protections, rules.Protection{Reason: ReasonPinned, Source: p.String()})
+		}
+	}
+	return protections
+}
+
+// Flag is a pin that needs attention
+type Flag struct {
+	Image   string `json:"image" yaml:"image"`
+	Owner   string `json:"owner" yaml:"owner"`
+	Expires string `json:"expires" yaml:"expires"`
+	// Problem is ProblemExpired or ProblemUnmatched
+	Problem string `json:"problem" yaml:"problem"`
+}
+
+// Check flags the pins that expired, and the pins that match none of the manifests. repos are the repos
+// the manifests are every tag of, or empty if they are every repo's; a pin of another repo is not known
+// to match nothing, so it is not flagged as such.
+func (s *Set) Check(manifests []*registry.Manifest, repos []string) []*Flag {
+	flags := []*Flag{}
+	for _, p := range s.pins {
+		problem := ""
+		if p.Expired(s.tNow) {
+			problem = ProblemExpired
+		} else if p.covered(repos) {
+			problem = ProblemUnmatched
+			for _, m := range manifests {
+				if p.Match(m) {
+					problem = ""
+					break
+				}
+			}
+		}
+		if problem != "" {
+			flags = append(flags, &Flag{Image: p.Image, Owner: p.Owner, Expires: p.Expires, Problem: problem})
+		}
+	}
+	return flags
+}
@@ -0,0 +1,114 @@
+package pins
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+const pinned = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func parse(t *testing.T, pins ...*Pin) []*Pin {
+	for _, p := range pins {
+		if err := p.Parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pins
+}
+
+func TestParse(t *testing.T) {
+	for image, valid := range map[string]bool{
+		"tumblr/fleeble":                   true,
+		"tumblr/fleeble:v1.2.3":            true,
+		"localhost:5000/tumblr/fleeble":    true,
+		"tumblr/*:release-*":               true,
+		"tumblr/fleeble@" + pinned:         true,
+		"":                                 false,
+		"tumblr/fleeble@sha256:nope":       false,
+		"tumblr/[fleeble:v1":               false,
+		"tumblr/fleeble:v1.2.3@sha256:abc": false,
+	} {
+		err := (&Pin{Image: image}).Parse()
+		if valid && err != nil {
+			t.Errorf("expected %s to parse, but got %v", image, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("expected %s not to parse", image)
+		}
+	}
+	if err := (&Pin{Image: "tumblr/fleeble", Expires: "soon"}).Parse(); err != ErrInvalidExpiry {
+		t.Errorf("expected %v but got %v", ErrInvalidExpiry, err)
+	}
+}
+
+func TestProtections(t *testing.T) {
+	tNow := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	pins := parse(t,
+		&Pin{Image: "tumblr/fleeble:v1.2.3", Owner: "fleeble-team", Expires: "2026-10-19"},
+		&Pin{Image: "tumblr/plumbus@" + pinned},
+		&Pin{Image: "tumblr/*:release-*", Owner: "release-eng"},
+		&Pin{Image: "tumblr/donut", Expires: "2026-10-18"},
+		&Pin{Image: "tumblr/nothing:v1"},
+	)
+	s := New(pins, tNow)
+
+	release := &registry.Manifest{Name: "tumblr/fleeble", Tag: "release-42"}
+	expiringToday := &registry.Manifest{Name: "tumblr/fleeble", Tag: "v1.2.3"}
+	byDigest := &registry.Manifest{Name: "tumblr/plumbus", Tag: "anything", Digest: pinned}
+	expired := &registry.Manifest{Name: "tumblr/donut", Tag: "v1"}
+	unpinned := &registry.Manifest{Name: "tumblr/fleeble", Tag: "v1.2.4"}
+
+	keep, delete, protectedBy := rules.ApplyProtections([]rules.Protector{s}, []*registry.Manifest{}, []*registry.Manifest{}, []*registry.Manifest{release, expiringToday, byDigest, expired, unpinned})
+	if len(keep) != 3 || len(delete) != 2 {
+		t.Fatalf("expected 3 images pinned and 2 deleted, but kept %d and deleted %d", len(keep), len(delete))
+	}
+	if p := protectedBy[release.Reference()]; len(p) != 1 || p[0].Reason != ReasonPinned || p[0].Source != "pin tumblr/*:release-* (release-eng)" {
+		t.Errorf("unexpected protections of %s: %v", release.Reference(), p)
+	}
+	if p := protectedBy[byDigest.Reference()]; len(p) != 1 || p[0].Source != "pin tumblr/plumbus@"+pinned {
+		t.Errorf("unexpected protections of %s: %v", byDigest.Reference(), p)
+	}
+	if _, ok := protectedBy[expired.Reference()]; ok {
+		t.Errorf("expected the expired pin not to protect %s", expired.Reference())
+	}
+
+	flags := s.Check([]*registry.Manifest{release, expiringToday, byDigest, expired, unpinned}, nil)
+	if len(flags) != 2 {
+		t.Fatalf("expected 2 pins flagged, but got %d", len(flags))
+	}
+	if flags[0].Image != "tumblr/donut" || flags[0].Problem != ProblemExpired {
+		t.Errorf("expected tumblr/donut to be flagged expired, but got %s %s", flags[0].Image, flags[0].Problem)
+	}
+	if flags[1].Image != "tumblr/nothing:v1" || flags[1].Problem != ProblemUnmatched {
+		t.Errorf("expected tumblr/nothing:v1 to be flagged unmatched, but got %s %s", flags[1].Image, flags[1].Problem)
+	}
+}
+
+func TestCheckOnlyFetchedRepos(t *testing.T) {
+	s := New(parse(t, &Pin{Image: "tumblr/fleeble:v1"}, &Pin{Image: "tumblr/plumbus:v1"}), time.Now())
+	fleeble := &registry.Manifest{Name: "tumblr/fleeble", Tag: "v2"}
+	// only tumblr/fleeble was fetched, so whether tumblr/plumbus:v1 exists is unknown
+	flags := s.Check([]*registry.Manifest{fleeble}, []string{"tumblr/fleeble"})
+	if len(flags) != 1 || flags[0].Image != "tumblr/fleeble:v1" {
+		t.Errorf("expected only tumblr/fleeble:v1 flagged, got %+v", flags)
+	}
+}
+
+func TestPinProtectsSharedDigest(t *testing.T) {
+	s := New(parse(t, &Pin{Image: "tumblr/fleeble:v1.2.3", Owner: "fleeble-team"}), time.Now())
+	pinnedTag := &registry.Manifest{Name: "tumblr/fleeble", Tag: "v1.2.3", Digest: pinned}
+	build := &registry.Manifest{Name: "tumblr/fleeble", Tag: "build-123", Digest: pinned}
+	all := []*registry.Manifest{pinnedTag, build}
+
+	_, delete, protectedBy := rules.ApplyProtections([]rules.Protector{s}, all, []*registry.Manifest{pinnedTag}, []*registry.Manifest{build})
+	if len(delete) != 0 {
+		t.Fatalf("expected deleting %s to be refused, as it would delete the pinned tag", build.Reference())
+	}
+	expected := rules.Protection{Reason: ReasonPinned, Source: "pin tumblr/fleeble:v1.2.3 (fleeble-team) (via tumblr/fleeble:v1.2.3)"}
+	if p := protectedBy[build.Reference()]; len(p) != 1 || p[0] != expected {
+		t.Errorf("expected %s protected by %v, got %v", build.Reference(), expected, p)
+	}
+}
@@ -0,0 +1,173 @@
+package plan
+
+// plan is a reviewed list of deletions. A plan is made from a report, and applying it deletes exactly
+// what it lists, as long as the config is unchanged, the plan is fresh, and each tag still points at
+// the digest that was planned.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+var (
+	// Version is the version of the plan format this package reads and writes
+	Version = 1
+	// DefaultMaxAge is how old a plan may be before it is too stale to apply
+	DefaultMaxAge = 24 * time.Hour
+
+	// ErrUnsupportedVersion is returned when loading a plan written in another format version
+	ErrUnsupportedVersion = fmt.Errorf("unsupported plan version, expected %d", Version)
+	// ErrTampered is returned when a plan's checksum does not match its contents
+	ErrTampered = fmt.Errorf("plan checksum does not match its contents; it was altered after it was made, or signed with a different plan key")
+	// ErrConfigChanged is returned when applying a plan made with a different config
+	ErrConfigChanged = fmt.Errorf("plan was made with a different config")
+	// ErrRegistryChanged is returned when applying a plan made for a different registry
+	ErrRegistryChanged = fmt.Errorf("plan was made for a different registry")
+	// ErrStale is returned when applying a plan older than its max age
+	ErrStale = fmt.Errorf("plan is too old to apply; make a new plan")
+)
+
+// Plan is the deletions a config decided on at a point in time
+type Plan struct {
+	Version  int    `json:"version"`
+	Registry string `json:"registry"`
+	// ConfigHash is the config.Config Hash of the config the plan was made with
+	ConfigHash string `json:"config_hash"`
+	// CreatedAt is when the plan was made, as RFC3339
+	CreatedAt string   `json:"created_at"`
+	Deletes   []*Entry `json:"deletes"`
+	// Checksum is the sha256 of the rest of the plan, or its HMAC-SHA256 if signed with a plan key
+	Checksum string `json:"checksum"`
+}
+
+// Entry is one manifest to delete
+type Entry struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+	// Rules are the names of the rules that deleted the manifest, as rules.RuleNames has them, so a pruned
+	// and an applied deletion are audited alike
+	Rules []string `json:"rules"`
+}
+
+// New makes a plan to delete the manifests, made at tNow. deletedBy is as in rules.Decisions.
+func New(registryURL string, configHash string, ruleset []*rules.Rule, delete []*registry.Manifest, deletedBy map[string][]int, tNow time.Time) *Plan {
+	p := Plan{
+		Version:    Version,
+		Registry:   registryURL,
+		ConfigHash: configHash,
+		CreatedAt:  tNow.UTC().Format(time.RFC3339),
+		Deletes:    []*Entry{},
+	}
+	names := rules.RuleNames(ruleset, deletedBy)
+	for _, m := range delete {
+		e := Entry{Repo: m.Name, Tag: m.Tag, Digest: m.Digest.String(), Rules: append([]string{}, names[m.Reference()]...)}
+		p.Deletes = append(p.Deletes, &e)
+	}
+	return &p
+}
+
+// checksum is the sha256, or HMAC-SHA256 with key, of the plan without its Checksum
+func (p *Plan) checksum(key []byte) (string, error) {
+	unsigned := *p
+	unsigned.Checksum = ""
+	d, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		sum := sha256.Sum256(d)
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(d)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// WriteFile checksums the plan with key, which may be empty, and writes it to path as JSON
+func (p *Plan) WriteFile(path string, key []byte) error {
+	sum, err := p.checksum(key)
+	if err != nil {
+		return err
+	}
+	p.Checksum = sum
+	d, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+// Load reads a plan written by WriteFile, and makes sure it was not altered since
+func Load(path string, key []byte) (*Plan, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := Plan{}
+	if err := json.Unmarshal(d, &p); err != nil {
+		return nil, err
+	}
+	if p.Version != Version {
+		return nil, ErrUnsupportedVersion
+	}
+	sum, err := p.checksum(key)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sum), []byte(p.Checksum)) {
+		return nil, ErrTampered
+	}
+	return &p, nil
+}
+
+// Verify checks the plan may be applied at tNow, with the config of registryURL hashing to configHash
+func (p *Plan) Verify(registryURL string, configHash string, tNow time.Time, maxAge time.Duration) error {
+	created, err := time.Parse(time.RFC3339, p.CreatedAt)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.Registry != registryURL:
+		return ErrRegistryChanged
+	case p.ConfigHash != configHash:
+		return ErrConfigChanged
+	case tNow.Sub(created) > maxAge || created.After(tNow):
+		return ErrStale
+	default:
+		return nil
+	}
+}
+
+// DeletedBy returns the rules that deleted each manifest in the plan, by Reference
+func (p *Plan) DeletedBy() map[string][]string {
+	deletedBy := map[string][]string{}
+	for _, e := range p.Deletes {
+		deletedBy[fmt.Sprintf("%s:%s", e.Repo, e.Tag)] = e.Rules
+	}
+	return deletedBy
+}
+
+// Manifests returns the manifests to delete. Their Digest is the planned digest, which the
+// client verifies the tag still points at before deleting.
+func (p *Plan) Manifests() []*registry.Manifest {
+	manifests := []*registry.Manifest{}
+	for _, e := range p.Deletes {
+		manifests = append(manifests, &registry.Manifest{
+			Name:   e.Repo,
+			Tag:    e.Tag,
+			Digest: digest.Digest(e.Digest),
+			Labels: map[string]string{},
+		})
+	}
+	return manifests
+}
@@ -0,0 +1,114 @@
+package plan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+var (
+	tNow        = time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	configHash  = "sha256:c0ffee"
+	registryURL = "https://foo.bar"
+)
+
+func mkplan() (*Plan, []*registry.Manifest) {
+	manifests := []*registry.Manifest{}
+	for i, tag := range []string{"v1.0.0", "v1.1.0", "v1.2.0"} {
+		m, _ := registry.NewManifest("tumblr/fleeble", tag, tNow.Add(time.Duration(i-3)*24*time.Hour), map[string]string{})
+		m.Digest = digest.Digest("sha256:" + strings.Repeat(string(rune('a'+i)), 4))
+		manifests = append(manifests, m)
+	}
+	ruleset := []*rules.Rule{
+		{Selector: rules.Selector{Repos: []string{"tumblr/fleeble"}, Labels: map[string]string{}}, KeepMostRecent: 1},
+	}
+	_, delete, d := rules.ApplyRulesWithDecisions(ruleset, manifests, rules.FixedClock(tNow))
+	return New(registryURL, configHash, ruleset, delete, d.DeletedBy, tNow), delete
+}
+
+func writePlan(t *testing.T, p *Plan, key []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "pruner-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "plan.json")
+	if err := p.WriteFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	p, delete := mkplan()
+	if len(p.Deletes) != 2 {
+		t.Fatalf("expected to plan 2 deletions, got %d", len(p.Deletes))
+	}
+	for _, e := range p.Deletes {
+		if len(e.Rules) != 1 || e.Rules[0] != "rule 0" {
+			t.Errorf("expected %s:%s to be attributed to rule 0, got %v", e.Repo, e.Tag, e.Rules)
+		}
+	}
+
+	path, cleanup := writePlan(t, p, nil)
+	defer cleanup()
+	loaded, err := Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Verify(registryURL, configHash, tNow.Add(time.Hour), DefaultMaxAge); err != nil {
+		t.Errorf("expected a fresh plan to verify, got %v", err)
+	}
+	for i, m := range loaded.Manifests() {
+		if m.Reference() != delete[i].Reference() || m.Digest != delete[i].Digest {
+			t.Errorf("expected to delete %s@%s, got %s@%s", delete[i].Reference(), delete[i].Digest, m.Reference(), m.Digest)
+		}
+	}
+}
+
+func TestPlanTampered(t *testing.T) {
+	p, _ := mkplan()
+	path, cleanup := writePlan(t, p, []byte("secret"))
+	defer cleanup()
+
+	if _, err := Load(path, []byte("secret")); err != nil {
+		t.Errorf("expected a signed plan to load with its key, got %v", err)
+	}
+	if _, err := Load(path, []byte("another secret")); err != ErrTampered {
+		t.Errorf("expected a plan signed with another key to be refused, got %v", err)
+	}
+	if _, err := Load(path, nil); err != ErrTampered {
+		t.Errorf("expected a signed plan to be refused without its key, got %v", err)
+	}
+
+	d, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, []byte(strings.Replace(string(d), "v1.0.0", "v1.2.0", 1)), 0644)
+	if _, err := Load(path, []byte("secret")); err != ErrTampered {
+		t.Errorf("expected an edited plan to be refused, got %v", err)
+	}
+}
+
+func TestPlanVerify(t *testing.T) {
+	p, _ := mkplan()
+	for _, test := range []struct {
+		registry string
+		hash     string
+		at       time.Time
+		expected error
+	}{
+		{registryURL, "sha256:decaf", tNow, ErrConfigChanged},
+		{"https://another.registry", configHash, tNow, ErrRegistryChanged},
+		{registryURL, configHash, tNow.Add(DefaultMaxAge + time.Minute), ErrStale},
+		{registryURL, configHash, tNow.Add(-time.Hour), ErrStale},
+	} {
+		if err := p.Verify(test.registry, test.hash, test.at, DefaultMaxAge); err != test.expected {
+			t.Errorf("expected %v verifying against %s %s at %s, got %v", test.expected, test.registry, test.hash, test.at, err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package protect
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReasonReferenced is what images referenced by files, i.e. in deploy repos, are reported as
+const ReasonReferenced = "protected-referenced"
+
+var (
+	// ErrUnknownExtractor is returned when a config refers to an Extractor that was not registered
+	ErrUnknownExtractor = fmt.Errorf("unknown extractor")
+	// ErrNoPaths is returned when scanning files without any paths to scan
+	ErrNoPaths = fmt.Errorf("protect files needs at least one path")
+
+	extractorsMu sync.RWMutex
+	extractors   = map[string]Extractor{}
+
+	// skipDirs are never scanned
+	skipDirs = map[string]bool{".git": true, ".hg": true, ".svn": true, "node_modules": true}
+)
+
+// Found is an image reference found in a file
+type Found struct {
+	Ref string
+	// Line is the line the reference is on, from 1
+	Line int
+}
+
+// Extractor finds the image references in a type of file
+type Extractor interface {
+	// Match is true if the extractor reads the file at path
+	Match(path string) bool
+	// Extract finds the image references in the content of a file it matches
+	Extract(content []byte) []Found
+}
+
+// RegisterExtractor makes an Extractor available to configs by name, under protect.files.extractors.
+// Programs embedding the pruner should register their Extractors before loading a config.
+// It panics if an Extractor is registered twice under the same name.
+func RegisterExtractor(name string, e Extractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	if _, dup := extractors[name]; dup {
+		panic("protect: RegisterExtractor called twice for " + name)
+	}
+	extractors[name] = e
+}
+
+// Extractors are the names of every registered Extractor, sorted
+func Extractors() []string {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	names := []string{}
+	for name := range extractors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func extractor(name string) (Extractor, error) {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	e, ok := extractors[name]
+	if !ok {
+		return nil, ErrUnknownExtractor
+	}
+	return e, nil
+}
+
+// FilesConfig is which local directories, i.e. checkouts of deploy repos, to find image references in
+type FilesConfig struct {
+	// Paths are the files and directories to scan. Directories are scanned recursively
+	Paths []string `yaml:"paths"`
+	// Extractors are the names of the Extractors to scan with. If empty, every registered Extractor is used
+	Extractors []string `yaml:"extractors"`
+}
+
+// Validate checks there are paths to scan, and the extractors are registered
+func (c *FilesConfig) Validate() error {
+	if len(c.Paths) == 0 {
+		return ErrNoPaths
+	}
+	for _, name := range c.Extractors {
+		if _, err := extractor(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filesSource finds the images referenced by files
+type filesSource struct {
+	paths      []string
+	extractors []Extractor
+}
+
+// NewFilesSource scans the paths of the config with its extractors
+func NewFilesSource(c *FilesConfig) (Source, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	names := c.Extractors
+	if len(names) == 0 {
+		names = Extractors()
+	}
+	s := filesSource{paths: c.Paths}
+	for _, name := range names {
+		e, err := extractor(name)
+		if err != nil {
+			return nil, err
+		}
+		s.extractors = append(s.extractors, e)
+	}
+	return &s, nil
+}
+
+// Reason is ReasonReferenced
+func (s *filesSource) Reason() string {
+	return ReasonReferenced
+}
+
+// Images are the images referenced by every file under the paths that an extractor matches, with
+// sources of path:line
+func (s *filesSource) Images() ([]Image, error) {
+	images := []Image{}
+	for _, root := range s.paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if skipDirs[info.Name()] && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			var content []byte
+			for _, e := range s.extractors {
+				if !e.Match(path) {
+					continue
+				}
+				if content == nil {
+					if content, err = ioutil.ReadFile(path); err != nil {
+						return err
+					}
+				}
+				for _, f := range e.Extract(content) {
+					images = append(images, Image{Ref: f.Ref, Source: fmt.Sprintf("%s:%d", path, f.Line)})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// lines calls f with each line of content, and its number from 1
+func lines(content []byte, f func(line string, n int)) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		f(scanner.Text(), n)
+	}
+}
+
+// literal is true if ref is an image reference, not a template or variable to be filled in
+func literal(ref string) bool {
+	return ref != "" && !strings.ContainsAny(ref, "${}<>")
+}
+
+// dockerfileExtractor finds the images Dockerfiles build from, and copy from
+type dockerfileExtractor struct{}
+
+var (
+	dockerfileFromRe = regexp.MustCompile(`(?i)^\s*FROM\s+(?:--\S+\s+)*(\S+)(?:\s+AS\s+(\S+))?`)
+	dockerfileCopyRe = regexp.MustCompile(`(?i)^\s*COPY\s+.*--from=(\S+)`)
+	dockerfileArgRe  = regexp.MustCompile(`(?i)^\s*ARG\s+(\w+)=["']?([^\s"']+)`)
+)
+
+// Match is true for Dockerfile, Dockerfile.*, *.Dockerfile and Containerfile
+func (dockerfileExtractor) Match(path string) bool {
+	base := filepath.Base(path)
+	return base == "Dockerfile" || base == "Containerfile" || strings.HasPrefix(base, "Dockerfile.") || strings.HasSuffix(base, ".Dockerfile")
+}
+
+// Extract finds the images of FROM and COPY --from lines, but not the build stages they refer to.
+// Variables in them are replaced by the defaults of the ARGs before them.
+func (dockerfileExtractor) Extract(content []byte) []Found {
+	found := []Found{}
+	stages := map[string]bool{"scratch": true}
+	args := map[string]string{}
+	lines(content, func(line string, n int) {
+		ref, stage := "", ""
+		if m := dockerfileArgRe.FindStringSubmatch(line); m != nil {
+			args[m[1]] = m[2]
+		} else if m := dockerfileFromRe.FindStringSubmatch(line); m != nil {
+			ref, stage = m[1], m[2]
+		} else if m := dockerfileCopyRe.FindStringSubmatch(line); m != nil {
+			ref = m[1]
+		}
+		if strings.Contains(ref, "$") {
+			ref = os.Expand(ref, func(name string) string {
+				if v, ok := args[name]; ok {
+					return v
+				}
+				// leave the variable, so the reference is not a literal
+				return "${" + name + "}"
+			})
+		}
+		if literal(ref) && !stages[strings.ToLower(ref)] {
+			found = append(found, Found{Ref: ref, Line: n})
+		}
+		if stage != "" {
+			stages[strings.ToLower(stage)] = true
+		}
+	})
+	return found
+}
+
+// yamlExtractor finds images in YAML: Kubernetes manifests and docker-compose files with image keys, Helm
+// values with repository and tag keys, and Kustomize images with name or newName, and newTag or digest keys
+type yamlExtractor struct{}
+
+var (
+	yamlImageRe = regexp.MustCompile(`^\s*(?:-\s+)?image:\s*["']?([^\s"'#]+)["']?\s*(?:#.*)?$`)
+	yamlKeyRe   = regexp.MustCompile(`^(\s*(-\s+)?)(repository|name|newName|tag|newTag|digest):\s*["']?([^\s"'#]+)["']?\s*(?:#.*)?$`)
+)
+
+// Match is true for .yaml and .yml files
+func (yamlExtractor) Match(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Extract finds image keys, and repository or name keys joined with a tag or digest key of the same mapping
+func (yamlExtractor) Extract(content []byte) []Found {
+	found := []Found{}
+	// the repository of the mapping at each column, and whether it is a newName, which wins over a name
+	type repo struct {
+		name    string
+		newName bool
+	}
+	repos := map[int]repo{}
+	lines(content, func(line string, n int) {
+		if m := yamlImageRe.FindStringSubmatch(line); m != nil {
+			if literal(m[1]) {
+				found = append(found, Found{Ref: m[1], Line: n})
+			}
+			return
+		}
+		m := yamlKeyRe.FindStringSubmatch(line)
+		if m == nil {
+			return
+		}
+		col := len(m[1])
+		for c := range repos {
+			// leaving a nested mapping, or starting the next item of a list
+			if c > col || (c == col && m[2] != "") {
+				delete(repos, c)
+			}
+		}
+		key, value := m[3], m[4]
+		switch key {
+		case "repository", "name", "newName":
+			if r, ok := repos[col]; !ok || !r.newName || key == "newName" {
+				repos[col] = repo{name: value, newName: key == "newName"}
+			}
+		case "tag", "newTag", "digest":
+			r, ok := repos[col]
+			if !ok || !literal(r.name) || !literal(value) {
+				return
+			}
+			sep := ":"
+			if key == "digest" {
+				sep = "@"
+			}
+			found = append(found, Found{Ref: r.name + sep + value, Line: n})
+		}
+	})
+	return found
+}
+
+// nomadExtractor finds the images of docker tasks in Nomad job files
+type nomadExtractor struct{}
+
+var nomadImageRe = regexp.MustCompile(`^\s*image\s*=\s*"([^"]+)"`)
+
+// Match is true for .nomad and .nomad.hcl files
+func (nomadExtractor) Match(path string) bool {
+	return strings.HasSuffix(path, ".nomad") || strings.HasSuffix(path, ".nomad.hcl")
+}
+
+// Extract finds image = "..." lines
+func (nomadExtractor) Extract(content []byte) []Found {
+	found := []Found{}
+	lines(content, func(line string, n int) {
+		if m := nomadImageRe.FindStringSubmatch(line); m != nil && literal(m[1]) {
+			found = append(found, Found{Ref: m[1], Line: n})
+		}
+	})
+	return found
+}
+
+func init() {
+	RegisterExtractor("dockerfile", dockerfileExtractor{})
+	RegisterExtractor("yaml", yamlExtractor{})
+	RegisterExtractor("nomad", nomadExtractor{})
+}
@@ -0,0 +1,164 @@
+package protect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+var deployRepo = map[string]string{
+	"web/Dockerfile": `ARG BASE=registry.company.net/tumblr/base:v3
+FROM ${BASE} AS deps
+FROM --platform=linux/amd64 registry.company.net/tumblr/builder:v2 AS build
+COPY --from=deps /deps /deps
+FROM ${UNSET}
+FROM scratch
+COPY --from=build /app /app
+COPY --from=registry.company.net/tumblr/tools:v1 /bin/tool /bin/tool
+`,
+	"web/values.yaml": `replicaCount: 3
+image:
+  repository: registry.company.net/tumblr/fleeble
+  tag: "v1.2.0" # bumped by CI
+sidecar:
+  image:
+    repository: registry.company.net/tumblr/envoy
+    digest: sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+`,
+	"web/kustomization.yaml": `resources:
+  - deployment.yaml
+images:
+  - name: registry.company.net/tumblr/fleeble
+    newTag: v1.1.0
+  - name: fleeble-canary
+    newName: registry.company.net/tumblr/fleeble
+    newTag: v1.3.0-rc1
+`,
+	"web/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: registry.company.net/tumblr/fleeble:v1.0.0
+        - name: templated
+          image: "{{ .Values.image }}"
+`,
+	"docker-compose.yml": `services:
+  plumbus:
+    image: 'registry.company.net/tumblr/plumbus:v0.1.0'
+`,
+	"jobs/plumbus.nomad": `job "plumbus" {
+  group "plumbus" {
+    task "plumbus" {
+      driver = "docker"
+      config {
+        image = "registry.company.net/tumblr/plumbus:v0.2.0"
+      }
+    }
+  }
+}
+`,
+	".git/config.yaml": `image: registry.company.net/tumblr/ignored:v1`,
+	"README.md":        `image: registry.company.net/tumblr/ignored:v2`,
+}
+
+// writeDeployRepo writes deployRepo to a temporary directory, returning it
+func writeDeployRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pruner-protect-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range deployRepo {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFilesSource(t *testing.T) {
+	dir := writeDeployRepo(t)
+	defer os.RemoveAll(dir)
+
+	source, err := NewFilesSource(&FilesConfig{Paths: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := source.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for _, img := range images {
+		rel, _ := filepath.Rel(dir, img.Source)
+		found = append(found, filepath.ToSlash(rel)+" "+img.Ref)
+	}
+	sort.Strings(found)
+	expected := []string{
+		"docker-compose.yml:3 registry.company.net/tumblr/plumbus:v0.1.0",
+		"jobs/plumbus.nomad:6 registry.company.net/tumblr/plumbus:v0.2.0",
+		"web/Dockerfile:2 registry.company.net/tumblr/base:v3",
+		"web/Dockerfile:3 registry.company.net/tumblr/builder:v2",
+		"web/Dockerfile:8 registry.company.net/tumblr/tools:v1",
+		"web/deployment.yaml:8 registry.company.net/tumblr/fleeble:v1.0.0",
+		"web/kustomization.yaml:5 registry.company.net/tumblr/fleeble:v1.1.0",
+		"web/kustomization.yaml:8 registry.company.net/tumblr/fleeble:v1.3.0-rc1",
+		"web/values.yaml:4 registry.company.net/tumblr/fleeble:v1.2.0",
+		"web/values.yaml:8 registry.company.net/tumblr/envoy@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+	}
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("expected to find\n%v\ngot\n%v", expected, found)
+	}
+
+	if _, err := NewFilesSource(&FilesConfig{Paths: []string{dir}, Extractors: []string{"terraform"}}); err != ErrUnknownExtractor {
+		t.Errorf("expected %v, got %v", ErrUnknownExtractor, err)
+	}
+	if _, err := NewFilesSource(&FilesConfig{}); err != ErrNoPaths {
+		t.Errorf("expected %v, got %v", ErrNoPaths, err)
+	}
+}
+
+func TestFilesProtectionOfSharedDigest(t *testing.T) {
+	dir := writeDeployRepo(t)
+	defer os.RemoveAll(dir)
+	source, err := NewFilesSource(&FilesConfig{Paths: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New("https://registry.company.net", []Source{source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := func(tag string, dgst digest.Digest) *registry.Manifest {
+		m, _ := registry.NewManifest("tumblr/fleeble", tag, time.Now(), map[string]string{})
+		m.Digest = dgst
+		return m
+	}
+	// web/values.yaml references v1.2.0, which CI also tagged build-123
+	referenced := manifest("v1.2.0", "sha256:aaaa")
+	build := manifest("build-123", "sha256:aaaa")
+	other := manifest("build-122", "sha256:bbbb")
+	all := []*registry.Manifest{referenced, build, other}
+
+	_, delete, protectedBy := rules.ApplyProtections([]rules.Protector{p}, all, []*registry.Manifest{referenced}, []*registry.Manifest{build, other})
+	if len(delete) != 1 || delete[0] != other {
+		t.Fatalf("expected only %s to be deleted, deleted %d", other.Reference(), len(delete))
+	}
+	protections := protectedBy[build.Reference()]
+	if len(protections) != 1 || protections[0].Reason != ReasonReferenced || !strings.HasSuffix(filepath.ToSlash(protections[0].Source), "web/values.yaml:4 (via tumblr/fleeble:v1.2.0)") {
+		t.Errorf("expected %s protected by web/values.yaml:4 via v1.2.0, got %v", build.Reference(), protections)
+	}
+}
@@ -0,0 +1,185 @@
+package protect
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ReasonInUse is what images referenced by Kubernetes workloads are reported as
+const ReasonInUse = "protected-in-use"
+
+// KubernetesConfig is which clusters to find the images of workloads in
+type KubernetesConfig struct {
+	// Kubeconfig is the kubeconfig file to use. If empty, $KUBECONFIG or ~/.kube/config is used
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Contexts are the contexts of the kubeconfig to look in. If empty, the current context is used
+	Contexts []string `yaml:"contexts"`
+	// Namespaces are the namespaces to look in. If empty, all namespaces are
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// kubernetesSource finds the images of the pods, and of the workloads that make pods, in clusters
+type kubernetesSource struct {
+	// clients are the clusters, by context name
+	clients    map[string]kubernetes.Interface
+	namespaces []string
+}
+
+// NewKubernetesSource connects to the contexts of the kubeconfig
+func NewKubernetesSource(c *KubernetesConfig) (Source, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if c.Kubeconfig != "" {
+		rules.ExplicitPath = c.Kubeconfig
+	}
+	contexts := c.Contexts
+	if len(contexts) == 0 {
+		// the current context
+		contexts = []string{""}
+	}
+	clients := map[string]kubernetes.Interface{}
+	for _, name := range contexts {
+		restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: name}).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes context %q: %v", name, err)
+		}
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes context %q: %v", name, err)
+		}
+		if name == "" {
+			name = "current-context"
+		}
+		clients[name] = client
+	}
+	return NewKubernetesSourceForClients(clients, c.Namespaces), nil
+}
+
+// NewKubernetesSourceForClients finds images with the clients, by context name, in the namespaces, or all namespaces if empty
+func NewKubernetesSourceForClients(clients map[string]kubernetes.Interface, namespaces []string) Source {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	return &kubernetesSource{clients: clients, namespaces: namespaces}
+}
+
+// Reason is ReasonInUse
+func (s *kubernetesSource) Reason() string {
+	return ReasonInUse
+}
+
+// Images are the images of every pod, and every Deployment, ReplicaSet, StatefulSet, DaemonSet, Job and
+// CronJob, so images are protected while they are scaled down or between scheduled runs, and while a
+// Deployment can be rolled back to them. For pods, the digests they run are included too.
+func (s *kubernetesSource) Images() ([]Image, error) {
+	contexts := []string{}
+	for name := range s.clients {
+		contexts = append(contexts, name)
+	}
+	sort.Strings(contexts)
+	images := []Image{}
+	for _, name := range contexts {
+		for _, ns := range s.namespaces {
+			found, err := workloadImages(context.Background(), s.clients[name], ns)
+			if err != nil {
+				return nil, fmt.Errorf("kubernetes context %s: %v", name, err)
+			}
+			for _, img := range found {
+				img.Source = name + "/" + img.Source
+				images = append(images, img)
+			}
+		}
+	}
+	return images, nil
+}
+
+// workloadImages lists the images of the workloads in ns, with sources of namespace/Kind/name
+func workloadImages(ctx context.Context, client kubernetes.Interface, ns string) ([]Image, error) {
+	images := []Image{}
+	add := func(kind string, meta metav1.ObjectMeta, spec corev1.PodSpec) {
+		source := fmt.Sprintf("%s/%s/%s", meta.Namespace, kind, meta.Name)
+		for _, img := range podSpecImages(spec) {
+			images = append(images, Image{Ref: img, Source: source})
+		}
+	}
+	opts := metav1.ListOptions{}
+
+	pods, err := client.CoreV1().Pods(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pods.Items {
+		add("Pod", p.ObjectMeta, p.Spec)
+		// the digest a pod runs protects the image even after its tag is moved
+		for _, statuses := range [][]corev1.ContainerStatus{p.Status.InitContainerStatuses, p.Status.ContainerStatuses, p.Status.EphemeralContainerStatuses} {
+			for _, cs := range statuses {
+				if cs.ImageID != "" {
+					images = append(images, Image{Ref: cs.ImageID, Source: fmt.Sprintf("%s/Pod/%s", p.Namespace, p.Name)})
+				}
+			}
+		}
+	}
+	deployments, err := client.AppsV1().Deployments(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments.Items {
+		add("Deployment", d.ObjectMeta, d.Spec.Template.Spec)
+	}
+	replicaSets, err := client.AppsV1().ReplicaSets(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, rs := range replicaSets.Items {
+		add("ReplicaSet", rs.ObjectMeta, rs.Spec.Template.Spec)
+	}
+	statefulSets, err := client.AppsV1().StatefulSets(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range statefulSets.Items {
+		add("StatefulSet", ss.ObjectMeta, ss.Spec.Template.Spec)
+	}
+	daemonSets, err := client.AppsV1().DaemonSets(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range daemonSets.Items {
+		add("DaemonSet", ds.ObjectMeta, ds.Spec.Template.Spec)
+	}
+	jobs, err := client.BatchV1().Jobs(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs.Items {
+		add("Job", j.ObjectMeta, j.Spec.Template.Spec)
+	}
+	cronJobs, err := client.BatchV1().CronJobs(ns).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, cj := range cronJobs.Items {
+		add("CronJob", cj.ObjectMeta, cj.Spec.JobTemplate.Spec.Template.Spec)
+	}
+	return images, nil
+}
+
+// podSpecImages are the images of every container of the pod spec
+func podSpecImages(spec corev1.PodSpec) []string {
+	images := []string{}
+	for _, c := range spec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range spec.Containers {
+		images = append(images, c.Image)
+	}
+	for _, c := range spec.EphemeralContainers {
+		images = append(images, c.Image)
+	}
+	return images
+}
@@ -0,0 +1,191 @@
+package protect
+
+// protect finds the images something still depends on, i.e. running workloads, so they are never
+// deleted, whatever the rules decide.
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"go.uber.org/zap"
+)
+
+var (
+	logger, _ = zap.NewProduction()
+	log       = logger.Sugar()
+
+	// dockerHubDomains are the names images on Docker Hub are referenced by
+	dockerHubDomains = map[string]bool{"docker.io": true, "index.docker.io": true, "registry-1.docker.io": true}
+)
+
+// Image is an image reference found by a Source, as written where it was found
+type Image struct {
+	// Ref is the image, i.e. registry.company.net/tumblr/fleeble:v1.0.0 or registry.company.net/tumblr/fleeble@sha256:...
+	Ref string
+	// Source is where the image was found, i.e. a workload or a file and line
+	Source string
+}
+
+// Source finds the images something depends on
+type Source interface {
+	// Reason is what the images the source protects are reported as, i.e. protected-in-use
+	Reason() string
+	// Images are all the images the source depends on
+	Images() ([]Image, error)
+}
+
+// Reference is an image in the registry, by tag, digest, or both
+type Reference struct {
+	Repo   string
+	Tag    string
+	Digest digest.Digest
+}
+
+// Normalizer turns image references into References in one registry
+type Normalizer struct {
+	domain string
+}
+
+// NewNormalizer normalizes references to images in the registry at registryURL
+func NewNormalizer(registryURL string) (*Normalizer, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, err
+	}
+	domain := u.Host
+	if domain == "" {
+		domain = registryURL
+	}
+	if dockerHubDomains[domain] {
+		domain = "docker.io"
+	}
+	return &Normalizer{domain: domain}, nil
+}
+
+// Normalize parses the image ref, as written in a pod spec, a Dockerfile, or reported in a pod's status.
+// An image without a tag or digest is tagged latest. It is false if the image is not in the registry.
+func (n *Normalizer) Normalize(ref string) (*Reference, bool) {
+	// container runtimes report the images pods run as docker-pullable://repo@digest
+	ref = strings.TrimPrefix(ref, "docker-pullable://")
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil || reference.Domain(named) != n.domain {
+		return nil, false
+	}
+	r := Reference{Repo: reference.Path(named)}
+	if tagged, ok := named.(reference.Tagged); ok {
+		r.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		r.Digest = digested.Digest()
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+	return &r, true
+}
+
+// Protector protects every image in the registry that its sources depend on. It implements rules.Protector.
+type Protector struct {
+	byRef map[string][]rules.Protection
+}
+
+// New finds the images of the sources in the registry at registryURL. If any source fails, nothing can be
+// known to be safe to delete, so the error is returned.
+func New(registryURL string, sources []Source) (*Protector, error) {
+	n, err := NewNormalizer(registryURL)
+	if err != nil {
+		return nil, err
+	}
+	p := Protector{byRef: map[string][]rules.Protection{}}
+	for _, s := range sources {
+		images, err := s.Images()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Reason(), err)
+		}
+		found := 0
+		for _, img := range images {
+			r, ok := n.Normalize(img.Ref)
+			if !ok {
+				continue
+			}
+			found++
+			p.add(r, rules.Protection{Reason: s.Reason(), Source: img.Source})
+		}
+		log.Infow("found protected images", "reason", s.Reason(), "images", found, "references", len(images))
+	}
+	return &p, nil
+}
+
+func (p *Protector) add(r *Reference, protection rules.Protection) {
+	for _, k := range refKeys(r.Repo, r.Tag, r.Digest) {
+		p.byRef[k] = append(p.byRef[k], protection)
+	}
+}
+
+// refKeys are repo:tag and repo@digest, for whichever of the tag and digest are set
+func refKeys(repo, tag string, dgst digest.Digest) []string {
+	keys := []string{}
+	if tag != "" {
+		keys = append(keys, fmt.Sprintf("%s:%s", repo, tag))
+	}
+	if dgst != "" {
+		keys = append(keys, fmt.Sprintf("%s@%s", repo, dgst))
+	}
+	return keys
+}
+
+// Protections are why the manifest must not be deleted: it is referenced by its tag, or by its digest
+func (p *Protector) Protections(m *registry.Manifest) []rules.Protection {
+	protections := []rules.Protection{}
+	seen := map[rules.Protection]bool{}
+	for _, k := range refKeys(m.Name, m.Tag, m.Digest) {
+		for _, protection := range p.byRef[k] {
+			if !seen[protection] {
+				seen[protection] = true
+				protections = append(protections, protection)
+			}
+		}
+	}
+	return protections
+}
+
+// Config is where to find the images that must not be deleted
+type Config struct {
+	// Kubernetes protects the images of workloads in Kubernetes clusters
+	Kubernetes *KubernetesConfig `yaml:"kubernetes"`
+	// Files protects the images referenced by local files, i.e. checkouts of deploy repos
+	Files *FilesConfig `yaml:"files"`
+}
+
+// Validate checks the config of each source
+func (c *Config) Validate() error {
+	if c.Files != nil {
+		return c.Files.Validate()
+	}
+	return nil
+}
+
+// Sources are the sources the config has
+func (c *Config) Sources() ([]Source, error) {
+	sources := []Source{}
+	if c.Kubernetes != nil {
+		s, err := NewKubernetesSource(c.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	if c.Files != nil {
+		s, err := NewFilesSource(c.Files)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
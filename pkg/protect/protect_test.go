@@ -0,0 +1,154 @@
+package protect
+
+import (
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+)
+
+const running = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func TestNormalize(t *testing.T) {
+	n, err := NewNormalizer("https://registry.company.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]*Reference{
+		"registry.company.net/tumblr/fleeble:v1.0.0":                              {Repo: "tumblr/fleeble", Tag: "v1.0.0"},
+		"registry.company.net/tumblr/fleeble":                                     {Repo: "tumblr/fleeble", Tag: "latest"},
+		"registry.company.net/tumblr/fleeble@" + running:                          {Repo: "tumblr/fleeble", Digest: running},
+		"registry.company.net/tumblr/fleeble:v1.0.0@" + running:                   {Repo: "tumblr/fleeble", Tag: "v1.0.0", Digest: running},
+		"docker-pullable://registry.company.net/tumblr/fleeble@" + running:        {Repo: "tumblr/fleeble", Digest: running},
+		"tumblr/fleeble:v1.0.0":                                                   nil,
+		"quay.io/tumblr/fleeble:v1.0.0":                                           nil,
+		"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": nil,
+	}
+	for ref, expected := range tests {
+		r, ok := n.Normalize(ref)
+		if expected == nil {
+			if ok {
+				t.Errorf("%s: expected no reference in the registry, got %+v", ref, r)
+			}
+			continue
+		}
+		if !ok || *r != *expected {
+			t.Errorf("%s: expected %+v, got %+v", ref, expected, r)
+		}
+	}
+
+	hub, _ := NewNormalizer("https://registry-1.docker.io")
+	if r, ok := hub.Normalize("nginx:1.25"); !ok || r.Repo != "library/nginx" || r.Tag != "1.25" {
+		t.Errorf("expected Docker Hub images to normalize to library/nginx:1.25, got %+v", r)
+	}
+}
+
+func podSpec(image string) corev1.PodSpec {
+	return corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}}
+}
+
+func TestKubernetesProtection(t *testing.T) {
+	prod := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "fleeble-abc"},
+			Spec:       podSpec("registry.company.net/tumblr/fleeble:v1.2.0"),
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", ImageID: "docker-pullable://registry.company.net/tumblr/fleeble@" + running},
+			}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "fleeble"},
+			Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec("registry.company.net/tumblr/fleeble:v1.2.0")}},
+		},
+	)
+	staging := fake.NewSimpleClientset(
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "batch", Name: "plumbus-nightly"},
+			Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{Spec: podSpec("registry.company.net/tumblr/plumbus:v0.1.0")},
+			}}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "elsewhere"},
+			Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec("quay.io/tumblr/plumbus:v0.0.1")}},
+		},
+	)
+	source := NewKubernetesSourceForClients(map[string]kubernetes.Interface{"prod": prod, "staging": staging}, nil)
+	p, err := New("https://registry.company.net", []Source{source})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := func(repo, tag string, dgst digest.Digest) *registry.Manifest {
+		m, _ := registry.NewManifest(repo, tag, time.Now(), map[string]string{})
+		m.Digest = dgst
+		return m
+	}
+	inUse := manifest("tumblr/fleeble", "v1.2.0", "sha256:aaaa")
+	movedFrom := manifest("tumblr/fleeble", "v1.1.0", running)
+	cron := manifest("tumblr/plumbus", "v0.1.0", "sha256:bbbb")
+	unused := manifest("tumblr/plumbus", "v0.0.1", "sha256:cccc")
+
+	keep, delete, protectedBy := rules.ApplyProtections([]rules.Protector{p}, []*registry.Manifest{}, []*registry.Manifest{}, []*registry.Manifest{inUse, movedFrom, cron, unused})
+	if len(keep) != 3 || len(delete) != 1 || delete[0] != unused {
+		t.Fatalf("expected only %s to be deleted, kept %d and deleted %d", unused.Reference(), len(keep), len(delete))
+	}
+	expected := map[string][]rules.Protection{
+		inUse.Reference(): {
+			{Reason: ReasonInUse, Source: "prod/web/Pod/fleeble-abc"},
+			{Reason: ReasonInUse, Source: "prod/web/Deployment/fleeble"},
+		},
+		movedFrom.Reference(): {{Reason: ReasonInUse, Source: "prod/web/Pod/fleeble-abc"}},
+		cron.Reference():      {{Reason: ReasonInUse, Source: "staging/batch/CronJob/plumbus-nightly"}},
+	}
+	for ref, protections := range expected {
+		if len(protectedBy[ref]) != len(protections) {
+			t.Errorf("%s: expected protections %v, got %v", ref, protections, protectedBy[ref])
+			continue
+		}
+		for i := range protections {
+			if protectedBy[ref][i] != protections[i] {
+				t.Errorf("%s: expected protections %v, got %v", ref, protections, protectedBy[ref])
+			}
+		}
+	}
+}
+
+func TestKubernetesProtectionOfSharedDigest(t *testing.T) {
+	prod := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "fleeble"},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec("registry.company.net/tumblr/fleeble:v1-prod")}},
+	})
+	p, err := New("https://registry.company.net", []Source{NewKubernetesSourceForClients(map[string]kubernetes.Interface{"prod": prod}, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := func(tag string, dgst digest.Digest) *registry.Manifest {
+		m, _ := registry.NewManifest("tumblr/fleeble", tag, time.Now(), map[string]string{})
+		m.Digest = dgst
+		return m
+	}
+	// the rules keep v1-prod, but deleting build-123 would delete its digest, and v1-prod with it
+	prodTag := manifest("v1-prod", running)
+	build := manifest("build-123", running)
+	other := manifest("build-122", "sha256:aaaa")
+	all := []*registry.Manifest{prodTag, build, other}
+
+	keep, delete, protectedBy := rules.ApplyProtections([]rules.Protector{p}, all, []*registry.Manifest{prodTag}, []*registry.Manifest{build, other})
+	if len(keep) != 2 || len(delete) != 1 || delete[0] != other {
+		t.Fatalf("expected only %s to be deleted, kept %d and deleted %d", other.Reference(), len(keep), len(delete))
+	}
+	expected := rules.Protection{Reason: ReasonInUse, Source: "prod/web/Deployment/fleeble (via tumblr/fleeble:v1-prod)"}
+	if len(protectedBy[build.Reference()]) != 1 || protectedBy[build.Reference()][0] != expected {
+		t.Errorf("expected %s protected by %v, got %v", build.Reference(), expected, protectedBy[build.Reference()])
+	}
+}
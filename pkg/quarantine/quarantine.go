@@ -0,0 +1,109 @@
+package quarantine
+
+// quarantine names the copies images are moved to instead of being deleted outright: repo:tag is
+// quarantined as <prefix>/repo:tag-<date>, so it can be brought back until it is purged.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPrefix is the repo quarantined images are moved under, if the config has no prefix
+const DefaultPrefix = "quarantine"
+
+var (
+	// ErrPurgeAfterDaysMustBePositive is returned when purge_after_days is negative
+	ErrPurgeAfterDaysMustBePositive = fmt.Errorf("quarantine purge_after_days must be positive")
+	// ErrInvalidPrefix is returned when the prefix is not a repo name
+	ErrInvalidPrefix = fmt.Errorf("quarantine prefix must be a repo name, without leading or trailing /")
+
+	// dateFormat is the format of the date quarantined tags end with
+	dateFormat = "20060102"
+	// maxTagLength is the longest tag registries accept
+	maxTagLength = 128
+)
+
+// Config is where images are quarantined, and for how long
+type Config struct {
+	// Prefix is the repo images are quarantined under, i.e. quarantine for quarantine/<repo>. Defaults to DefaultPrefix
+	Prefix string `yaml:"prefix"`
+	// PurgeAfterDays is how many days quarantined images are kept before they are deleted. If 0, they are never purged
+	PurgeAfterDays int `yaml:"purge_after_days"`
+}
+
+// Validate checks the prefix and purge period
+func (c *Config) Validate() error {
+	if strings.HasPrefix(c.Prefix, "/") || strings.HasSuffix(c.Prefix, "/") {
+		return ErrInvalidPrefix
+	}
+	if c.PurgeAfterDays < 0 {
+		return ErrPurgeAfterDaysMustBePositive
+	}
+	return nil
+}
+
+// Repo is the repo the images of repo are quarantined in
+func (c *Config) Repo(repo string) string {
+	return c.prefix() + "/" + repo
+}
+
+// Contains is true if repo is a quarantine repo, under the prefix
+func (c *Config) Contains(repo string) bool {
+	return strings.HasPrefix(repo, c.prefix()+"/")
+}
+
+func (c *Config) prefix() string {
+	if c.Prefix == "" {
+		return DefaultPrefix
+	}
+	return c.Prefix
+}
+
+// Tag is the tag an image tagged tag is quarantined as at t. Long tags are shortened to fit the date.
+func Tag(tag string, t time.Time) string {
+	suffix := "-" + t.UTC().Format(dateFormat)
+	if len(tag)+len(suffix) > maxTagLength {
+		tag = tag[:maxTagLength-len(suffix)]
+	}
+	return tag + suffix
+}
+
+// QuarantinedAt is the date a quarantined tag was quarantined, or false if the tag is not a quarantined tag
+func QuarantinedAt(tag string) (time.Time, bool) {
+	i := strings.LastIndex(tag, "-")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(dateFormat, tag[i+1:])
+	return t, err == nil
+}
+
+// Expired is true if the quarantined tag was quarantined at least PurgeAfterDays days before tNow.
+// Nothing expires if PurgeAfterDays is 0, and tags that are not quarantined tags never expire.
+func (c *Config) Expired(tag string, tNow time.Time) bool {
+	t, ok := QuarantinedAt(tag)
+	if !ok || c.PurgeAfterDays == 0 {
+		return false
+	}
+	return !tNow.Before(t.Add(time.Duration(c.PurgeAfterDays) * 24 * time.Hour))
+}
+
+// Purgeable are the digests of tagsByDigest, the tags of a quarantine repo by their digest, that can be
+// purged at tNow: every tag on them is a quarantined tag that expired. Deleting a digest deletes every tag
+// on it, so a digest with any other tag is kept.
+func (c *Config) Purgeable(tagsByDigest map[string][]string, tNow time.Time) []string {
+	purgeable := []string{}
+	for dgst, tags := range tagsByDigest {
+		expired := len(tags) > 0
+		for _, tag := range tags {
+			expired = expired && c.Expired(tag, tNow)
+		}
+		if expired {
+			purgeable = append(purgeable, dgst)
+		}
+	}
+	sort.Strings(purgeable)
+	return purgeable
+}
@@ -0,0 +1,72 @@
+package quarantine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantineNames(t *testing.T) {
+	c := Config{PurgeAfterDays: 30}
+	if repo := c.Repo("tumblr/fleeble"); repo != "quarantine/tumblr/fleeble" {
+		t.Errorf("expected quarantine/tumblr/fleeble, got %s", repo)
+	}
+	c.Prefix = "attic"
+	if repo := c.Repo("tumblr/fleeble"); repo != "attic/tumblr/fleeble" {
+		t.Errorf("expected attic/tumblr/fleeble, got %s", repo)
+	}
+
+	at := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	tag := Tag("v1.0.0", at)
+	if tag != "v1.0.0-20260615" {
+		t.Errorf("expected v1.0.0-20260615, got %s", tag)
+	}
+	if long := Tag(strings.Repeat("a", 130), at); len(long) != maxTagLength || !strings.HasSuffix(long, "-20260615") {
+		t.Errorf("expected a long tag shortened to %d characters, got %s", maxTagLength, long)
+	}
+	if quarantined, ok := QuarantinedAt(tag); !ok || !quarantined.Equal(time.Date(2026, 6, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected %s quarantined on 2026-06-15, got %s", tag, quarantined)
+	}
+
+	for tNow, expired := range map[time.Time]bool{at.Add(29 * 24 * time.Hour): false, at.Add(30 * 24 * time.Hour): true} {
+		if c.Expired(tag, tNow) != expired {
+			t.Errorf("expected %s expired at %s to be %v", tag, tNow, expired)
+		}
+	}
+	if c.Expired("v1.0.0", at.Add(365*24*time.Hour)) {
+		t.Errorf("expected a tag that was not quarantined never to expire")
+	}
+	if (&Config{}).Expired(tag, at.Add(365*24*time.Hour)) {
+		t.Errorf("expected nothing to expire without purge_after_days")
+	}
+	for _, bad := range []Config{{Prefix: "/quarantine"}, {PurgeAfterDays: -1}} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func TestPurgeable(t *testing.T) {
+	c := Config{PurgeAfterDays: 30}
+	tNow := time.Date(2026, 7, 20, 0, 0, 0, 0, time.UTC)
+	tagsByDigest := map[string][]string{
+		// every quarantined tag expired
+		"sha256:aaaa": {"v1.0.0-20260601", "v1.0.1-20260615"},
+		// one tag on the digest was quarantined recently
+		"sha256:bbbb": {"v2.0.0-20260601", "v2.0.1-20260710"},
+		// a tag that is not a quarantined tag never expires
+		"sha256:cccc": {"v3.0.0-20260601", "latest"},
+	}
+	if purgeable := c.Purgeable(tagsByDigest, tNow); len(purgeable) != 1 || purgeable[0] != "sha256:aaaa" {
+		t.Errorf("expected only sha256:aaaa purgeable, got %v", purgeable)
+	}
+}
+
+func TestContains(t *testing.T) {
+	c := Config{}
+	for repo, contained := range map[string]bool{"quarantine/tumblr/fleeble": true, "tumblr/fleeble": false, "quarantined/tumblr/fleeble": false} {
+		if c.Contains(repo) != contained {
+			t.Errorf("expected %s in quarantine to be %v", repo, contained)
+		}
+	}
+}
@@ -43,11 +43,15 @@ func FromSignedManifest(sm *schema1.SignedManifest) (*Manifest, error) {
 	// will need to figure out what we want to do for V2 manifests if we want to support date-based expirations
 
 	labels := map[string]string{}
-	var lastModified time.Time
+	var lastModified, created time.Time
 
-	for _, h := range sm.History {
+	for i, h := range sm.History {
 		// keep deserializing the history blobs and extracting any interesting tidbit we can salvage from them
 		v1c := deserializeV1CompatibilityHistory(h.V1Compatibility)
+		// the first history entry is the image's own config
+		if i == 0 {
+			created = v1c.Created
+		}
 		// we care about the most recent Created field
 		if v1c.Created.After(lastModified) {
 			lastModified = v1c.Created
@@ -61,5 +65,10 @@ func FromSignedManifest(sm *schema1.SignedManifest) (*Manifest, error) {
 			}
 		}
 	}
-	return NewManifest(sm.Name, sm.Tag, lastModified, labels)
+	m, err := NewManifest(sm.Name, sm.Tag, lastModified, labels)
+	if err != nil {
+		return nil, err
+	}
+	m.Created = created
+	return m, nil
 }
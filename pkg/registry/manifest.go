@@ -2,22 +2,31 @@ package registry
 
 import (
 	"fmt"
-	"regexp"
 	//"sort"
 	"time"
 
-	"github.com/hashicorp/go-version"
+	digest "github.com/opencontainers/go-digest"
 	"go.uber.org/zap"
 	//"github.com/tumblr/docker-registry-pruner/pkg/rules"
 )
 
 var (
-	// DefaultVersion is the default version we use for a Manifest if we cant parse it
-	DefaultVersion = version.Must(version.NewVersion("0.0.0"))
-	// GitShaRegex is the anchored regex that a pure commit sha matches
-	GitShaRegex = regexp.MustCompile(`^[0-9a-f]{4,}$`)
-	logger, _   = zap.NewProduction()
-	log         = logger.Sugar()
+	logger, _ = zap.NewProduction()
+	log       = logger.Sugar()
+)
+
+// The sources a Manifest's LastModified can come from
+const (
+	// AgeSourceHistory is the newest created time in the image's history, i.e. when it was built
+	AgeSourceHistory = "history"
+	// AgeSourceCreated is the created time of the image config
+	AgeSourceCreated = "created"
+	// AgeSourceLabel is a timestamp in one of the image's labels
+	AgeSourceLabel = "label"
+	// AgeSourceTag is a timestamp embedded in the tag
+	AgeSourceTag = "tag"
+	// AgeSourceFirstSeen is when the pruner first saw the tag pointing at this digest
+	AgeSourceFirstSeen = "first_seen"
 )
 
 // Manifest is a combined struct of a v1 manifest, as well as some interesting fields
@@ -25,11 +34,21 @@ var (
 type Manifest struct {
 	Name string
 	Tag  string
+	// Digest is the content digest of the manifest in the registry, if known
+	Digest digest.Digest
 	//FSLayers []*schema1.FSLayer
 	// LastModified is a synthesized field we extract from History via `lastModified`
 	LastModified time.Time
+	// AgeSource is where LastModified came from; AgeSourceHistory unless a rule chose another source
+	AgeSource string
+	// Created is the created time of the image config, if known
+	Created time.Time
+	// FirstSeen is when the tag was first seen pointing at this digest, if known
+	FirstSeen time.Time
+	// Size is the size in bytes of the image's config and layers, or 0 if unknown
+	Size int64
 	// Version is a sortable version field, derived from Tag
-	Version *version.Version
+	Version Version
 	Labels  map[string]string
 }
 
@@ -40,27 +59,41 @@ func NewManifest(repo string, tag string, lm time.Time, labels map[string]string
 		Name:         repo,
 		Tag:          tag,
 		LastModified: lm,
+		AgeSource:    AgeSourceHistory,
 		Labels:       labels,
 	}
 
 	// do some version parsing of the tag, as well!
-	// before we do any version parsing, lets match against a raw git sha - hashicorp version parsing produces nonsense
-	// values when parsing shas, so lets skip this and just assume DefaultVersion here.
-	if GitShaRegex.MatchString(tag) {
-		log.Debugf("Assuming default version, because %s is just a git sha", tag)
+	mani.Version, err = ParseVersion(tag, nil, nil)
+	if err != nil {
+		// lets make the assumption that we just take the minimal version
+		log.Debugf("Assuming default version for %s:%s: %v", repo, tag, err)
 		mani.Version = DefaultVersion
-	} else {
-
-		mani.Version, err = version.NewVersion(tag)
-		if err != nil {
-			// lets make the assumption that we just take the minimal version
-			mani.Version = DefaultVersion
-		}
 	}
 
 	return &mani, nil
 }
 
+// Reference is the repo:tag of this Manifest
+func (m *Manifest) Reference() string {
+	return fmt.Sprintf("%s:%s", m.Name, m.Tag)
+}
+
+// WithVersion returns a shallow copy of this Manifest with a different Version
+func (m *Manifest) WithVersion(v Version) *Manifest {
+	mani := *m
+	mani.Version = v
+	return &mani
+}
+
+// WithLastModified returns a shallow copy of this Manifest with LastModified taken from another source
+func (m *Manifest) WithLastModified(lm time.Time, source string) *Manifest {
+	mani := *m
+	mani.LastModified = lm
+	mani.AgeSource = source
+	return &mani
+}
+
 // removes all items in b from a, returning the list (a-b)
 // this is super shitty timecomplexity but i really dont care
 func RemoveItems(a []*Manifest, b []*Manifest) []*Manifest {
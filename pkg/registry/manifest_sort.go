@@ -1,7 +1,8 @@
 package registry
 
 // ManifestVersionCollection is a type that implements the sort.Interface interface
-// so that versions can be sorted.
+// so that versions can be sorted. Manifests are ordered with Version.Compare, so all
+// Versions in the collection should come from the same VersionScheme.
 type ManifestVersionCollection []*Manifest
 
 func (v ManifestVersionCollection) Len() int {
@@ -9,7 +10,7 @@ func (v ManifestVersionCollection) Len() int {
 }
 
 func (v ManifestVersionCollection) Less(i, j int) bool {
-	return v[i].Version.LessThan(v[j].Version)
+	return v[i].Version.Compare(v[j].Version) < 0
 }
 
 func (v ManifestVersionCollection) Swap(i, j int) {
@@ -0,0 +1,299 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+var (
+	// DefaultVersion is the default version we use for a Manifest if we cant parse it
+	DefaultVersion Version = semverVersion{version.Must(version.NewVersion("0.0.0"))}
+	// DefaultVersionScheme is the VersionScheme used when none is specified
+	DefaultVersionScheme VersionScheme = SemverScheme{}
+	// VersionSchemes are all the known VersionSchemes, by name
+	VersionSchemes = map[string]VersionScheme{
+		SemverScheme{}.Name():  SemverScheme{},
+		CalverScheme{}.Name():  CalverScheme{},
+		IntegerScheme{}.Name(): IntegerScheme{},
+		NaturalScheme{}.Name(): NaturalScheme{},
+	}
+
+	// GitShaRegex is the anchored regex that a pure commit sha matches
+	GitShaRegex = regexp.MustCompile(`^[0-9a-f]{4,}$`)
+	// VersionRegexGroup is the name of the capture group a version regex uses to extract the version from a tag
+	VersionRegexGroup = "version"
+
+	// ErrVersionIsGitSha is returned when a tag is a bare git sha, and has no meaningful version
+	ErrVersionIsGitSha = fmt.Errorf("tag is a git sha")
+	// ErrVersionRegexNoMatch is returned when a tag does not match the version regex
+	ErrVersionRegexNoMatch = fmt.Errorf("tag does not match version regex")
+	// ErrUnknownVersionScheme is returned when looking up a VersionScheme that does not exist
+	ErrUnknownVersionScheme = fmt.Errorf("unknown version_scheme")
+	// ErrInvalidCalver is returned when a tag is not a calendar version
+	ErrInvalidCalver = fmt.Errorf("tag is not a calendar version")
+	// ErrInvalidInteger is returned when a tag does not end in a build number
+	ErrInvalidInteger = fmt.Errorf("tag is not a build number")
+	// ErrEmptyVersion is returned when there is nothing to parse a version from
+	ErrEmptyVersion = fmt.Errorf("version is empty")
+
+	calverRegex        = regexp.MustCompile(`^(\d{4})\.(\d{1,2})(?:\.(\d{1,2}))?(?:[-.+_](\d+))?$`)
+	calverCompactRegex = regexp.MustCompile(`^(\d{4})(\d{2})(\d{2})(?:[-.+_](\d+))?$`)
+	integerRegex       = regexp.MustCompile(`^\D*(\d+)$`)
+	naturalChunkRegex  = regexp.MustCompile(`\d+|\D+`)
+)
+
+// Version is a sortable version, parsed from a tag by a VersionScheme
+type Version interface {
+	// Compare returns -1, 0, or 1 if this Version is less than, equal to, or greater than other.
+	// Versions from different schemes are compared by their string representation.
+	Compare(other Version) int
+	String() string
+}
+
+// VersionScheme parses tags into Versions that can be ordered
+type VersionScheme interface {
+	// Name is the name of the scheme, as used in config
+	Name() string
+	// Parse turns a raw version string into a Version, or returns an error if it is unsortable
+	Parse(raw string) (Version, error)
+}
+
+// VersionSchemeByName looks up a VersionScheme by name. An empty name returns DefaultVersionScheme.
+func VersionSchemeByName(name string) (VersionScheme, error) {
+	if name == "" {
+		return DefaultVersionScheme, nil
+	}
+	s, ok := VersionSchemes[name]
+	if !ok {
+		return nil, ErrUnknownVersionScheme
+	}
+	return s, nil
+}
+
+// ParseVersion parses a version out of a tag with the given scheme. If re is not nil, the version is
+// extracted from the tag with the named capture group VersionRegexGroup before parsing.
+// A nil scheme uses DefaultVersionScheme.
+func ParseVersion(tag string, re *regexp.Regexp, scheme VersionScheme) (Version, error) {
+	if scheme == nil {
+		scheme = DefaultVersionScheme
+	}
+	raw := tag
+	if re != nil {
+		match := re.FindStringSubmatch(tag)
+		if match == nil {
+			return nil, ErrVersionRegexNoMatch
+		}
+		i := re.SubexpIndex(VersionRegexGroup)
+		if i < 0 {
+			return nil, ErrVersionRegexNoMatch
+		}
+		raw = match[i]
+	}
+	return scheme.Parse(raw)
+}
+
+// isGitSha is true if s looks like an abbreviated or full commit sha. Unlike GitShaRegex,
+// this requires at least one hex letter, so plain numbers are not mistaken for shas.
+func isGitSha(s string) bool {
+	return GitShaRegex.MatchString(s) && strings.ContainsAny(s, "abcdef")
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareInts(a, b []uint64) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SemverScheme orders tags by semantic version (https://semver.org). This is the default.
+type SemverScheme struct{}
+
+type semverVersion struct {
+	*version.Version
+}
+
+func (SemverScheme) Name() string { return "semver" }
+
+func (SemverScheme) Parse(raw string) (Version, error) {
+	// before we do any version parsing, lets match against a raw git sha - hashicorp version parsing produces nonsense
+	// values when parsing shas, so lets skip this
+	if GitShaRegex.MatchString(raw) {
+		return nil, ErrVersionIsGitSha
+	}
+	v, err := version.NewVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+	return semverVersion{v}, nil
+}
+
+func (v semverVersion) Compare(other Version) int {
+	o, ok := other.(semverVersion)
+	if !ok {
+		return compareStrings(v.String(), other.String())
+	}
+	return v.Version.Compare(o.Version)
+}
+
+// CalverScheme orders tags by calendar version, i.e. 2024.06.17, 2024.6-3 or 20240617-1.
+// An optional trailing build number orders releases made on the same day.
+type CalverScheme struct{}
+
+type calverVersion struct {
+	raw      string
+	segments []uint64
+}
+
+func (CalverScheme) Name() string { return "calver" }
+
+func (CalverScheme) Parse(raw string) (Version, error) {
+	match := calverRegex.FindStringSubmatch(raw)
+	if match == nil {
+		match = calverCompactRegex.FindStringSubmatch(raw)
+	}
+	if match == nil {
+		return nil, ErrInvalidCalver
+	}
+	// segments are year, month, day, build; missing segments are 0
+	segments := make([]uint64, 4)
+	for i, s := range match[1:] {
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = n
+	}
+	if segments[1] < 1 || segments[1] > 12 || segments[2] > 31 {
+		return nil, ErrInvalidCalver
+	}
+	return calverVersion{raw: raw, segments: segments}, nil
+}
+
+func (v calverVersion) Compare(other Version) int {
+	o, ok := other.(calverVersion)
+	if !ok {
+		return compareStrings(v.String(), other.String())
+	}
+	return compareInts(v.segments, o.segments)
+}
+
+func (v calverVersion) String() string {
+	return v.raw
+}
+
+// IntegerScheme orders tags by a trailing build number, i.e. 4812 or build-4812
+type IntegerScheme struct{}
+
+type integerVersion struct {
+	raw string
+	n   uint64
+}
+
+func (IntegerScheme) Name() string { return "integer" }
+
+func (IntegerScheme) Parse(raw string) (Version, error) {
+	if isGitSha(raw) {
+		return nil, ErrVersionIsGitSha
+	}
+	match := integerRegex.FindStringSubmatch(raw)
+	if match == nil {
+		return nil, ErrInvalidInteger
+	}
+	n, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return integerVersion{raw: raw, n: n}, nil
+}
+
+func (v integerVersion) Compare(other Version) int {
+	o, ok := other.(integerVersion)
+	if !ok {
+		return compareStrings(v.String(), other.String())
+	}
+	return compareInts([]uint64{v.n}, []uint64{o.n})
+}
+
+func (v integerVersion) String() string {
+	return v.raw
+}
+
+// NaturalScheme orders tags in natural string order, where runs of digits compare numerically,
+// so that build-9 sorts before build-10.
+type NaturalScheme struct{}
+
+type naturalVersion struct {
+	raw    string
+	chunks []string
+}
+
+func (NaturalScheme) Name() string { return "natural" }
+
+func (NaturalScheme) Parse(raw string) (Version, error) {
+	if raw == "" {
+		return nil, ErrEmptyVersion
+	}
+	if isGitSha(raw) {
+		return nil, ErrVersionIsGitSha
+	}
+	return naturalVersion{raw: raw, chunks: naturalChunkRegex.FindAllString(raw, -1)}, nil
+}
+
+func (v naturalVersion) Compare(other Version) int {
+	o, ok := other.(naturalVersion)
+	if !ok {
+		return compareStrings(v.String(), other.String())
+	}
+	for i := 0; i < len(v.chunks) && i < len(o.chunks); i++ {
+		a, b := v.chunks[i], o.chunks[i]
+		if isDigit(a[0]) && isDigit(b[0]) {
+			// compare numerically without overflowing: strip leading zeros, then longer is bigger
+			a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+			if len(a) != len(b) {
+				return compareInts([]uint64{uint64(len(a))}, []uint64{uint64(len(b))})
+			}
+		}
+		if c := compareStrings(a, b); c != 0 {
+			return c
+		}
+	}
+	return compareInts([]uint64{uint64(len(v.chunks))}, []uint64{uint64(len(o.chunks))})
+}
+
+func (v naturalVersion) String() string {
+	return v.raw
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
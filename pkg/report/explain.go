@@ -0,0 +1,78 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// ErrNothingToExplain is returned when explaining an image no rule selected
+var ErrNothingToExplain = fmt.Errorf("no rule selected the image; it is kept")
+
+// Explain writes why each of the report's images of repo got its action, for people. If tag is not empty,
+// only the image with that tag is explained. Returns ErrNothingToExplain if there are no such images.
+func (r *Report) Explain(w io.Writer, repo, tag string) error {
+	images := []*Image{}
+	for _, img := range r.Images {
+		if img.Repo == repo && (tag == "" || img.Tag == tag) {
+			images = append(images, img)
+		}
+	}
+	if len(images) == 0 {
+		return ErrNothingToExplain
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	for _, img := range images {
+		fmt.Fprintf(tw, "%s:%s\n", img.Repo, img.Tag)
+		for _, line := range img.explain() {
+			name := line[0]
+			if name != "" {
+				name += ":"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\n", name, line[1])
+		}
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintf(tw, "as of %s\n", r.Now)
+	return tw.Flush()
+}
+
+// explain is what the image's action is and why, as name and value pairs. Names are empty for more
+// values of the name before
+func (i *Image) explain() [][2]string {
+	lines := [][2]string{{"action", i.Action}}
+	if i.Digest != "" {
+		lines = append(lines, [2]string{"digest", i.Digest})
+	}
+	lines = append(lines, [2]string{"version", i.Version}, [2]string{"age", fmt.Sprintf("%d days, from %s", i.AgeDays, i.AgeSource)})
+	rules := strings.Join(i.Rules, ", ")
+	switch {
+	case len(i.ProtectedBy) > 0:
+		lines = append(lines, [2]string{"would be deleted by", rules})
+		for n, source := range i.ProtectedBy {
+			name := "protected by"
+			if n > 0 {
+				name = ""
+			}
+			lines = append(lines, [2]string{name, source})
+		}
+	case i.Action == "keep":
+		lines = append(lines, [2]string{"kept by", rules})
+	case i.Action == "skipped":
+		lines = append(lines, [2]string{"skipped by", rules})
+	default:
+		lines = append(lines, [2]string{"deleted by", rules})
+	}
+	if i.PendingSince != "" {
+		lines = append(lines, [2]string{"pending since", i.PendingSince}, [2]string{"delete at", i.DeleteAt})
+	}
+	for n, issue := range i.Issues {
+		name := "issues"
+		if n > 0 {
+			name = ""
+		}
+		lines = append(lines, [2]string{name, issue})
+	}
+	return lines
+}
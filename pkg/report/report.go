@@ -0,0 +1,507 @@
+package report
+
+// report is what a config decides to do to a registry's images, and why, in a stable order, written
+// as a table for people or as JSON, CSV, YAML or Markdown for CI checks, dashboards and PR comments.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/grace"
+	"github.com/tumblr/docker-registry-pruner/pkg/pins"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"gopkg.in/yaml.v2"
+)
+
+// The formats a Report can be written in
+const (
+	FormatTable    = "table"
+	FormatJSON     = "json"
+	FormatCSV      = "csv"
+	FormatYAML     = "yaml"
+	FormatMarkdown = "markdown"
+)
+
+var (
+	// Formats are all the formats a Report can be written in
+	Formats = []string{FormatTable, FormatJSON, FormatCSV, FormatYAML, FormatMarkdown}
+
+	// ErrUnknownFormat is returned when writing a report in a format not in Formats
+	ErrUnknownFormat = fmt.Errorf("unknown report format, expected one of %s", strings.Join(Formats, ", "))
+)
+
+// Report is what the rules decided for each image, with totals per repo and per rule
+type Report struct {
+	// Now is the time the rules were evaluated as of, as RFC3339
+	Now        string `json:"now" yaml:"now"`
+	Keep       int    `json:"keep" yaml:"keep"`
+	Delete     int    `json:"delete" yaml:"delete"`
+	DeleteSize int64  `json:"delete_size" yaml:"delete_size"`
+	// Pending is how many images are marked for deletion, but still in their grace period
+	Pending int `json:"pending" yaml:"pending"`
+	// Protected is how many of the images kept were protected from deletion, i.e. because they are in use
+	Protected int `json:"protected" yaml:"protected"`
+	// Skipped is how many images rules selected, but neither kept nor deleted because of their issues
+	Skipped int        `json:"skipped" yaml:"skipped"`
+	Images  []*Image   `json:"images" yaml:"images"`
+	Repos   []*Summary `json:"repos" yaml:"repos"`
+	Rules   []*Summary `json:"rules" yaml:"rules"`
+	// Groups are how many images each grouped rule kept and deleted in each group of each repo
+	Groups []*Group `json:"groups" yaml:"groups"`
+	// Rescued are the images that were pending deletion, that the rules no longer delete
+	Rescued []*Rescued `json:"rescued" yaml:"rescued"`
+	// Pins are the pins that need attention, because they expired or match no images
+	Pins []*pins.Flag `json:"pins" yaml:"pins"`
+}
+
+// Image is the decision for one image
+type Image struct {
+	Action  string `json:"action" yaml:"action"`
+	Repo    string `json:"repo" yaml:"repo"`
+	Tag     string `json:"tag" yaml:"tag"`
+	Digest  string `json:"digest" yaml:"digest"`
+	Version string `json:"version" yaml:"version"`
+	// Size is the size of the image in bytes, or 0 if unknown
+	Size      int64  `json:"size" yaml:"size"`
+	AgeDays   int64  `json:"age_days" yaml:"age_days"`
+	AgeSource string `json:"age_source" yaml:"age_source"`
+	// Rules are the names of the rules that decided on the action. For protected images, the rules that would have deleted them
+	Rules []string `json:"rules" yaml:"rules"`
+	// ProtectedBy are what a protected image was protected by, i.e. the workloads using it
+	ProtectedBy []string `json:"protected_by,omitempty" yaml:"protected_by,omitempty"`
+	// PendingSince is when a pending image was first marked for deletion, as RFC3339
+	PendingSince string `json:"pending_since,omitempty" yaml:"pending_since,omitempty"`
+	// DeleteAt is when a pending image will be deleted, if it stays marked until then, as RFC3339
+	DeleteAt string `json:"delete_at,omitempty" yaml:"delete_at,omitempty"`
+	// Issues are what rules found wrong with the image, i.e. a tag whose version does not parse, with the rule
+	Issues []string `json:"issues,omitempty" yaml:"issues,omitempty"`
+
+	lastModified time.Time
+	version      registry.Version
+}
+
+// Summary is how many images a repo or rule keeps and deletes
+type Summary struct {
+	Name   string `json:"name" yaml:"name"`
+	Keep   int    `json:"keep" yaml:"keep"`
+	Delete int    `json:"delete" yaml:"delete"`
+	// DeleteSize is the total size in bytes of the images deleted, as far as it is known
+	DeleteSize int64 `json:"delete_size" yaml:"delete_size"`
+	Pending    int   `json:"pending" yaml:"pending"`
+}
+
+// Group is how many images of a repo's group a grouped rule kept and deleted, before the decisions of other
+// rules, grace periods and protections are taken into account
+type Group struct {
+	Rule   string `json:"rule" yaml:"rule"`
+	Repo   string `json:"repo" yaml:"repo"`
+	Group  string `json:"group" yaml:"group"`
+	Keep   int    `json:"keep" yaml:"keep"`
+	Delete int    `json:"delete" yaml:"delete"`
+}
+
+// Rescued is an image that was pending deletion, until the rules stopped deleting it
+type Rescued struct {
+	Repo   string `json:"repo" yaml:"repo"`
+	Tag    string `json:"tag" yaml:"tag"`
+	Digest string `json:"digest" yaml:"digest"`
+	// PendingSince is when the image was first marked for deletion, as RFC3339
+	PendingSince string `json:"pending_since" yaml:"pending_since"`
+}
+
+// New reports the decisions d of the ruleset at tNow. The images to delete have been through a grace period
+// g: the due images are deleted, and the pending and rescued images are reported as such. Kept images in
+// protectedBy, as returned by rules.ApplyProtections, are reported with the reason of their first protection
+// as their action. The images d skipped are reported as skipped, and every image with its issues.
+func New(ruleset []*rules.Rule, keep []*registry.Manifest, g *grace.Result, d *rules.Decisions, protectedBy map[string][]rules.Protection, tNow time.Time) *Report {
+	keptBy, deletedBy := d.KeptBy, d.DeletedBy
+	r := Report{
+		Now:     tNow.UTC().Format(time.RFC3339),
+		Images:  []*Image{},
+		Repos:   []*Summary{},
+		Rules:   []*Summary{},
+		Groups:  []*Group{},
+		Rescued: []*Rescued{},
+		Pins:    []*pins.Flag{},
+	}
+	pending := []*registry.Manifest{}
+	pendingByRef := map[string]*grace.Pending{}
+	for _, p := range g.Pending {
+		pending = append(pending, p.Manifest)
+		pendingByRef[p.Reference()] = p
+	}
+	ruleSummaries := make([]*Summary, len(ruleset))
+	for i := range ruleset {
+		ruleSummaries[i] = &Summary{Name: rules.RuleName(ruleset, i)}
+	}
+	repoSummaries := map[string]*Summary{}
+
+	for action, manifests := range map[string][]*registry.Manifest{"keep": keep, "delete": g.Due, "pending": pending} {
+		reasons := deletedBy
+		if action == "keep" {
+			reasons = keptBy
+		}
+		for _, m := range manifests {
+			img := newImage(action, m, tNow)
+			if p, ok := pendingByRef[m.Reference()]; ok {
+				img.PendingSince = p.Since.UTC().Format(time.RFC3339)
+				img.DeleteAt = p.DeleteAt.UTC().Format(time.RFC3339)
+			}
+			refReasons := reasons[m.Reference()]
+			if protections := protectedBy[m.Reference()]; action == "keep" && len(protections) > 0 {
+				img.Action = protections[0].Reason
+				for _, p := range protections {
+					img.ProtectedBy = append(img.ProtectedBy, p.Source)
+				}
+				refReasons = deletedBy[m.Reference()]
+				r.Protected++
+			}
+			repo, ok := repoSummaries[m.Name]
+			if !ok {
+				repo = &Summary{Name: m.Name}
+				repoSummaries[m.Name] = repo
+			}
+			summaries := []*Summary{repo}
+			for _, i := range refReasons {
+				img.Rules = append(img.Rules, ruleSummaries[i].Name)
+				summaries = append(summaries, ruleSummaries[i])
+			}
+			for _, s := range summaries {
+				s.count(action, m.Size)
+			}
+			r.count(action, m.Size)
+			r.Images = append(r.Images, img)
+		}
+	}
+
+	sort.Slice(r.Images, func(i, j int) bool { return r.Images[i].less(r.Images[j]) })
+	for _, s := range repoSummaries {
+		r.Repos = append(r.Repos, s)
+	}
+	sort.Slice(r.Repos, func(i, j int) bool { return r.Repos[i].Name < r.Repos[j].Name })
+	r.Rules = append(r.Rules, ruleSummaries...)
+	for _, rec := range g.Rescued {
+		r.Rescued = append(r.Rescued, &Rescued{Repo: rec.Repo, Tag: rec.Tag, Digest: rec.Digest.String(), PendingSince: rec.Since.UTC().Format(time.RFC3339)})
+	}
+	sort.Slice(r.Rescued, func(i, j int) bool {
+		if r.Rescued[i].Repo != r.Rescued[j].Repo {
+			return r.Rescued[i].Repo < r.Rescued[j].Repo
+		}
+		return r.Rescued[i].Tag < r.Rescued[j].Tag
+	})
+	r.addIssues(ruleset, d.Skipped, d.Issues, tNow)
+	r.addGroups(ruleset, d.Groups)
+	return &r
+}
+
+// addIssues reports the issues rules found with the report's images, by Reference, and adds the skipped
+// images, which rules neither kept nor deleted because of their issues, as skipped
+func (r *Report) addIssues(ruleset []*rules.Rule, skipped []*registry.Manifest, issues map[string][]rules.Issue, tNow time.Time) {
+	for _, m := range skipped {
+		img := newImage("skipped", m, tNow)
+		seen := map[int]bool{}
+		for _, issue := range issues[m.Reference()] {
+			if !seen[issue.Rule] {
+				seen[issue.Rule] = true
+				img.Rules = append(img.Rules, rules.RuleName(ruleset, issue.Rule))
+			}
+		}
+		r.count("skipped", m.Size)
+		r.Images = append(r.Images, img)
+	}
+	for _, img := range r.Images {
+		for _, issue := range issues[img.Repo+":"+img.Tag] {
+			img.Issues = append(img.Issues, fmt.Sprintf("%s (%s): %s", issue.Kind, rules.RuleName(ruleset, issue.Rule), issue.Detail))
+		}
+	}
+	sort.Slice(r.Images, func(i, j int) bool { return r.Images[i].less(r.Images[j]) })
+}
+
+// addGroups reports the counts of each group of the grouped rules
+func (r *Report) addGroups(ruleset []*rules.Rule, groups []*rules.GroupCount) {
+	for _, g := range groups {
+		r.Groups = append(r.Groups, &Group{Rule: rules.RuleName(ruleset, g.Rule), Repo: g.Repo, Group: g.Group, Keep: g.Keep, Delete: g.Delete})
+	}
+}
+
+func newImage(action string, m *registry.Manifest, tNow time.Time) *Image {
+	img := Image{
+		Action:       action,
+		Repo:         m.Name,
+		Tag:          m.Tag,
+		Digest:       m.Digest.String(),
+		Size:         m.Size,
+		AgeDays:      int64(tNow.Sub(m.LastModified).Hours() / 24.0),
+		AgeSource:    m.AgeSource,
+		Rules:        []string{},
+		lastModified: m.LastModified,
+		version:      m.Version,
+	}
+	if m.Version != nil {
+		img.Version = m.Version.String()
+	}
+	return &img
+}
+
+// less orders images by action, then repo, then newest version, then most recently modified. Versions of
+// different schemes don't compare, so images are grouped by their version's scheme, unversioned ones last.
+func (i *Image) less(o *Image) bool {
+	if i.Action != o.Action {
+		return i.Action < o.Action
+	}
+	if i.Repo != o.Repo {
+		return i.Repo < o.Repo
+	}
+	if a, b := versionScheme(i.version), versionScheme(o.version); a != b {
+		return b == "" || (a != "" && a < b)
+	}
+	if i.version != nil && o.version != nil {
+		if c := i.version.Compare(o.version); c != 0 {
+			return c > 0
+		}
+	}
+	if !i.lastModified.Equal(o.lastModified) {
+		return i.lastModified.After(o.lastModified)
+	}
+	return i.Tag < o.Tag
+}
+
+// versionScheme tells apart the schemes of versions, by their type. It is empty for no version.
+func versionScheme(v registry.Version) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func (s *Summary) count(action string, size int64) {
+	switch action {
+	case "delete":
+		s.Delete++
+		s.DeleteSize += size
+	case "pending":
+		s.Pending++
+	case "skipped":
+	default:
+		s.Keep++
+	}
+}
+
+func (r *Report) count(action string, size int64) {
+	switch action {
+	case "delete":
+		r.Delete++
+		r.DeleteSize += size
+	case "pending":
+		r.Pending++
+	case "skipped":
+		r.Skipped++
+	default:
+		r.Keep++
+	}
+}
+
+// Write writes the report to w in format, one of Formats. CSV has only the images; sum them for totals.
+// Group counts, rescued images and pins are not in the CSV, as they are not images the rules decided on.
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatTable:
+		return r.writeTable(w)
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case FormatCSV:
+		return r.writeCSV(w)
+	case FormatYAML:
+		d, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(d)
+		return err
+	case FormatMarkdown:
+		return r.writeMarkdown(w)
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// ValidFormat is true if format is one of Formats
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	imageHeader   = []string{"action", "image", "tag", "parsed_version", "age_days", "age_source", "size", "digest", "rules", "delete_at", "protected_by", "issues"}
+	summaryHeader = []string{"keep", "delete", "delete_size", "pending"}
+	groupHeader   = []string{"rule", "repo", "group", "keep", "delete"}
+	rescuedHeader = []string{"rescued", "tag", "digest", "pending_since"}
+	pinHeader     = []string{"pin", "owner", "expires", "problem"}
+)
+
+// row is the image's columns in imageHeader, with its size formatted by size
+func (i *Image) row(size func(int64) string) []string {
+	return []string{i.Action, i.Repo, i.Tag, i.Version, strconv.FormatInt(i.AgeDays, 10), i.AgeSource, size(i.Size), i.Digest, strings.Join(i.Rules, ","), i.DeleteAt, strings.Join(i.ProtectedBy, ","), strings.Join(i.Issues, "; ")}
+}
+
+func (s *Summary) row() []string {
+	return []string{s.Name, strconv.Itoa(s.Keep), strconv.Itoa(s.Delete), humanSize(s.DeleteSize), strconv.Itoa(s.Pending)}
+}
+
+func (g *Group) row() []string {
+	return []string{g.Rule, g.Repo, g.Group, strconv.Itoa(g.Keep), strconv.Itoa(g.Delete)}
+}
+
+func (r *Rescued) row() []string {
+	return []string{r.Repo, r.Tag, r.Digest, r.PendingSince}
+}
+
+func pinRow(f *pins.Flag) []string {
+	return []string{f.Image, f.Owner, f.Expires, f.Problem}
+}
+
+func (r *Report) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(imageHeader, "\t"))
+	for _, img := range r.Images {
+		fmt.Fprintln(tw, strings.Join(img.row(humanSize), "\t"))
+	}
+	fmt.Fprintln(tw)
+	for _, section := range []struct {
+		name      string
+		summaries []*Summary
+	}{{"repo", r.Repos}, {"rule", r.Rules}} {
+		fmt.Fprintln(tw, strings.Join(append([]string{section.name}, summaryHeader...), "\t"))
+		for _, s := range section.summaries {
+			fmt.Fprintln(tw, strings.Join(s.row(), "\t"))
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(r.Groups) > 0 {
+		fmt.Fprintln(tw, strings.Join(groupHeader, "\t"))
+		for _, g := range r.Groups {
+			fmt.Fprintln(tw, strings.Join(g.row(), "\t"))
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(r.Rescued) > 0 {
+		fmt.Fprintln(tw, strings.Join(rescuedHeader, "\t"))
+		for _, rescued := range r.Rescued {
+			fmt.Fprintln(tw, strings.Join(rescued.row(), "\t"))
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(r.Pins) > 0 {
+		fmt.Fprintln(tw, strings.Join(pinHeader, "\t"))
+		for _, f := range r.Pins {
+			fmt.Fprintln(tw, strings.Join(pinRow(f), "\t"))
+		}
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintf(tw, "deleting %d images (%s), keeping %d images (%d protected), %d pending deletion, %d skipped\n", r.Delete, humanSize(r.DeleteSize), r.Keep, r.Protected, r.Pending, r.Skipped)
+	return tw.Flush()
+}
+
+func (r *Report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(imageHeader)
+	for _, img := range r.Images {
+		cw.Write(img.row(func(size int64) string { return strconv.FormatInt(size, 10) }))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Image report as of %s\n\n", r.Now)
+	fmt.Fprintf(&b, "Deleting %d images (%s), keeping %d images (%d protected), %d pending deletion, %d skipped.\n\n", r.Delete, humanSize(r.DeleteSize), r.Keep, r.Protected, r.Pending, r.Skipped)
+	b.WriteString("### Repos\n\n")
+	writeMarkdownTable(&b, append([]string{"repo"}, summaryHeader...), summaryRows(r.Repos))
+	b.WriteString("### Rules\n\n")
+	writeMarkdownTable(&b, append([]string{"rule"}, summaryHeader...), summaryRows(r.Rules))
+	rows := [][]string{}
+	if len(r.Groups) > 0 {
+		b.WriteString("### Groups\n\n")
+		for _, g := range r.Groups {
+			rows = append(rows, g.row())
+		}
+		writeMarkdownTable(&b, groupHeader, rows)
+	}
+	b.WriteString("### Images\n\n")
+	rows = [][]string{}
+	for _, img := range r.Images {
+		rows = append(rows, img.row(humanSize))
+	}
+	writeMarkdownTable(&b, imageHeader, rows)
+	if len(r.Rescued) > 0 {
+		b.WriteString("### Rescued\n\n")
+		rows = [][]string{}
+		for _, rescued := range r.Rescued {
+			rows = append(rows, rescued.row())
+		}
+		writeMarkdownTable(&b, append([]string{"repo"}, rescuedHeader[1:]...), rows)
+	}
+	if len(r.Pins) > 0 {
+		b.WriteString("### Pins\n\n")
+		rows = [][]string{}
+		for _, f := range r.Pins {
+			rows = append(rows, pinRow(f))
+		}
+		writeMarkdownTable(&b, pinHeader, rows)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func summaryRows(summaries []*Summary) [][]string {
+	rows := [][]string{}
+	for _, s := range summaries {
+		rows = append(rows, s.row())
+	}
+	return rows
+}
+
+func writeMarkdownTable(b *strings.Builder, header []string, rows [][]string) {
+	b.WriteString("| " + strings.Join(header, " | ") + " |\n")
+	b.WriteString(strings.Repeat("| --- ", len(header)) + "|\n")
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, c := range row {
+			cells[i] = strings.ReplaceAll(c, "|", `\|`)
+		}
+		b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+	b.WriteString("\n")
+}
+
+// humanSize formats a size in bytes for people, i.e. 1.5 GiB. Unknown sizes are -
+func humanSize(size int64) string {
+	if size <= 0 {
+		return "-"
+	}
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
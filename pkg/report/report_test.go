@@ -0,0 +1,349 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/grace"
+	"github.com/tumblr/docker-registry-pruner/pkg/pins"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"github.com/tumblr/docker-registry-pruner/pkg/rules"
+	"github.com/tumblr/docker-registry-pruner/pkg/state"
+	"gopkg.in/yaml.v2"
+)
+
+var tNow = time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+
+func mkreport() *Report {
+	manifests := []*registry.Manifest{}
+	for i, tag := range []string{"v1.2.0", "v1.0.0", "v1.10.0", "v1.1.0"} {
+		m, _ := registry.NewManifest("tumblr/fleeble", tag, tNow.Add(-time.Duration(i+1)*24*time.Hour), map[string]string{})
+		m.Size = 1024
+		manifests = append(manifests, m)
+	}
+	plumbus, _ := registry.NewManifest("tumblr/plumbus", "latest", tNow, map[string]string{})
+	manifests = append(manifests, plumbus)
+
+	ruleset := []*rules.Rule{
+		{Name: "fleeble-releases", Selector: rules.Selector{Repos: []string{"tumblr/fleeble"}, Labels: map[string]string{}}, KeepVersions: 2},
+		{Selector: rules.Selector{Repos: []string{"tumblr/plumbus"}, Labels: map[string]string{}}, KeepMostRecent: 1},
+	}
+	keep, delete, d := rules.ApplyRulesWithDecisions(ruleset, manifests, rules.FixedClock(tNow))
+	return New(ruleset, keep, &grace.Result{Due: delete}, d, nil, tNow)
+}
+
+func TestReportOrderAndSummaries(t *testing.T) {
+	r := mkreport()
+	order := []string{}
+	for _, img := range r.Images {
+		order = append(order, img.Action+" "+img.Repo+":"+img.Tag+" "+strings.Join(img.Rules, ","))
+	}
+	expected := []string{
+		"delete tumblr/fleeble:v1.1.0 fleeble-releases",
+		"delete tumblr/fleeble:v1.0.0 fleeble-releases",
+		"keep tumblr/fleeble:v1.10.0 fleeble-releases",
+		"keep tumblr/fleeble:v1.2.0 fleeble-releases",
+		"keep tumblr/plumbus:latest rule 1",
+	}
+	if !reflect.DeepEqual(expected, order) {
+		t.Errorf("expected images in order %v, got %v", expected, order)
+	}
+
+	if r.Keep != 3 || r.Delete != 2 || r.DeleteSize != 2048 {
+		t.Errorf("expected to keep 3 and delete 2 images of 2048 bytes, got %d, %d and %d bytes", r.Keep, r.Delete, r.DeleteSize)
+	}
+	expectedRepos := []*Summary{
+		{Name: "tumblr/fleeble", Keep: 2, Delete: 2, DeleteSize: 2048},
+		{Name: "tumblr/plumbus", Keep: 1},
+	}
+	if !reflect.DeepEqual(expectedRepos, r.Repos) {
+		t.Errorf("expected repo summaries %+v, got %+v", expectedRepos, r.Repos)
+	}
+	expectedRules := []*Summary{
+		{Name: "fleeble-releases", Keep: 2, Delete: 2, DeleteSize: 2048},
+		{Name: "rule 1", Keep: 1},
+	}
+	if !reflect.DeepEqual(expectedRules, r.Rules) {
+		t.Errorf("expected rule summaries %+v, got %+v", expectedRules, r.Rules)
+	}
+}
+
+// TestImageOrderAcrossSchemes sorts images whose versions come from different schemes the same way,
+// whatever order they are in
+func TestImageOrderAcrossSchemes(t *testing.T) {
+	images := []*Image{}
+	for _, v := range []struct {
+		tag    string
+		scheme registry.VersionScheme
+	}{
+		{"v1.0.0", registry.SemverScheme{}},
+		{"2024.01.02", registry.CalverScheme{}},
+		{"v2.0.0", registry.SemverScheme{}},
+		{"abc123f", nil},
+		{"2023.05.06", registry.CalverScheme{}},
+	} {
+		m, _ := registry.NewManifest("tumblr/fleeble", v.tag, tNow, map[string]string{})
+		m.Version = nil
+		if v.scheme != nil {
+			m.Version, _ = registry.ParseVersion(v.tag, nil, v.scheme)
+		}
+		images = append(images, newImage("keep", m, tNow))
+	}
+	var expected []string
+	for _, perm := range [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}, {1, 3, 0, 4, 2}, {3, 0, 4, 2, 1}} {
+		sorted := []*Image{}
+		for _, i := range perm {
+			sorted = append(sorted, images[i])
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].less(sorted[j]) })
+		tags := []string{}
+		for _, img := range sorted {
+			tags = append(tags, img.Tag)
+		}
+		if expected == nil {
+			expected = tags
+		}
+		if !reflect.DeepEqual(expected, tags) {
+			t.Errorf("expected images in order %v whatever their order, got %v", expected, tags)
+		}
+	}
+	if expected[len(expected)-1] != "abc123f" {
+		t.Errorf("expected the unversioned image last, got %v", expected)
+	}
+}
+
+func TestReportFormats(t *testing.T) {
+	r := mkreport()
+	for _, format := range Formats {
+		var b bytes.Buffer
+		if err := r.Write(&b, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		switch format {
+		case FormatJSON, FormatYAML:
+			parsed := Report{}
+			var err error
+			if format == FormatJSON {
+				err = json.Unmarshal(b.Bytes(), &parsed)
+			} else {
+				err = yaml.Unmarshal(b.Bytes(), &parsed)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if len(parsed.Images) != 5 || len(parsed.Repos) != 2 || len(parsed.Rules) != 2 || parsed.Images[0].Tag != "v1.1.0" {
+				t.Errorf("%s: report did not round trip: %s", format, b.String())
+			}
+		case FormatCSV:
+			records, err := csv.NewReader(&b).ReadAll()
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if len(records) != 6 || !reflect.DeepEqual(records[0], imageHeader) || records[1][6] != "1024" {
+				t.Errorf("%s: unexpected records %v", format, records)
+			}
+		case FormatTable, FormatMarkdown:
+			for _, s := range []string{"fleeble-releases", "tumblr/plumbus", "deleting 2 images (2.0 KiB), keeping 3 images"} {
+				if !strings.Contains(strings.ToLower(b.String()), strings.ToLower(s)) {
+					t.Errorf("%s: expected report to contain %q: %s", format, s, b.String())
+				}
+			}
+		}
+	}
+
+	if err := r.Write(&bytes.Buffer{}, "xml"); err != ErrUnknownFormat {
+		t.Errorf("expected %v writing an unknown format, got %v", ErrUnknownFormat, err)
+	}
+}
+
+func TestReportPendingRescuedAndProtected(t *testing.T) {
+	old, _ := registry.NewManifest("tumblr/fleeble", "v1.0.0", tNow.Add(-48*time.Hour), map[string]string{})
+	older, _ := registry.NewManifest("tumblr/fleeble", "v0.9.0", tNow.Add(-72*time.Hour), map[string]string{})
+	ruleset := []*rules.Rule{
+		{Name: "fleeble-releases", Selector: rules.Selector{Repos: []string{"tumblr/fleeble"}, Labels: map[string]string{}}, KeepVersions: 1},
+	}
+	since := tNow.Add(-24 * time.Hour)
+	g := &grace.Result{
+		Due:     []*registry.Manifest{older},
+		Pending: []*grace.Pending{{Manifest: old, Since: since, DeleteAt: since.Add(7 * 24 * time.Hour)}},
+		Rescued: []*state.PendingRecord{{Repo: "tumblr/fleeble", Tag: "v0.1.0", Digest: "sha256:aaaa", Since: since}},
+	}
+	inUse, _ := registry.NewManifest("tumblr/fleeble", "v0.8.0", tNow.Add(-96*time.Hour), map[string]string{})
+	deletedBy := map[string][]int{old.Reference(): {0}, older.Reference(): {0}, inUse.Reference(): {0}}
+	protectedBy := map[string][]rules.Protection{inUse.Reference(): {{Reason: "protected-in-use", Source: "prod/web/Deployment/fleeble"}}}
+	r := New(ruleset, []*registry.Manifest{inUse}, g, &rules.Decisions{KeptBy: map[string][]int{}, DeletedBy: deletedBy}, protectedBy, tNow)
+
+	if r.Delete != 1 || r.Pending != 1 || r.Rules[0].Pending != 1 || r.Repos[0].Pending != 1 {
+		t.Errorf("expected 1 image deleted and 1 pending, got %+v", r)
+	}
+	pending := r.Images[len(r.Images)-2]
+	if pending.Action != "pending" || pending.DeleteAt != "2026-06-21T12:00:00Z" || pending.PendingSince != "2026-06-14T12:00:00Z" {
+		t.Errorf("expected v1.0.0 pending deletion at 2026-06-21T12:00:00Z, got %+v", pending)
+	}
+	if len(r.Rescued) != 1 || r.Rescued[0].Tag != "v0.1.0" {
+		t.Errorf("expected v0.1.0 rescued, got %+v", r.Rescued)
+	}
+	protected := r.Images[len(r.Images)-1]
+	if r.Keep != 1 || r.Protected != 1 || protected.Action != "protected-in-use" || protected.Rules[0] != "fleeble-releases" || protected.ProtectedBy[0] != "prod/web/Deployment/fleeble" {
+		t.Errorf("expected v0.8.0 kept as protected-in-use, that fleeble-releases would have deleted, got %+v", protected)
+	}
+	var b bytes.Buffer
+	r.Write(&b, FormatTable)
+	for _, s := range []string{"2026-06-21T12:00:00Z", "v0.1.0", "1 pending deletion", "(1 protected)", "prod/web/Deployment/fleeble"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected table to contain %q: %s", s, b.String())
+		}
+	}
+}
+
+func TestReportIssues(t *testing.T) {
+	manifests := []*registry.Manifest{}
+	for i, tag := range []string{"donut-2.4.0-production", "donut-2.3.9-production", "donut-1.0.0-staging"} {
+		m, _ := registry.NewManifest("tumblr/donut", tag, tNow.Add(-time.Duration(i+1)*24*time.Hour), map[string]string{})
+		manifests = append(manifests, m)
+	}
+	ruleset := []*rules.Rule{
+		{Name: "donut-releases", Selector: rules.Selector{Repos: []string{"tumblr/donut"}, Labels: map[string]string{}}, KeepVersions: 1, VersionRegex: regexp.MustCompile(`^donut-(?P<version>\d+\.\d+\.\d+)-production$`)},
+	}
+	keep, delete, d := rules.ApplyRulesWithDecisions(ruleset, manifests, rules.FixedClock(tNow))
+	r := New(ruleset, keep, &grace.Result{Due: delete}, d, nil, tNow)
+
+	skipped := r.Images[len(r.Images)-1]
+	if r.Keep != 1 || r.Delete != 1 || r.Skipped != 1 || skipped.Action != "skipped" || skipped.Tag != "donut-1.0.0-staging" || skipped.Rules[0] != "donut-releases" {
+		t.Errorf("expected donut-1.0.0-staging skipped by donut-releases, got %+v", r)
+	}
+	if len(skipped.Issues) != 1 || !strings.HasPrefix(skipped.Issues[0], "unparsed-version (donut-releases): ") {
+		t.Errorf("expected an unparsed-version issue for donut-1.0.0-staging, got %v", skipped.Issues)
+	}
+
+	for _, format := range Formats {
+		var b bytes.Buffer
+		if err := r.Write(&b, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		for _, s := range []string{"skipped", "donut-1.0.0-staging", "unparsed-version (donut-releases)"} {
+			if !strings.Contains(b.String(), s) {
+				t.Errorf("%s: expected report to contain %q: %s", format, s, b.String())
+			}
+		}
+	}
+	var b bytes.Buffer
+	r.Write(&b, FormatTable)
+	if !strings.Contains(b.String(), "1 skipped") {
+		t.Errorf("expected the summary to count 1 skipped: %s", b.String())
+	}
+	b.Reset()
+	if err := r.Explain(&b, "tumblr/donut", "donut-1.0.0-staging"); err != nil || !strings.Contains(strings.Join(strings.Fields(b.String()), " "), "skipped by: donut-releases") {
+		t.Errorf("expected explain to show donut-1.0.0-staging skipped by donut-releases, got %v: %s", err, b.String())
+	}
+}
+
+func TestReportGroups(t *testing.T) {
+	manifests := []*registry.Manifest{}
+	for i, tag := range []string{"master-aaaaaa1", "master-aaaaaa2", "master-aaaaaa3", "feat-x-bbbbbb1"} {
+		m, _ := registry.NewManifest("tumblr/branches", tag, tNow.Add(-time.Duration(i+1)*24*time.Hour), map[string]string{})
+		manifests = append(manifests, m)
+	}
+	ruleset := []*rules.Rule{
+		{Name: "branches", Selector: rules.Selector{Repos: []string{"tumblr/branches"}, Labels: map[string]string{}}, KeepMostRecent: 2, GroupByTag: regexp.MustCompile(`^(?P<group>[a-z0-9-]+)-[0-9a-f]{7}$`)},
+	}
+	keep, delete, d := rules.ApplyRulesWithDecisions(ruleset, manifests, rules.FixedClock(tNow))
+	r := New(ruleset, keep, &grace.Result{Due: delete}, d, nil, tNow)
+
+	expected := []*Group{
+		{Rule: "branches", Repo: "tumblr/branches", Group: "feat-x", Keep: 1},
+		{Rule: "branches", Repo: "tumblr/branches", Group: "master", Keep: 2, Delete: 1},
+	}
+	if !reflect.DeepEqual(expected, r.Groups) {
+		t.Errorf("expected group counts %+v, got %+v", expected, r.Groups)
+	}
+	for _, format := range []string{FormatTable, FormatMarkdown} {
+		var b bytes.Buffer
+		if err := r.Write(&b, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if row := strings.Join(strings.Fields(strings.ReplaceAll(b.String(), "|", "")), " "); !strings.Contains(row, "branches tumblr/branches master 2 1") {
+			t.Errorf("%s: expected report to contain the counts of the master group: %s", format, b.String())
+		}
+	}
+	var b bytes.Buffer
+	r.Write(&b, FormatJSON)
+	parsed := Report{}
+	if err := json.Unmarshal(b.Bytes(), &parsed); err != nil || !reflect.DeepEqual(expected, parsed.Groups) {
+		t.Errorf("expected group counts to round trip through json, got %v: %s", err, b.String())
+	}
+}
+
+func TestReportPins(t *testing.T) {
+	r := New([]*rules.Rule{}, []*registry.Manifest{}, &grace.Result{}, &rules.Decisions{}, nil, tNow)
+	var b bytes.Buffer
+	r.Write(&b, FormatTable)
+	if strings.Contains(b.String(), "problem") {
+		t.Errorf("expected no pins in the table when no pins need attention: %s", b.String())
+	}
+
+	r.Pins = []*pins.Flag{
+		{Image: "tumblr/fleeble:v1.2.3", Owner: "fleeble-team", Expires: "2026-06-01", Problem: pins.ProblemExpired},
+		{Image: "tumblr/gone:*", Owner: "plumbus-team", Problem: pins.ProblemUnmatched},
+	}
+	for _, format := range []string{FormatTable, FormatMarkdown} {
+		b.Reset()
+		r.Write(&b, format)
+		for _, s := range []string{"tumblr/fleeble:v1.2.3", "fleeble-team", "2026-06-01", "expired", "tumblr/gone:*", "matches nothing"} {
+			if !strings.Contains(b.String(), s) {
+				t.Errorf("expected %s to contain %q: %s", format, s, b.String())
+			}
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	kept, _ := registry.NewManifest("tumblr/fleeble", "v1.1.0", tNow.Add(-24*time.Hour), map[string]string{})
+	protected, _ := registry.NewManifest("tumblr/fleeble", "v1.0.0", tNow.Add(-48*time.Hour), map[string]string{})
+	deleted, _ := registry.NewManifest("tumblr/fleeble", "v0.9.0", tNow.Add(-72*time.Hour), map[string]string{})
+	ruleset := []*rules.Rule{
+		{Name: "fleeble-releases", Selector: rules.Selector{Repos: []string{"tumblr/fleeble"}, Labels: map[string]string{}}, KeepVersions: 1},
+	}
+	keptBy := map[string][]int{kept.Reference(): {0}}
+	deletedBy := map[string][]int{protected.Reference(): {0}, deleted.Reference(): {0}}
+	protectedBy := map[string][]rules.Protection{protected.Reference(): {
+		{Reason: "protected-referenced", Source: "deploy/web/values.yaml:4"},
+		{Reason: "protected-in-use", Source: "prod/web/Deployment/fleeble"},
+	}}
+	r := New(ruleset, []*registry.Manifest{kept, protected}, &grace.Result{Due: []*registry.Manifest{deleted}}, &rules.Decisions{KeptBy: keptBy, DeletedBy: deletedBy}, protectedBy, tNow)
+
+	var b bytes.Buffer
+	if err := r.Explain(&b, "tumblr/fleeble", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"tumblr/fleeble:v1.0.0", "protected-referenced", "would be deleted by: fleeble-releases", "protected by:        deploy/web/values.yaml:4", "prod/web/Deployment/fleeble"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected explanation to contain %q: %s", s, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "v1.1.0") {
+		t.Errorf("expected only v1.0.0 to be explained: %s", b.String())
+	}
+
+	b.Reset()
+	if err := r.Explain(&b, "tumblr/fleeble", ""); err != nil {
+		t.Fatal(err)
+	}
+	// columns are aligned within each image
+	words := strings.Join(strings.Fields(b.String()), " ")
+	for _, s := range []string{"kept by: fleeble-releases", "deleted by: fleeble-releases"} {
+		if !strings.Contains(words, s) {
+			t.Errorf("expected explanation to contain %q: %s", s, b.String())
+		}
+	}
+	if err := r.Explain(&b, "tumblr/plumbus", ""); err != ErrNothingToExplain {
+		t.Errorf("expected %v, got %v", ErrNothingToExplain, err)
+	}
+}
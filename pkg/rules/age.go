@@ -0,0 +1,133 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var (
+	// AgeSourceTagRegexGroup is the name of the capture group an age_source tag regex uses to extract the timestamp from a tag
+	AgeSourceTagRegexGroup = "timestamp"
+	// AgeSourceUnixFormat is the tag format for timestamps in unix seconds
+	AgeSourceUnixFormat = "unix"
+
+	// ErrUnknownAgeSource
+	ErrUnknownAgeSource = fmt.Errorf("age_source must be one of %s, %s, %s, %s or %s", registry.AgeSourceHistory, registry.AgeSourceCreated, registry.AgeSourceLabel, registry.AgeSourceTag, registry.AgeSourceFirstSeen)
+	// ErrAgeSourceMissingLabel is returned when a label age_source does not name the label
+	ErrAgeSourceMissingLabel = fmt.Errorf("age_source label requires the label to read the timestamp from")
+	// ErrAgeSourceTagRegexMissingGroup is returned when a tag age_source regex does not have a named capture group for the timestamp
+	ErrAgeSourceTagRegexMissingGroup = fmt.Errorf("age_source tag_regex must contain a (?P<%s>...) capture group", AgeSourceTagRegexGroup)
+)
+
+// AgeSource is where a rule takes the age of an image from, instead of the newest created time in its history.
+// A rebuilt base image can look older than it is by history, even though it was pushed yesterday.
+type AgeSource struct {
+	// Source is one of the registry.AgeSource* constants
+	Source string
+	// Label holds an RFC3339 timestamp, for the label source
+	Label string
+	// TagRegex extracts the timestamp from the tag via the named capture group AgeSourceTagRegexGroup, for the tag source
+	TagRegex *regexp.Regexp
+	// TagFormat is the time layout of the timestamp in the tag, or AgeSourceUnixFormat for unix seconds
+	TagFormat string
+}
+
+// String returns a useful string description of this AgeSource
+func (s *AgeSource) String() string {
+	switch s.Source {
+	case registry.AgeSourceLabel:
+		return fmt.Sprintf("label %s", s.Label)
+	case registry.AgeSourceTag:
+		return fmt.Sprintf("tag %s as %s", s.TagRegex.String(), s.TagFormat)
+	default:
+		return s.Source
+	}
+}
+
+// Validate checks this AgeSource is complete
+func (s *AgeSource) Validate() error {
+	switch s.Source {
+	case registry.AgeSourceHistory, registry.AgeSourceCreated, registry.AgeSourceFirstSeen:
+		return nil
+	case registry.AgeSourceLabel:
+		if s.Label == "" {
+			return ErrAgeSourceMissingLabel
+		}
+		return nil
+	case registry.AgeSourceTag:
+		if s.TagRegex == nil || s.TagRegex.SubexpIndex(AgeSourceTagRegexGroup) < 0 {
+			return ErrAgeSourceTagRegexMissingGroup
+		}
+		return nil
+	default:
+		return ErrUnknownAgeSource
+	}
+}
+
+// Timestamp returns the time the manifest was last modified according to this source.
+// It is false if the manifest does not have it.
+func (s *AgeSource) Timestamp(m *registry.Manifest) (time.Time, bool) {
+	switch s.Source {
+	case registry.AgeSourceHistory:
+		return m.LastModified, true
+	case registry.AgeSourceCreated:
+		return m.Created, !m.Created.IsZero()
+	case registry.AgeSourceFirstSeen:
+		return m.FirstSeen, !m.FirstSeen.IsZero()
+	case registry.AgeSourceLabel:
+		v, ok := m.Labels[s.Label]
+		if !ok {
+			return time.Time{}, false
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			log.Warnw("malformed timestamp label", "repo", m.Name, "tag", m.Tag, "label", s.Label, "value", v, "error", err)
+			return time.Time{}, false
+		}
+		return t, true
+	case registry.AgeSourceTag:
+		match := s.TagRegex.FindStringSubmatch(m.Tag)
+		if match == nil {
+			return time.Time{}, false
+		}
+		v := match[s.TagRegex.SubexpIndex(AgeSourceTagRegexGroup)]
+		t, err := parseTagTimestamp(v, s.TagFormat)
+		if err != nil {
+			log.Warnw("malformed timestamp in tag", "repo", m.Name, "tag", m.Tag, "format", s.TagFormat, "error", err)
+			return time.Time{}, false
+		}
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Apply returns copies of the manifests with LastModified taken from this source. Manifests
+// without a timestamp from this source are reported and left out, so the rule leaves them alone.
+func (s *AgeSource) Apply(manifests []*registry.Manifest) []*registry.Manifest {
+	res := []*registry.Manifest{}
+	for _, m := range manifests {
+		t, ok := s.Timestamp(m)
+		if !ok {
+			log.Warnw("image has no timestamp from age source, skipping", "repo", m.Name, "tag", m.Tag, "age_source", s.String())
+			continue
+		}
+		res = append(res, m.WithLastModified(t, s.Source))
+	}
+	return res
+}
+
+func parseTagTimestamp(v string, format string) (time.Time, error) {
+	if format == "" || format == AgeSourceUnixFormat {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(format, v)
+}
@@ -0,0 +1,27 @@
+package rules
+
+import (
+	"time"
+)
+
+// Clock tells the time rules are evaluated at. Ages, expiries and schedules are all relative to it.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the wall clock
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FixedClock is always the same time. It is used to evaluate rules as of a time in the past or future, and in tests.
+type FixedClock time.Time
+
+// Now returns the fixed time
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
@@ -0,0 +1,93 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var (
+	// ErrExprMustBeBool is returned when an expr selector does not evaluate to a bool
+	ErrExprMustBeBool = fmt.Errorf("expr must evaluate to a bool")
+
+	exprEnv *cel.Env
+)
+
+func init() {
+	var err error
+	exprEnv, err = cel.NewEnv(
+		cel.Variable("repo", cel.StringType),
+		cel.Variable("tag", cel.StringType),
+		cel.Variable("version", cel.StringType),
+		cel.Variable("age_days", cel.IntType),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("digest", cel.StringType),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Expression is a compiled and type checked CEL expression (https://github.com/google/cel-spec)
+// that selects manifests. The expression can refer to repo, tag, version, age_days, labels and digest.
+type Expression struct {
+	// Source is the expression as written in the config
+	Source string
+	// VersionRegex and VersionScheme parse the tag into version, as the rule's keep_versions does.
+	// version is empty if the tag does not parse.
+	VersionRegex  *regexp.Regexp
+	VersionScheme registry.VersionScheme
+	program       cel.Program
+}
+
+// CompileExpression parses and type checks a CEL expression, which must evaluate to a bool
+func CompileExpression(src string) (*Expression, error) {
+	ast, iss := exprEnv.Compile(src)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, ErrExprMustBeBool
+	}
+	program, err := exprEnv.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{Source: src, program: program}, nil
+}
+
+// String returns the source of this Expression
+func (e *Expression) String() string {
+	return e.Source
+}
+
+// Match evaluates the expression against a manifest. An expression that fails to evaluate,
+// i.e. by looking up a label the manifest does not have, does not match.
+func (e *Expression) Match(m *registry.Manifest) bool {
+	return e.MatchAt(m, time.Now())
+}
+
+// MatchAt is Match, with age_days as of tNow
+func (e *Expression) MatchAt(m *registry.Manifest, tNow time.Time) bool {
+	version := ""
+	if v, err := registry.ParseVersion(m.Tag, e.VersionRegex, e.VersionScheme); err == nil {
+		version = v.String()
+	}
+	out, _, err := e.program.Eval(map[string]interface{}{
+		"repo":     m.Name,
+		"tag":      m.Tag,
+		"version":  version,
+		"age_days": int64(tNow.Sub(m.LastModified).Hours() / 24.0),
+		"labels":   m.Labels,
+		"digest":   m.Digest.String(),
+	})
+	if err != nil {
+		log.Debugw("expr did not evaluate, not matching", "repo", m.Name, "tag", m.Tag, "expr", e.Source, "error", err)
+		return false
+	}
+	match, ok := out.Value().(bool)
+	return ok && match
+}
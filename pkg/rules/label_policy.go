@@ -0,0 +1,172 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var (
+	// DefaultKeepDaysLabel is the label an image uses to declare how many days it should be kept
+	DefaultKeepDaysLabel = "com.tumblr.prune.keep-days"
+	// DefaultExpiresAtLabel is the label an image uses to declare the date after which it may be deleted. An
+	// image expiring on a date is kept through the end of that day (UTC), as a pin expiring on a date is
+	DefaultExpiresAtLabel = "com.tumblr.prune.expires-at"
+	// ExpiresAtFormats are the accepted formats of an expires-at label
+	ExpiresAtFormats = []string{"2006-01-02", time.RFC3339}
+
+	// ErrLabelPolicyDaysMustBePositive
+	ErrLabelPolicyDaysMustBePositive = fmt.Errorf("label_policy default_keep_days, min_keep_days and max_keep_days must be positive")
+	// ErrLabelPolicyMinExceedsMax
+	ErrLabelPolicyMinExceedsMax = fmt.Errorf("label_policy min_keep_days must not be greater than max_keep_days")
+	// ErrMalformedKeepDaysLabel is returned when an image's keep-days label is not a non-negative integer
+	ErrMalformedKeepDaysLabel = fmt.Errorf("keep-days label must be a non-negative integer")
+	// ErrMalformedExpiresAtLabel is returned when an image's expires-at label is not a date
+	ErrMalformedExpiresAtLabel = fmt.Errorf("expires-at label must be a date formatted as YYYY-MM-DD or RFC3339")
+)
+
+// LabelPolicy is an action that lets each image declare its own retention with labels,
+// within bounds set by the central config.
+type LabelPolicy struct {
+	// KeepDaysLabel is the label holding how many days to keep the image, by last modified
+	KeepDaysLabel string `yaml:"keep_days_label"`
+	// ExpiresAtLabel is the label holding the date after which the image may be deleted
+	ExpiresAtLabel string `yaml:"expires_at_label"`
+	// DefaultKeepDays applies to images without valid retention labels. If 0, those images are left alone.
+	DefaultKeepDays int `yaml:"default_keep_days"`
+	// MinKeepDays is the least number of days an image is kept, no matter what its labels say
+	MinKeepDays int `yaml:"min_keep_days"`
+	// MaxKeepDays caps how many days an image can ask to be kept. If 0, there is no cap.
+	MaxKeepDays int `yaml:"max_keep_days"`
+}
+
+// String returns a useful string description of this LabelPolicy
+func (p *LabelPolicy) String() string {
+	s := fmt.Sprintf("keep per labels %s or %s", p.KeepDaysLabel, p.ExpiresAtLabel)
+	if p.DefaultKeepDays != 0 {
+		s = fmt.Sprintf("%s, default %d days", s, p.DefaultKeepDays)
+	}
+	if p.MinKeepDays != 0 {
+		s = fmt.Sprintf("%s, min %d days", s, p.MinKeepDays)
+	}
+	if p.MaxKeepDays != 0 {
+		s = fmt.Sprintf("%s, max %d days", s, p.MaxKeepDays)
+	}
+	return s
+}
+
+// Validate checks the bounds of this LabelPolicy make sense
+func (p *LabelPolicy) Validate() error {
+	switch {
+	case p.DefaultKeepDays < 0 || p.MinKeepDays < 0 || p.MaxKeepDays < 0:
+		return ErrLabelPolicyDaysMustBePositive
+	case p.MaxKeepDays > 0 && p.MinKeepDays > p.MaxKeepDays:
+		return ErrLabelPolicyMinExceedsMax
+	default:
+		return nil
+	}
+}
+
+// Apply decides which images to keep or delete based on their labels. Images with malformed labels
+// are reported, and treated as if they had no labels.
+func (p *LabelPolicy) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	for _, manifest := range manifests {
+		expiry, ok := p.expiry(manifest)
+		if !ok {
+			log.Debugw("image has no retention labels and there is no default, skipping", "repo", manifest.Name, "tag", manifest.Tag)
+			continue
+		}
+		if tNow.After(expiry) {
+			delete = append(delete, manifest)
+		} else {
+			keep = append(keep, manifest)
+		}
+	}
+	return
+}
+
+// expiry returns when the image may be deleted, bounded by MinKeepDays and MaxKeepDays.
+// If both labels are present, the later expiry wins.
+func (p *LabelPolicy) expiry(m *registry.Manifest) (time.Time, bool) {
+	var expiry time.Time
+	found := false
+	if v, ok := m.Labels[p.KeepDaysLabel]; ok {
+		days, err := parseKeepDays(v)
+		if err != nil {
+			log.Warnw("malformed retention label", "repo", m.Name, "tag", m.Tag, "label", p.KeepDaysLabel, "value", v, "error", err)
+		} else {
+			expiry = addDays(m.LastModified, days)
+			found = true
+		}
+	}
+	if v, ok := m.Labels[p.ExpiresAtLabel]; ok {
+		t, err := parseExpiresAt(v)
+		if err != nil {
+			log.Warnw("malformed retention label", "repo", m.Name, "tag", m.Tag, "label", p.ExpiresAtLabel, "value", v, "error", err)
+		} else {
+			if !found || t.After(expiry) {
+				expiry = t
+			}
+			found = true
+		}
+	}
+	if !found {
+		if p.DefaultKeepDays == 0 {
+			return expiry, false
+		}
+		expiry = addDays(m.LastModified, p.DefaultKeepDays)
+	}
+
+	if min := addDays(m.LastModified, p.MinKeepDays); expiry.Before(min) {
+		expiry = min
+	}
+	if max := addDays(m.LastModified, p.MaxKeepDays); p.MaxKeepDays > 0 && expiry.After(max) {
+		expiry = max
+	}
+	return expiry, true
+}
+
+// Issues are the manifests with malformed retention labels, which Apply treats as if they had no labels
+func (p *LabelPolicy) Issues(manifests []*registry.Manifest) map[string][]Issue {
+	issues := map[string][]Issue{}
+	for _, m := range manifests {
+		if v, ok := m.Labels[p.KeepDaysLabel]; ok {
+			if _, err := parseKeepDays(v); err != nil {
+				issues[m.Reference()] = append(issues[m.Reference()], Issue{Kind: IssueMalformedLabel, Detail: fmt.Sprintf("%s=%s: %s", p.KeepDaysLabel, v, err)})
+			}
+		}
+		if v, ok := m.Labels[p.ExpiresAtLabel]; ok {
+			if _, err := parseExpiresAt(v); err != nil {
+				issues[m.Reference()] = append(issues[m.Reference()], Issue{Kind: IssueMalformedLabel, Detail: fmt.Sprintf("%s=%s: %s", p.ExpiresAtLabel, v, err)})
+			}
+		}
+	}
+	return issues
+}
+
+func parseKeepDays(v string) (int, error) {
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 0 {
+		return 0, ErrMalformedKeepDaysLabel
+	}
+	return days, nil
+}
+
+// parseExpiresAt returns when an image expiring at v may be deleted. A date means the end of that day.
+func parseExpiresAt(v string) (time.Time, error) {
+	if t, err := time.Parse(ExpiresAtFormats[0], v); err == nil {
+		return t.Add(24 * time.Hour), nil
+	}
+	for _, f := range ExpiresAtFormats[1:] {
+		if t, err := time.Parse(f, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrMalformedExpiresAtLabel
+}
+
+func addDays(t time.Time, days int) time.Time {
+	return t.Add(time.Duration(days) * 24 * time.Hour)
+}
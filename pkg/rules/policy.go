@@ -0,0 +1,248 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var (
+	// ErrUnknownMatcher is returned when a config refers to a Matcher that was not registered
+	ErrUnknownMatcher = fmt.Errorf("unknown matcher")
+	// ErrUnknownPolicy is returned when a config refers to a RetentionPolicy that was not registered
+	ErrUnknownPolicy = fmt.Errorf("unknown policy")
+
+	pluginsMu sync.RWMutex
+	matchers  = map[string]MatcherFactory{}
+	policies  = map[string]PolicyFactory{}
+)
+
+// Matcher selects the manifests a Rule applies to. A Rule only applies to manifests
+// matched by its Selector and all of its Matchers.
+type Matcher interface {
+	Match(m *registry.Manifest) bool
+}
+
+// RetentionPolicy decides which of the manifests selected by a Rule to keep, and which to delete.
+// It is called with the manifests of a single repo (or group, when the Rule is grouped) at a time.
+// Manifests that are neither kept nor deleted are left alone.
+type RetentionPolicy interface {
+	Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest)
+}
+
+// The kinds of Issue
+const (
+	// IssueUnparsedVersion is a tag no version could be parsed from
+	IssueUnparsedVersion = "unparsed-version"
+	// IssueMalformedLabel is an image retention label that does not parse
+	IssueMalformedLabel = "malformed-label"
+	// IssueScriptFailed is a script that failed on the images it was given, so it neither kept nor deleted them
+	IssueScriptFailed = "script-failed"
+)
+
+// Issue is something wrong with a manifest that a rule had to work around, i.e. a tag whose version does not parse
+type Issue struct {
+	// Rule is the index in the ruleset of the rule that found the issue. It is set by ApplyRulesWithDecisions
+	Rule int
+	// Kind is what is wrong, one of the Issue constants
+	Kind string
+	// Detail is why, i.e. the parse error
+	Detail string
+}
+
+// IssueReporter is a RetentionPolicy that can say what is wrong with the manifests it decides on, i.e. so
+// the manifests it leaves alone because it can't decide on them are reported
+type IssueReporter interface {
+	// Issues are what is wrong with the manifests, by Reference, as Apply would find
+	Issues(manifests []*registry.Manifest) map[string][]Issue
+}
+
+// Unmarshaler decodes a Matcher or RetentionPolicy's config section into v. It behaves like
+// the unmarshal function passed to yaml.Unmarshaler, so v should use yaml struct tags.
+type Unmarshaler func(v interface{}) error
+
+// MatcherFactory builds a Matcher from its config section
+type MatcherFactory func(unmarshal Unmarshaler) (Matcher, error)
+
+// PolicyFactory builds a RetentionPolicy from its config section
+type PolicyFactory func(unmarshal Unmarshaler) (RetentionPolicy, error)
+
+// RegisterMatcher makes a Matcher available to configs by name, under a rule's `match:` section.
+// Programs embedding the pruner should register their Matchers before loading a config.
+// It panics if a Matcher is registered twice under the same name.
+func RegisterMatcher(name string, factory MatcherFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, dup := matchers[name]; dup {
+		panic("rules: RegisterMatcher called twice for " + name)
+	}
+	matchers[name] = factory
+}
+
+// RegisterPolicy makes a RetentionPolicy available to configs by name, under a rule's `policy:` section.
+// Programs embedding the pruner should register their RetentionPolicies before loading a config.
+// It panics if a RetentionPolicy is registered twice under the same name.
+func RegisterPolicy(name string, factory PolicyFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, dup := policies[name]; dup {
+		panic("rules: RegisterPolicy called twice for " + name)
+	}
+	policies[name] = factory
+}
+
+// NewMatcher builds the Matcher registered as name from its config
+func NewMatcher(name string, unmarshal Unmarshaler) (Matcher, error) {
+	pluginsMu.RLock()
+	factory, ok := matchers[name]
+	pluginsMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownMatcher
+	}
+	return factory(unmarshal)
+}
+
+// NewPolicy builds the RetentionPolicy registered as name from its config
+func NewPolicy(name string, unmarshal Unmarshaler) (RetentionPolicy, error) {
+	pluginsMu.RLock()
+	factory, ok := policies[name]
+	pluginsMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownPolicy
+	}
+	return factory(unmarshal)
+}
+
+func init() {
+	RegisterPolicy("label_policy", func(unmarshal Unmarshaler) (RetentionPolicy, error) {
+		p := LabelPolicy{}
+		if err := unmarshal(&p); err != nil {
+			return nil, err
+		}
+		if p.KeepDaysLabel == "" {
+			p.KeepDaysLabel = DefaultKeepDaysLabel
+		}
+		if p.ExpiresAtLabel == "" {
+			p.ExpiresAtLabel = DefaultExpiresAtLabel
+		}
+		return &p, nil
+	})
+	RegisterPolicy("keep_schedule", func(unmarshal Unmarshaler) (RetentionPolicy, error) {
+		p := KeepSchedulePolicy{}
+		if err := unmarshal(&p); err != nil {
+			return nil, err
+		}
+		return &p, nil
+	})
+}
+
+// KeepVersionsPolicy keeps the latest N versions. Manifests whose version does not parse are left alone.
+type KeepVersionsPolicy struct {
+	N int
+	// Regex extracts the version from a tag, via the named capture group registry.VersionRegexGroup.
+	// If nil, the whole tag is parsed as a version.
+	Regex *regexp.Regexp
+	// Scheme determines how versions are parsed and ordered. If nil, registry.DefaultVersionScheme is used.
+	Scheme registry.VersionScheme
+}
+
+// Apply keeps the latest N manifests by version, and deletes the rest
+func (p *KeepVersionsPolicy) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	// handle versions that arent parsable. We do not apply any retention rules to versions that didnt parse
+	validVersionManifests := []*registry.Manifest{}
+	for _, manifest := range manifests {
+		v, err := registry.ParseVersion(manifest.Tag, p.Regex, p.Scheme)
+		if err != nil {
+			log.Warnw("unable to parse version from tag, skipping", "repo", manifest.Name, "tag", manifest.Tag, "error", err)
+			continue
+		}
+		validVersionManifests = append(validVersionManifests, manifest.WithVersion(v))
+	}
+	sort.Sort(registry.ManifestVersionCollection(validVersionManifests))
+	indexHigh := len(validVersionManifests)
+	indexLow := indexHigh - p.N
+	if indexLow < 0 {
+		indexLow = 0
+	}
+	delete = append(delete, validVersionManifests[0:indexLow]...)
+	keep = append(keep, validVersionManifests[indexLow:indexHigh]...)
+	return
+}
+
+// Issues are the manifests whose version does not parse, which Apply leaves alone
+func (p *KeepVersionsPolicy) Issues(manifests []*registry.Manifest) map[string][]Issue {
+	issues := map[string][]Issue{}
+	for _, manifest := range manifests {
+		if _, err := registry.ParseVersion(manifest.Tag, p.Regex, p.Scheme); err != nil {
+			issues[manifest.Reference()] = []Issue{{Kind: IssueUnparsedVersion, Detail: err.Error()}}
+		}
+	}
+	return issues
+}
+
+// String returns a useful string description of this KeepVersionsPolicy
+func (p *KeepVersionsPolicy) String() string {
+	s := fmt.Sprintf("keep latest %d versions", p.N)
+	if p.Scheme != nil {
+		s = fmt.Sprintf("%s (%s)", s, p.Scheme.Name())
+	}
+	if p.Regex != nil {
+		s = fmt.Sprintf("%s extracted by %s", s, p.Regex.String())
+	}
+	return s
+}
+
+// KeepDaysPolicy keeps images modified in the last N days
+type KeepDaysPolicy struct {
+	N int
+}
+
+// Apply keeps manifests modified in the last N days, and deletes the rest
+func (p *KeepDaysPolicy) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	sort.Sort(registry.ManifestModifiedCollection(manifests))
+	for _, manifest := range manifests {
+		if olderThanDays(manifest, p.N, tNow) {
+			delete = append(delete, manifest)
+		} else {
+			keep = append(keep, manifest)
+		}
+	}
+	return
+}
+
+// String returns a useful string description of this KeepDaysPolicy
+func (p *KeepDaysPolicy) String() string {
+	return fmt.Sprintf("keep latest %d days", p.N)
+}
+
+// KeepRecentPolicy keeps the latest N images, by modification time
+type KeepRecentPolicy struct {
+	N int
+}
+
+// Apply keeps the latest N manifests by modification time, and deletes the rest
+func (p *KeepRecentPolicy) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	sort.Sort(registry.ManifestModifiedCollection(manifests))
+	for i, manifest := range manifests {
+		if i < len(manifests)-p.N {
+			delete = append(delete, manifest)
+		} else {
+			keep = append(keep, manifest)
+		}
+	}
+	return
+}
+
+// String returns a useful string description of this KeepRecentPolicy
+func (p *KeepRecentPolicy) String() string {
+	return fmt.Sprintf("keep latest %d images", p.N)
+}
+
+// olderThanDays is true when the manifest was last modified more than days ago
+func olderThanDays(m *registry.Manifest, days int, tNow time.Time) bool {
+	return int64(tNow.Sub(m.LastModified).Minutes()) > int64(24*60*days)
+}
@@ -0,0 +1,80 @@
+package rules
+
+import (
+	"fmt"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+// Protection is why an image must not be deleted
+type Protection struct {
+	// Reason is what the image is reported as, i.e. protected-in-use
+	Reason string
+	// Source is what depends on the image, i.e. a workload or a file and line
+	Source string
+}
+
+// Protector protects images from deletion, whatever the rules decide
+type Protector interface {
+	// Protections are why m must not be deleted, or empty if it may be
+	Protections(m *registry.Manifest) []Protection
+}
+
+// ApplyProtections keeps the manifests to delete that any of the protectors protect. Deleting a manifest
+// deletes its digest, along with every tag of its repo on that digest, so a manifest is also protected by
+// the protections of the other tags on its digest. all are every manifest fetched, to find those tags in,
+// whether or not a rule selected them. Returns the protections of each manifest kept this way, by Reference.
+func ApplyProtections(protectors []Protector, all []*registry.Manifest, keep []*registry.Manifest, delete []*registry.Manifest) ([]*registry.Manifest, []*registry.Manifest, map[string][]Protection) {
+	protectedBy := map[string][]Protection{}
+	if len(protectors) == 0 {
+		return keep, delete, protectedBy
+	}
+	protectionsOf := func(m *registry.Manifest) []Protection {
+		protections := []Protection{}
+		for _, p := range protectors {
+			protections = append(protections, p.Protections(m)...)
+		}
+		return protections
+	}
+	// the tags with protections, by the repo and digest they are on
+	byDigest := map[string][]*registry.Manifest{}
+	for _, m := range all {
+		if m.Digest != "" && len(protectionsOf(m)) > 0 {
+			k := m.Name + "@" + m.Digest.String()
+			byDigest[k] = append(byDigest[k], m)
+		}
+	}
+
+	deletable := []*registry.Manifest{}
+	for _, m := range delete {
+		protections := protectionsOf(m)
+		if m.Digest != "" {
+			// protections of the digest itself already protect every tag on it
+			seen := map[Protection]bool{}
+			for _, protection := range protections {
+				seen[protection] = true
+			}
+			for _, other := range byDigest[m.Name+"@"+m.Digest.String()] {
+				if other.Tag == m.Tag {
+					continue
+				}
+				for _, protection := range protectionsOf(other) {
+					if seen[protection] {
+						continue
+					}
+					seen[protection] = true
+					protection.Source = fmt.Sprintf("%s (via %s)", protection.Source, other.Reference())
+					protections = append(protections, protection)
+				}
+			}
+		}
+		if len(protections) == 0 {
+			deletable = append(deletable, m)
+			continue
+		}
+		log.Infow("protected image from deletion", "repo", m.Name, "tag", m.Tag, "digest", m.Digest, "reason", protections[0].Reason, "source", protections[0].Source)
+		protectedBy[m.Reference()] = protections
+		keep = append(keep, m)
+	}
+	return keep, deletable, protectedBy
+}
@@ -2,14 +2,22 @@ package rules
 
 import (
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"go.uber.org/zap"
 )
 
 var (
+	logger, _ = zap.NewProduction()
+	log       = logger.Sugar()
+
+	// GroupByRegexGroup is the name of the capture group a group_by tag regex uses to extract the group from a tag
+	GroupByRegexGroup = "group"
+
 	// ErrLabelsNil is returned when an initialization error creates a Selector with a nil Labels map
 	ErrLabelsNil = fmt.Errorf("labels must not be a nil map")
 	// ErrKeepVersionsMustBePositive
@@ -19,16 +27,34 @@ var (
 	// ErrKeepMostRecentCountMustBePositive
 	ErrKeepMostRecentCountMustBePositive = fmt.Errorf("keep_recent must be positive")
 	// ErrMissingReposOrLabels
-	ErrMissingReposOrLabels = fmt.Errorf("repos or labels selector is required")
+	ErrMissingReposOrLabels = fmt.Errorf("repos, labels, expr, or match selector is required")
 	// ErrActionMustBeSpecified
-	ErrActionMustBeSpecified        = fmt.Errorf("one of keep_versions, keep_days, or keep_recent must be specified as an action")
+	ErrActionMustBeSpecified        = fmt.Errorf("one of keep_versions, keep_days, keep_recent, keep_schedule, label_policy, script, or policy must be specified as an action")
 	ErrMultipleActionVersionsDays   = fmt.Errorf("both keep_versions and keep_days specified, but are mutually exclusive")
 	ErrMultipleActionDaysLatest     = fmt.Errorf("both keep_days and keep_recent specified, but are mutually exclusive")
 	ErrMultipleActionLatestVersions = fmt.Errorf("both keep_versions and keep_recent specified, but are mutually exclusive")
+	// ErrMultipleActionPolicy is returned when a keep_schedule, label_policy, script, or policy is combined with another action
+	ErrMultipleActionPolicy = fmt.Errorf("only one of keep_versions, keep_days, keep_recent, keep_schedule, label_policy, script, or policy may be specified")
+	// ErrMinKeepMustBePositive
+	ErrMinKeepMustBePositive = fmt.Errorf("min_keep must be positive")
+	// ErrMaxAgeDaysMustBePositive
+	ErrMaxAgeDaysMustBePositive = fmt.Errorf("max_age_days must be positive")
+	// ErrGracePeriodDaysMustBePositive is returned when a rule's grace_period_days is negative
+	ErrGracePeriodDaysMustBePositive = fmt.Errorf("grace_period_days must be positive")
+	// ErrGroupByRegexMissingGroup is returned when a group_by tag regex does not have a named capture group for the group
+	ErrGroupByRegexMissingGroup = fmt.Errorf("group_by tag must contain a (?P<%s>...) capture group", GroupByRegexGroup)
+	// ErrGroupByTagAndLabel is returned when a rule groups by both a tag regex and a label
+	ErrGroupByTagAndLabel = fmt.Errorf("group_by tag and label specified, but are mutually exclusive")
+	// ErrVersionRegexMissingGroup is returned when a version_regex does not have a named capture group for the version
+	ErrVersionRegexMissingGroup = fmt.Errorf("version_regex must contain a (?P<%s>...) capture group", registry.VersionRegexGroup)
 )
 
 type Rule struct {
+	// Name identifies the rule in reports, if set
+	Name string
 	Selector
+	// Matchers further restrict which manifests this rule applies to; all must match
+	Matchers []Matcher
 
 	// KeepVersions is how many of the latest images to keep, sorted by version
 	KeepVersions int
@@ -36,6 +62,32 @@ type Rule struct {
 	KeepDays int
 	// KeepMostRecent will keep the latest N images, by modification time
 	KeepMostRecent int
+	// Policy is the action for rules that use a RetentionPolicy other than the built in
+	// KeepVersions, KeepDays or KeepMostRecent, i.e. a LabelPolicy, Script, or one registered with RegisterPolicy
+	Policy RetentionPolicy
+	// MinKeep always keeps the latest N images selected by this rule, by modification time, regardless of the action
+	MinKeep int
+	// MaxAgeDays deletes any images selected by this rule older than N days, even if the action would keep them
+	MaxAgeDays int
+	// GracePeriodDays is how many days images this rule deletes must stay marked for deletion before they are
+	// deleted. If 0, the config's grace period applies
+	GracePeriodDays int
+
+	// VersionRegex extracts the version from a tag, via the named capture group registry.VersionRegexGroup.
+	// If nil, the whole tag is parsed as a version.
+	VersionRegex *regexp.Regexp
+	// VersionScheme determines how versions are parsed and ordered. If nil, registry.DefaultVersionScheme is used.
+	VersionScheme registry.VersionScheme
+
+	// GroupByTag partitions the selected images by the GroupByRegexGroup capture of their tag, and applies
+	// the action within each partition independently
+	GroupByTag *regexp.Regexp
+	// GroupByLabel partitions the selected images by the value of this label, and applies
+	// the action within each partition independently
+	GroupByLabel string
+
+	// AgeSource is where the age of images comes from for this rule. If nil, it is the newest created time in their history.
+	AgeSource *AgeSource
 }
 
 // String returns a useful string description of this Rule
@@ -49,24 +101,61 @@ func (r *Rule) String() string {
 		matches = append(matches, i.String())
 	}
 	selector := fmt.Sprintf("ignore tags [%s], match tags [%s]", strings.Join(ignores, " or "), strings.Join(matches, " or "))
+	if r.Expr != nil {
+		selector = fmt.Sprintf("%s, expr [%s]", selector, r.Expr.String())
+	}
+	for _, m := range r.Matchers {
+		selector = fmt.Sprintf("%s, match [%s]", selector, describe(m))
+	}
 	action := ""
-	if r.KeepMostRecent != 0 {
-		action = fmt.Sprintf("keep latest %d images", r.KeepMostRecent)
+	if p := r.policy(); p != nil {
+		action = describe(p)
+	}
+	if r.GroupByTag != nil {
+		action = fmt.Sprintf("%s per tag group %s", action, r.GroupByTag.String())
+	}
+	if r.GroupByLabel != "" {
+		action = fmt.Sprintf("%s per label %s", action, r.GroupByLabel)
 	}
-	if r.KeepDays != 0 {
-		action = fmt.Sprintf("keep latest %d days", r.KeepDays)
+	if r.MaxAgeDays != 0 {
+		action = fmt.Sprintf("%s, at most %d days old", action, r.MaxAgeDays)
 	}
-	if r.KeepVersions != 0 {
-		action = fmt.Sprintf("keep latest %d versions", r.KeepVersions)
+	if r.MinKeep != 0 {
+		action = fmt.Sprintf("%s, at least %d images", action, r.MinKeep)
+	}
+	if r.AgeSource != nil {
+		action = fmt.Sprintf("%s, aged by %s", action, r.AgeSource.String())
+	}
+	if r.GracePeriodDays != 0 {
+		action = fmt.Sprintf("%s, deleting after %d days marked", action, r.GracePeriodDays)
 	}
 	return fmt.Sprintf("Repos:%s Labels:%v Selector{%s} Action{%s}", strings.Join(r.Repos, ","), r.Labels, selector, action)
 }
 
+// RuleName is the Name of the ith rule of the ruleset, or "rule i" if it has none
+func RuleName(ruleset []*Rule, i int) string {
+	if ruleset[i].Name != "" {
+		return ruleset[i].Name
+	}
+	return fmt.Sprintf("rule %d", i)
+}
+
+// RuleNames turns the rule indices of reasons, as in Decisions, into RuleNames
+func RuleNames(ruleset []*Rule, reasons map[string][]int) map[string][]string {
+	names := map[string][]string{}
+	for ref, rs := range reasons {
+		for _, i := range rs {
+			names[ref] = append(names[ref], RuleName(ruleset, i))
+		}
+	}
+	return names
+}
+
 func (r *Rule) Validate() error {
 	switch {
 	case r.Labels == nil:
 		return ErrLabelsNil
-	case len(r.Repos) == 0 && len(r.Labels) == 0:
+	case len(r.Repos) == 0 && len(r.Labels) == 0 && r.Expr == nil && len(r.Matchers) == 0:
 		return ErrMissingReposOrLabels
 	case r.KeepDays != 0 && r.KeepVersions != 0:
 		return ErrMultipleActionVersionsDays
@@ -80,17 +169,123 @@ func (r *Rule) Validate() error {
 		return ErrKeepVersionsMustBePositive
 	case r.KeepMostRecent < 0:
 		return ErrKeepMostRecentCountMustBePositive
-	case r.KeepDays == 0 && r.KeepVersions == 0 && r.KeepMostRecent == 0:
+	case r.MinKeep < 0:
+		return ErrMinKeepMustBePositive
+	case r.MaxAgeDays < 0:
+		return ErrMaxAgeDaysMustBePositive
+	case r.GracePeriodDays < 0:
+		return ErrGracePeriodDaysMustBePositive
+	case r.Policy != nil && (r.KeepDays != 0 || r.KeepVersions != 0 || r.KeepMostRecent != 0):
+		return ErrMultipleActionPolicy
+	case r.KeepDays == 0 && r.KeepVersions == 0 && r.KeepMostRecent == 0 && r.Policy == nil:
 		return ErrActionMustBeSpecified
+	case r.VersionRegex != nil && r.VersionRegex.SubexpIndex(registry.VersionRegexGroup) < 0:
+		return ErrVersionRegexMissingGroup
+	case r.GroupByTag != nil && r.GroupByLabel != "":
+		return ErrGroupByTagAndLabel
+	case r.GroupByTag != nil && r.GroupByTag.SubexpIndex(GroupByRegexGroup) < 0:
+		return ErrGroupByRegexMissingGroup
+	case r.AgeSource != nil && r.AgeSource.Validate() != nil:
+		return r.AgeSource.Validate()
 	default:
+		// policies may validate their own config
+		if v, ok := r.Policy.(interface{ Validate() error }); ok {
+			return v.Validate()
+		}
 		return nil
 	}
 }
 
+// Match is true if the manifest is matched by this rule's Selector, and all of its Matchers
+func (r *Rule) Match(m *registry.Manifest) bool {
+	return r.MatchAt(m, time.Now())
+}
+
+// MatchAt is Match, evaluating any age in the Selector's expr as of tNow
+func (r *Rule) MatchAt(m *registry.Manifest, tNow time.Time) bool {
+	if !r.Selector.MatchAt(m, tNow) {
+		return false
+	}
+	for _, matcher := range r.Matchers {
+		if !matcher.Match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// policy returns the RetentionPolicy for this rule's action
+func (r *Rule) policy() RetentionPolicy {
+	switch {
+	case r.KeepVersions > 0:
+		return &KeepVersionsPolicy{N: r.KeepVersions, Regex: r.VersionRegex, Scheme: r.VersionScheme}
+	case r.KeepDays > 0:
+		return &KeepDaysPolicy{N: r.KeepDays}
+	case r.KeepMostRecent > 0:
+		return &KeepRecentPolicy{N: r.KeepMostRecent}
+	default:
+		return r.Policy
+	}
+}
+
+// describe returns the String of a Matcher or RetentionPolicy, or its type if it has none
+func describe(x interface{}) string {
+	if s, ok := x.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", x)
+}
+
 // ApplyRules takes a list of rules, and applies them to a list of manifests.
 // 2 stages: 1. matching selectors, 2. of those that match, apply retention logic in rule
-// returns 2 slices; the manifests to keep, and those to delete
-func ApplyRules(ruleset []*Rule, manifests []*registry.Manifest) (keep []*registry.Manifest, delete []*registry.Manifest) {
+// returns 2 slices; the manifests to keep, and those to delete. Rules are evaluated as of the clock's current time.
+func ApplyRules(ruleset []*Rule, manifests []*registry.Manifest, clock Clock) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	keep, delete, _ = ApplyRulesWithDecisions(ruleset, manifests, clock)
+	return keep, delete
+}
+
+// Decisions are why the rules kept and deleted manifests, and what they could not decide on
+type Decisions struct {
+	// KeptBy and DeletedBy map the Reference of each manifest kept or deleted to the indices in the
+	// ruleset of the rules that kept or deleted it
+	KeptBy    map[string][]int
+	DeletedBy map[string][]int
+	// Issues are what the rules found wrong with manifests, by Reference
+	Issues map[string][]Issue
+	// Skipped are the manifests with issues that no rule kept or deleted
+	Skipped []*registry.Manifest
+	// Groups are how many manifests each grouped rule kept and deleted in each group, by rule, repo and group
+	Groups []*GroupCount
+}
+
+// ScriptsFailed is true if any rule's script failed, so images it should have decided on were not
+func (d *Decisions) ScriptsFailed() bool {
+	for _, issues := range d.Issues {
+		for _, issue := range issues {
+			if issue.Kind == IssueScriptFailed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GroupCount is how many manifests of a repo's group a grouped rule kept and deleted, before the decisions
+// of other rules are taken into account
+type GroupCount struct {
+	// Rule is the index in the ruleset of the rule
+	Rule   int
+	Repo   string
+	Group  string
+	Keep   int
+	Delete int
+}
+
+// ApplyRulesWithDecisions is ApplyRules, also returning the Decisions: which rules kept and deleted each
+// manifest, the issues they found, and how they decided on each group
+func ApplyRulesWithDecisions(ruleset []*Rule, manifests []*registry.Manifest, clock Clock) (keep []*registry.Manifest, delete []*registry.Manifest, d *Decisions) {
+	d = &Decisions{KeptBy: map[string][]int{}, DeletedBy: map[string][]int{}, Issues: map[string][]Issue{}, Skipped: []*registry.Manifest{}, Groups: []*GroupCount{}}
+	keptBy, deletedBy := d.KeptBy, d.DeletedBy
 	manifestsByRepo := map[string][]*registry.Manifest{}
 	// group manifests by their repo, so we apply rule sets only over one repo's manifests at a time
 	for _, manifest := range manifests {
@@ -101,72 +296,196 @@ func ApplyRules(ruleset []*Rule, manifests []*registry.Manifest) (keep []*regist
 		manifestsByRepo[manifest.Name] = append(ms, manifest)
 	}
 
-	// apply rules to manifests
+	// apply rules to manifests, all as of the same time
+	tNow := clock.Now()
 	for _, manifests := range manifestsByRepo {
-		k, d := applyRules(ruleset, manifests)
+		k, del := applyRules(ruleset, manifests, tNow, d)
 		keep = append(keep, k...)
-		delete = append(delete, d...)
+		delete = append(delete, del...)
 	}
+	sort.Slice(d.Groups, func(i, j int) bool {
+		a, b := d.Groups[i], d.Groups[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Group < b.Group
+	})
 
 	// 3. dedupe our keep/delete sets, because we definitely could have matched an image with multiple rules
 	// NOTE: delete supercedes any keep directive, because keep is a default.
 	// TODO: we will need to remove all the deletes from keeps
 	keep = registry.RemoveItems(keep, delete)
-	return registry.DedupeManifests(keep), registry.DedupeManifests(delete)
+	// likewise, a manifest some rule kept but another deleted was not kept by anything
+	kept := map[string][]int{}
+	for ref, rs := range keptBy {
+		if _, ok := deletedBy[ref]; !ok {
+			kept[ref] = rs
+		}
+	}
+	d.KeptBy = kept
+	for _, m := range manifests {
+		_, decided := keptBy[m.Reference()]
+		if _, ok := deletedBy[m.Reference()]; ok {
+			decided = true
+		}
+		if _, ok := d.Issues[m.Reference()]; ok && !decided {
+			d.Skipped = append(d.Skipped, m)
+		}
+	}
+	return registry.DedupeManifests(keep), registry.DedupeManifests(delete), d
+}
+
+// FilterManifestsByRules is FilterManifests over the selectors of the ruleset, where each rule's selector
+// matches the manifests by their age from the rule's AgeSource, as applyRules does. The manifests are
+// returned as they are given, not aged.
+func FilterManifestsByRules(manifests []*registry.Manifest, ruleset []*Rule, clock Clock) map[string][]*registry.Manifest {
+	tNow := clock.Now()
+	matchingManifests := map[string][]*registry.Manifest{}
+	for _, manifest := range manifests {
+		for _, rule := range ruleset {
+			aged := manifest
+			if rule.AgeSource != nil {
+				t, ok := rule.AgeSource.Timestamp(manifest)
+				if !ok {
+					continue
+				}
+				aged = manifest.WithLastModified(t, rule.AgeSource.Source)
+			}
+			if rule.MatchAt(aged, tNow) {
+				matchingManifests[manifest.Name] = append(matchingManifests[manifest.Name], manifest)
+				break
+			}
+		}
+	}
+	for _, ms := range matchingManifests {
+		sort.Sort(registry.ManifestModifiedCollection(ms))
+	}
+	return matchingManifests
 }
 
 // applyRules returns a list of Manifests that match the set of rules
-// assumes all manifests are for the same repo!
-func applyRules(ruleset []*Rule, manifests []*registry.Manifest) (keep []*registry.Manifest, delete []*registry.Manifest) {
-	for _, rule := range ruleset {
+// assumes all manifests are for the same repo! Records which rules kept and deleted each manifest, and the
+// issues they found and the counts of each group, in d.
+func applyRules(ruleset []*Rule, manifests []*registry.Manifest, tNow time.Time, d *Decisions) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	for i, rule := range ruleset {
+		// 0. take the age of the manifests from where this rule says, so selectors and actions see the same age
+		ruleManifests := manifests
+		if rule.AgeSource != nil {
+			ruleManifests = rule.AgeSource.Apply(manifests)
+		}
+
 		// 1. for each rule, see if any manifests match our selector.
 		filteredManifests := []*registry.Manifest{}
-		for _, manifest := range manifests {
+		for _, manifest := range ruleManifests {
 			// see if this rule's Selector matches any of these manifests
-			if rule.Match(manifest) {
+			if rule.MatchAt(manifest, tNow) {
 				filteredManifests = append(filteredManifests, manifest)
 			}
 		}
 
-		// 2. For all manifests that were selected by this rule, apply retention logic to it
-		switch {
-		case rule.KeepVersions > 0:
-			// handle versions that arent parsable. We do not apply any retention rules to versions that didnt parse
-			validVersionManifests := []*registry.Manifest{}
-			for _, manifest := range filteredManifests {
-				if manifest.Version != registry.DefaultVersion {
-					validVersionManifests = append(validVersionManifests, manifest)
+		// 2. partition the selected manifests, if this rule is grouped. Otherwise, they are all one group
+		groups := map[string][]*registry.Manifest{"": filteredManifests}
+		if rule.grouped() {
+			groups = rule.partition(filteredManifests)
+		}
+
+		for group, groupManifests := range groups {
+			// 3. For all manifests in the group, apply retention logic to it
+			k, del := rule.applyAction(groupManifests, tNow)
+			if r, ok := rule.policy().(IssueReporter); ok {
+				for ref, issues := range r.Issues(groupManifests) {
+					for _, issue := range issues {
+						issue.Rule = i
+						d.Issues[ref] = append(d.Issues[ref], issue)
+					}
 				}
 			}
-			sort.Sort(registry.ManifestVersionCollection(validVersionManifests))
-			indexHigh := len(validVersionManifests)
-			indexLow := indexHigh - rule.KeepVersions
-			if indexLow < 0 {
-				indexLow = 0
+			// 4. enforce the max age ceiling and min keep floor over whatever the action decided
+			k, del = rule.applyAgeLimits(k, del, tNow)
+			if rule.grouped() && len(groupManifests) > 0 {
+				log.Infow("applied rule to group", "repo", groupManifests[0].Name, "group", group, "keep", len(k), "delete", len(del))
+				d.Groups = append(d.Groups, &GroupCount{Rule: i, Repo: groupManifests[0].Name, Group: group, Keep: len(k), Delete: len(del)})
 			}
-			delete = append(delete, validVersionManifests[0:indexLow]...)
-			keep = append(keep, validVersionManifests[indexLow:indexHigh]...)
-
-		case rule.KeepDays > 0:
-			tNow := time.Now()
-			sort.Sort(registry.ManifestModifiedCollection(filteredManifests))
-			for _, manifest := range filteredManifests {
-				if int64(tNow.Sub(manifest.LastModified).Minutes()) > int64(24*60*rule.KeepDays) {
-					delete = append(delete, manifest)
-				} else {
-					keep = append(keep, manifest)
-				}
+			for _, m := range k {
+				d.KeptBy[m.Reference()] = append(d.KeptBy[m.Reference()], i)
 			}
-		case rule.KeepMostRecent > 0:
-			sort.Sort(registry.ManifestModifiedCollection(filteredManifests))
-			for i, manifest := range filteredManifests {
-				if i < len(filteredManifests)-rule.KeepMostRecent {
-					delete = append(delete, manifest)
-				} else {
-					keep = append(keep, manifest)
-				}
+			for _, m := range del {
+				d.DeletedBy[m.Reference()] = append(d.DeletedBy[m.Reference()], i)
 			}
+			keep = append(keep, k...)
+			delete = append(delete, del...)
 		}
 	}
 	return
 }
+
+func (r *Rule) grouped() bool {
+	return r.GroupByTag != nil || r.GroupByLabel != ""
+}
+
+// partition groups manifests by their GroupByTag capture or GroupByLabel value. Manifests
+// without a group are left out, so the rule neither keeps nor deletes them.
+func (r *Rule) partition(manifests []*registry.Manifest) map[string][]*registry.Manifest {
+	groups := map[string][]*registry.Manifest{}
+	for _, manifest := range manifests {
+		group, ok := r.groupOf(manifest)
+		if !ok {
+			log.Debugw("image has no group, skipping", "repo", manifest.Name, "tag", manifest.Tag)
+			continue
+		}
+		groups[group] = append(groups[group], manifest)
+	}
+	return groups
+}
+
+func (r *Rule) groupOf(m *registry.Manifest) (string, bool) {
+	if r.GroupByLabel != "" {
+		group, ok := m.Labels[r.GroupByLabel]
+		return group, ok
+	}
+	match := r.GroupByTag.FindStringSubmatch(m.Tag)
+	if match == nil {
+		return "", false
+	}
+	return match[r.GroupByTag.SubexpIndex(GroupByRegexGroup)], true
+}
+
+// applyAction applies the retention action of this rule to the manifests it selected
+func (r *Rule) applyAction(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	p := r.policy()
+	if p == nil {
+		return nil, nil
+	}
+	return p.Apply(manifests, tNow)
+}
+
+// applyAgeLimits deletes any kept manifests older than MaxAgeDays, and then makes sure
+// the MinKeep most recently modified manifests are kept regardless of age.
+func (r *Rule) applyAgeLimits(keep []*registry.Manifest, delete []*registry.Manifest, tNow time.Time) ([]*registry.Manifest, []*registry.Manifest) {
+	if r.MaxAgeDays > 0 {
+		young := []*registry.Manifest{}
+		for _, manifest := range keep {
+			if olderThanDays(manifest, r.MaxAgeDays, tNow) {
+				delete = append(delete, manifest)
+			} else {
+				young = append(young, manifest)
+			}
+		}
+		keep = young
+	}
+	if r.MinKeep > 0 {
+		all := append(append([]*registry.Manifest{}, keep...), delete...)
+		sort.Sort(registry.ManifestModifiedCollection(all))
+		indexLow := len(all) - r.MinKeep
+		if indexLow < 0 {
+			indexLow = 0
+		}
+		newest := all[indexLow:]
+		delete = registry.RemoveItems(delete, newest)
+		keep = registry.DedupeManifests(append(keep, newest...))
+	}
+	return keep, delete
+}
@@ -0,0 +1,115 @@
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+var (
+	// ErrKeepScheduleMustBePositive
+	ErrKeepScheduleMustBePositive = fmt.Errorf("keep_schedule all_days, daily, weekly and monthly must be positive")
+	// ErrKeepScheduleEmpty is returned when a keep_schedule would not keep anything
+	ErrKeepScheduleEmpty = fmt.Errorf("keep_schedule must set at least one of all_days, daily, weekly or monthly")
+)
+
+// KeepSchedulePolicy is a grandfather-father-son schedule: it keeps every image from the last AllDays days,
+// then the newest image of each calendar day for Daily days, of each ISO week for Weekly weeks, and of each
+// month for Monthly months. Days, weeks and months are in UTC. Images kept by none of these are deleted.
+type KeepSchedulePolicy struct {
+	// AllDays keeps every image modified in the last N days
+	AllDays int `yaml:"all_days"`
+	// Daily keeps the newest image of each day, for the last N days
+	Daily int `yaml:"daily"`
+	// Weekly keeps the newest image of each week, for the last N weeks
+	Weekly int `yaml:"weekly"`
+	// Monthly keeps the newest image of each month, for the last N months
+	Monthly int `yaml:"monthly"`
+}
+
+// String returns a useful string description of this KeepSchedulePolicy
+func (p *KeepSchedulePolicy) String() string {
+	tiers := []string{}
+	if p.AllDays != 0 {
+		tiers = append(tiers, fmt.Sprintf("all for %d days", p.AllDays))
+	}
+	if p.Daily != 0 {
+		tiers = append(tiers, fmt.Sprintf("daily for %d days", p.Daily))
+	}
+	if p.Weekly != 0 {
+		tiers = append(tiers, fmt.Sprintf("weekly for %d weeks", p.Weekly))
+	}
+	if p.Monthly != 0 {
+		tiers = append(tiers, fmt.Sprintf("monthly for %d months", p.Monthly))
+	}
+	return fmt.Sprintf("keep schedule %s", strings.Join(tiers, ", "))
+}
+
+// Validate checks this KeepSchedulePolicy keeps something
+func (p *KeepSchedulePolicy) Validate() error {
+	switch {
+	case p.AllDays < 0 || p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0:
+		return ErrKeepScheduleMustBePositive
+	case p.AllDays == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0:
+		return ErrKeepScheduleEmpty
+	default:
+		return nil
+	}
+}
+
+// Apply keeps the manifests any tier of the schedule retains as of tNow, and deletes the rest
+func (p *KeepSchedulePolicy) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	// newest first, so the first manifest seen in a bucket is the one kept
+	newest := append([]*registry.Manifest{}, manifests...)
+	sort.Sort(sort.Reverse(registry.ManifestModifiedCollection(newest)))
+
+	// every tier reaches back by calendar days or months from tNow, the same way
+	since := func(months, days int) time.Time {
+		return tNow.AddDate(0, -months, -days)
+	}
+	kept := map[*registry.Manifest]bool{}
+	for _, m := range newest {
+		if m.LastModified.After(since(0, p.AllDays)) {
+			kept[m] = true
+		}
+	}
+	keepNewestPerBucket(newest, kept, since(0, p.Daily), func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepNewestPerBucket(newest, kept, since(0, 7*p.Weekly), func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepNewestPerBucket(newest, kept, since(p.Monthly, 0), func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	for _, m := range newest {
+		if kept[m] {
+			keep = append(keep, m)
+		} else {
+			delete = append(delete, m)
+		}
+	}
+	return
+}
+
+// keepNewestPerBucket marks the first of the newest-first manifests in each bucket as kept,
+// considering only those modified after since
+func keepNewestPerBucket(newest []*registry.Manifest, kept map[*registry.Manifest]bool, since time.Time, bucket func(time.Time) string) {
+	seen := map[string]bool{}
+	for _, m := range newest {
+		if !m.LastModified.After(since) {
+			continue
+		}
+		b := bucket(m.LastModified.UTC())
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		kept[m] = true
+	}
+}
@@ -0,0 +1,254 @@
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+var (
+	// DefaultScriptMaxSteps is how many Starlark steps a script may execute per evaluation, if not configured
+	DefaultScriptMaxSteps uint64 = 1000000
+	// ScriptEntrypoint is the function a script must define. It is called with the list of
+	// manifests selected for a repo, and returns {"keep": [tags], "delete": [tags]}
+	ScriptEntrypoint = "retain"
+
+	// ErrScriptMissingEntrypoint is returned when a script does not define a retain function
+	ErrScriptMissingEntrypoint = fmt.Errorf("script must define a %s(manifests) function", ScriptEntrypoint)
+	// ErrScriptResultNotDict is returned when retain does not return a dict
+	ErrScriptResultNotDict = fmt.Errorf("%s must return a dict with keep and delete lists of tags", ScriptEntrypoint)
+	// ErrScriptUnknownTag is returned when retain returns a tag it was not given
+	ErrScriptUnknownTag = fmt.Errorf("%s returned a tag that was not selected", ScriptEntrypoint)
+	// ErrScriptTagKeptAndDeleted is returned when retain both keeps and deletes a tag
+	ErrScriptTagKeptAndDeleted = fmt.Errorf("%s returned a tag in both keep and delete", ScriptEntrypoint)
+)
+
+// Script is an action that delegates retention to a Starlark (https://github.com/bazelbuild/starlark) script.
+// Scripts are sandboxed: they have no I/O or load(), see the time only through the predeclared `now`
+// (unix seconds), and are limited to MaxSteps execution steps.
+//
+// The script's retain(manifests) function receives a list of structs with the fields
+// repo, tag, digest, version, last_modified (unix seconds) and labels.
+type Script struct {
+	// File is the path the script was loaded from
+	File string
+	// MaxSteps limits how many steps the script may execute per evaluation
+	MaxSteps uint64
+	// Source is the script as it was loaded
+	Source []byte
+	// VersionRegex and VersionScheme parse the tags into the manifests' version, as the rule's keep_versions
+	// does. version is empty if the tag does not parse.
+	VersionRegex  *regexp.Regexp
+	VersionScheme registry.VersionScheme
+	program       *starlark.Program
+
+	mu sync.Mutex
+	// failed are why the script failed on the manifests of its last Apply to them, by Reference
+	failed map[string]string
+}
+
+// LoadScript reads and compiles a Starlark script, and makes sure it defines a retain function
+func LoadScript(file string, maxSteps uint64) (*Script, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if maxSteps == 0 {
+		maxSteps = DefaultScriptMaxSteps
+	}
+	_, program, err := starlark.SourceProgramOptions(&syntax.FileOptions{}, file, src, scriptPredeclared(time.Unix(0, 0)).Has)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{File: file, MaxSteps: maxSteps, Source: src, program: program, failed: map[string]string{}}
+	if _, err := s.entrypoint(s.thread(), time.Unix(0, 0)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// String returns a useful string description of this Script
+func (s *Script) String() string {
+	return fmt.Sprintf("retain per script %s", s.File)
+}
+
+func scriptPredeclared(tNow time.Time) starlark.StringDict {
+	return starlark.StringDict{
+		"now":    starlark.MakeInt64(tNow.Unix()),
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+}
+
+func (s *Script) thread() *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: s.File,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Debugw("script output", "script", s.File, "msg", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(s.MaxSteps)
+	return thread
+}
+
+// entrypoint initializes the script's globals as of tNow, and returns its retain function
+func (s *Script) entrypoint(thread *starlark.Thread, tNow time.Time) (starlark.Callable, error) {
+	globals, err := s.program.Init(thread, scriptPredeclared(tNow))
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals[ScriptEntrypoint].(starlark.Callable)
+	if !ok {
+		return nil, ErrScriptMissingEntrypoint
+	}
+	return fn, nil
+}
+
+// Apply runs the script over the manifests. If the script fails, none of the manifests are kept or
+// deleted, and Issues reports the failure for each of them.
+func (s *Script) Apply(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest) {
+	keep, delete, err := s.eval(manifests, tNow)
+	s.record(manifests, err)
+	if err != nil {
+		log.Errorw("script failed, skipping", "script", s.File, "error", err)
+		return nil, nil
+	}
+	return keep, delete
+}
+
+// record remembers whether the script failed on the manifests, for Issues
+func (s *Script) record(manifests []*registry.Manifest, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range manifests {
+		if err != nil {
+			s.failed[m.Reference()] = err.Error()
+		} else {
+			delete(s.failed, m.Reference())
+		}
+	}
+}
+
+// Issues reports a script-failed issue for each manifest the script failed on when last applied to it
+func (s *Script) Issues(manifests []*registry.Manifest) map[string][]Issue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	issues := map[string][]Issue{}
+	for _, m := range manifests {
+		if detail, ok := s.failed[m.Reference()]; ok {
+			issues[m.Reference()] = []Issue{{Kind: IssueScriptFailed, Detail: detail}}
+		}
+	}
+	return issues
+}
+
+func (s *Script) eval(manifests []*registry.Manifest, tNow time.Time) (keep []*registry.Manifest, delete []*registry.Manifest, err error) {
+	thread := s.thread()
+	fn, err := s.entrypoint(thread, tNow)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byTag := map[string]*registry.Manifest{}
+	args := make([]starlark.Value, len(manifests))
+	for i, m := range manifests {
+		byTag[m.Tag] = m
+		version := ""
+		if v, err := registry.ParseVersion(m.Tag, s.VersionRegex, s.VersionScheme); err == nil {
+			version = v.String()
+		}
+		args[i] = manifestToStarlark(m, version)
+	}
+	res, err := starlark.Call(thread, fn, starlark.Tuple{starlark.NewList(args)}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := res.(*starlark.Dict)
+	if !ok {
+		return nil, nil, ErrScriptResultNotDict
+	}
+	keepTags, err := tagsFromResult(dict, "keep")
+	if err != nil {
+		return nil, nil, err
+	}
+	deleteTags, err := tagsFromResult(dict, "delete")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, tag := range keepTags {
+		m, ok := byTag[tag]
+		if !ok {
+			return nil, nil, ErrScriptUnknownTag
+		}
+		seen[tag] = true
+		keep = append(keep, m)
+	}
+	for _, tag := range deleteTags {
+		m, ok := byTag[tag]
+		if !ok {
+			return nil, nil, ErrScriptUnknownTag
+		}
+		if seen[tag] {
+			return nil, nil, ErrScriptTagKeptAndDeleted
+		}
+		delete = append(delete, m)
+	}
+	return keep, delete, nil
+}
+
+func tagsFromResult(dict *starlark.Dict, key string) ([]string, error) {
+	v, found, err := dict.Get(starlark.String(key))
+	if err != nil {
+		return nil, err
+	}
+	if !found || v == starlark.None {
+		return nil, nil
+	}
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, ErrScriptResultNotDict
+	}
+	tags := []string{}
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var x starlark.Value
+	for iter.Next(&x) {
+		tag, ok := starlark.AsString(x)
+		if !ok {
+			return nil, ErrScriptResultNotDict
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func manifestToStarlark(m *registry.Manifest, version string) starlark.Value {
+	// iterate labels in a stable order, so scripts are deterministic
+	keys := []string{}
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labels := starlark.NewDict(len(keys))
+	for _, k := range keys {
+		labels.SetKey(starlark.String(k), starlark.String(m.Labels[k]))
+	}
+	labels.Freeze()
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"repo":          starlark.String(m.Name),
+		"tag":           starlark.String(m.Tag),
+		"digest":        starlark.String(m.Digest.String()),
+		"version":       starlark.String(version),
+		"last_modified": starlark.MakeInt64(m.LastModified.Unix()),
+		"labels":        labels,
+	})
+}
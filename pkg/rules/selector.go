@@ -3,6 +3,7 @@ package rules
 import (
 	"regexp"
 	"sort"
+	"time"
 
 	"github.com/tumblr/docker-registry-pruner/pkg/registry"
 )
@@ -16,10 +17,17 @@ type Selector struct {
 	IgnoreTags []*regexp.Regexp
 	// MatchTags will restrict the rule to only apply to manifests matching the regex tag
 	MatchTags []*regexp.Regexp
+	// Expr is a CEL expression that must also evaluate to true for manifests to match
+	Expr *Expression
 }
 
 //func (r *Selector) Match(repo, tag string, labels map[string]string) bool {
 func (r *Selector) Match(m *registry.Manifest) bool {
+	return r.MatchAt(m, time.Now())
+}
+
+// MatchAt is Match, evaluating any age in Expr as of tNow
+func (r *Selector) MatchAt(m *registry.Manifest, tNow time.Time) bool {
 
 	anyRepoMatch := len(r.Repos) == 0 // if r.Repos is empty, assume we have a Repos predicate match
 	for _, r := range r.Repos {
@@ -46,6 +54,9 @@ func (r *Selector) Match(m *registry.Manifest) bool {
 			return false
 		}
 	}
+	if r.Expr != nil && !r.Expr.MatchAt(m, tNow) {
+		return false
+	}
 	if len(r.MatchTags) == 0 {
 		// if there are no tags to match, return match
 		return true
@@ -75,10 +86,16 @@ func RulesToSelectors(ruleset []*Rule) []*Selector {
 
 // FilterManifests will apply a set of Selectors over a slice of Manifests,
 // and return the map mapping from repo name to list of matching Manifests.
-func FilterManifests(manifests []*registry.Manifest, selectors []*Selector) map[string][]*registry.Manifest {
+// Selectors are evaluated as of the clock's current time.
+func FilterManifests(manifests []*registry.Manifest, selectors []*Selector, clock Clock) map[string][]*registry.Manifest {
+	tNow := clock.Now()
 	matchingManifests := map[string][]*registry.Manifest{}
 	for _, manifest := range manifests {
-		if MatchAny(selectors, manifest) {
+		anyMatch := false
+		for _, selector := range selectors {
+			anyMatch = selector.MatchAt(manifest, tNow) || anyMatch
+		}
+		if anyMatch {
 			if _, ok := matchingManifests[manifest.Name]; !ok {
 				matchingManifests[manifest.Name] = []*registry.Manifest{}
 			}
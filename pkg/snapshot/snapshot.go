@@ -0,0 +1,176 @@
+package snapshot
+
+// snapshot is an offline copy of a registry's inventory, so rules can be evaluated without registry access.
+// Manifests are written in the same shape as the rules test fixtures' source_manifests, so a snapshot
+// of a real registry can be used as a fixture.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// Version is the version of the snapshot format this package reads and writes
+	Version = 1
+
+	// ErrUnsupportedVersion is returned when loading a snapshot written in another format version
+	ErrUnsupportedVersion = fmt.Errorf("unsupported snapshot version, expected %d", Version)
+)
+
+// Snapshot is the inventory of a registry at a point in time
+type Snapshot struct {
+	Version  int    `yaml:"version" json:"version"`
+	Registry string `yaml:"registry" json:"registry"`
+	// Now is when the snapshot was taken, as RFC3339. Manifests' days_old and hours_old are relative to it
+	Now       string      `yaml:"now" json:"now"`
+	Manifests []*Manifest `yaml:"source_manifests" json:"source_manifests"`
+}
+
+// Manifest is a registry.Manifest, as written to a snapshot. Times are RFC3339.
+type Manifest struct {
+	Name         string            `yaml:"name" json:"name"`
+	Tag          string            `yaml:"tag" json:"tag"`
+	Digest       string            `yaml:"digest,omitempty" json:"digest,omitempty"`
+	Version      string            `yaml:"version,omitempty" json:"version,omitempty"`
+	LastModified string            `yaml:"last_modified" json:"last_modified"`
+	Created      string            `yaml:"created,omitempty" json:"created,omitempty"`
+	FirstSeen    string            `yaml:"first_seen,omitempty" json:"first_seen,omitempty"`
+	Size         int64             `yaml:"size,omitempty" json:"size,omitempty"`
+	DaysOld      int64             `yaml:"days_old" json:"days_old"`
+	HoursOld     int64             `yaml:"hours_old" json:"hours_old"`
+	Labels       map[string]string `yaml:"labels" json:"labels"`
+}
+
+// New takes a snapshot of the manifests of registryURL at tNow. Manifests are sorted by repo and tag,
+// so snapshots of an unchanged registry are identical.
+func New(registryURL string, manifests []*registry.Manifest, tNow time.Time) *Snapshot {
+	s := Snapshot{
+		Version:   Version,
+		Registry:  registryURL,
+		Now:       tNow.UTC().Format(time.RFC3339),
+		Manifests: []*Manifest{},
+	}
+	for _, m := range manifests {
+		age := tNow.Sub(m.LastModified)
+		version := ""
+		if m.Version != nil {
+			version = m.Version.String()
+		}
+		s.Manifests = append(s.Manifests, &Manifest{
+			Name:         m.Name,
+			Tag:          m.Tag,
+			Digest:       m.Digest.String(),
+			Version:      version,
+			LastModified: formatTime(m.LastModified),
+			Created:      formatTime(m.Created),
+			FirstSeen:    formatTime(m.FirstSeen),
+			Size:         m.Size,
+			DaysOld:      int64(age.Hours()) / 24,
+			HoursOld:     int64(age.Hours()) % 24,
+			Labels:       m.Labels,
+		})
+	}
+	sort.Slice(s.Manifests, func(i, j int) bool {
+		if s.Manifests[i].Name != s.Manifests[j].Name {
+			return s.Manifests[i].Name < s.Manifests[j].Name
+		}
+		return s.Manifests[i].Tag < s.Manifests[j].Tag
+	})
+	return &s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// WriteFile writes the snapshot to path, as JSON if it ends in .json and YAML otherwise
+func (s *Snapshot) WriteFile(path string) error {
+	var d []byte
+	var err error
+	if filepath.Ext(path) == ".json" {
+		d, err = json.MarshalIndent(s, "", "  ")
+	} else {
+		d, err = yaml.Marshal(s)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+// Load reads a snapshot written by WriteFile
+func Load(path string) (*Snapshot, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := Snapshot{}
+	// JSON is YAML, so either parses
+	if err := yaml.Unmarshal(d, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != Version {
+		return nil, ErrUnsupportedVersion
+	}
+	return &s, nil
+}
+
+// Time is when the snapshot was taken
+func (s *Snapshot) Time() (time.Time, error) {
+	return time.Parse(time.RFC3339, s.Now)
+}
+
+// RegistryManifests returns the snapshot's manifests as registry.Manifests. Manifests without a
+// last_modified, i.e. hand written fixtures, are aged by days_old and hours_old.
+func (s *Snapshot) RegistryManifests() ([]*registry.Manifest, error) {
+	tNow, err := s.Time()
+	if err != nil {
+		return nil, err
+	}
+	manifests := []*registry.Manifest{}
+	for _, sm := range s.Manifests {
+		lm, err := parseTime(sm.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		if lm.IsZero() {
+			lm = tNow.Add(-time.Duration(sm.DaysOld*24+sm.HoursOld) * time.Hour)
+		}
+		labels := sm.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		m, err := registry.NewManifest(sm.Name, sm.Tag, lm, labels)
+		if err != nil {
+			return nil, err
+		}
+		m.Digest = digest.Digest(sm.Digest)
+		m.Size = sm.Size
+		if m.Created, err = parseTime(sm.Created); err != nil {
+			return nil, err
+		}
+		if m.FirstSeen, err = parseTime(sm.FirstSeen); err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/tumblr/docker-registry-pruner/internal/pkg/testing"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pruner-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tNow := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	a, _ := registry.NewManifest("tumblr/fleeble", "v1.1.0", tNow.Add(-30*time.Hour), map[string]string{"team": "web"})
+	a.Digest = "sha256:aaaa"
+	a.Created = tNow.Add(-31 * time.Hour)
+	b, _ := registry.NewManifest("tumblr/fleeble", "v1.0.0", tNow.Add(-240*time.Hour), map[string]string{})
+	b.Digest = "sha256:bbbb"
+	b.FirstSeen = tNow.Add(-200 * time.Hour)
+
+	for _, file := range []string{"snapshot.yaml", "snapshot.json"} {
+		path := filepath.Join(dir, file)
+		if err := New("https://foo.bar", []*registry.Manifest{a, b}, tNow).WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		s, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Manifests[0].Tag != "v1.0.0" || s.Manifests[0].DaysOld != 10 || s.Manifests[1].DaysOld != 1 || s.Manifests[1].HoursOld != 6 {
+			t.Errorf("%s: expected manifests sorted by tag and aged relative to the snapshot, got %+v %+v", file, s.Manifests[0], s.Manifests[1])
+		}
+		ms, err := s.RegistryManifests()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, expected := range []*registry.Manifest{b, a} {
+			if !reflect.DeepEqual(ms[i], expected) {
+				t.Errorf("%s: expected %+v to round trip, got %+v", file, expected, ms[i])
+			}
+		}
+	}
+}
+
+func TestLoadHandWritten(t *testing.T) {
+	s, err := Load("test/fixtures/snapshots/hand-written.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := s.RegistryManifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2026, 6, 5, 6, 0, 0, 0, time.UTC)
+	if !ms[0].LastModified.Equal(expected) {
+		t.Errorf("expected a manifest without last_modified to be aged by days_old and hours_old to %s, got %s", expected, ms[0].LastModified)
+	}
+	if ms[1].Labels["team"] != "web" || ms[0].Labels == nil {
+		t.Errorf("expected labels to load, got %v and %v", ms[0].Labels, ms[1].Labels)
+	}
+}
+
+func TestLoadUnsupportedVersion(t *testing.T) {
+	if _, err := Load("test/fixtures/snapshots/unsupported-version.yaml"); err != ErrUnsupportedVersion {
+		t.Errorf("expected %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
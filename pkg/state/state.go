@@ -0,0 +1,356 @@
+package state
+
+// state is an optional local inventory of every repo:tag the pruner has seen. Registries don't expose
+// when a tag was pushed, so the first time the pruner sees a tag pointing at a digest stands in for it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	logger, _ = zap.NewProduction()
+	log       = logger.Sugar()
+
+	// OpenTimeout is how long to wait for another pruner holding the state file to release it
+	OpenTimeout = 10 * time.Second
+
+	tagsBucket    = []byte("tags")
+	pendingBucket = []byte("pending")
+
+	// ErrStateNotOpen is returned when using a Store that was closed
+	ErrStateNotOpen = fmt.Errorf("state store is not open")
+)
+
+// Store is a bbolt file holding a TagRecord for each repo:tag, and a PendingRecord for each image marked for deletion
+type Store struct {
+	db *bolt.DB
+}
+
+// TagRecord is everything the pruner remembers about a repo:tag
+type TagRecord struct {
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// Digest is the digest the tag pointed at when it was last seen
+	Digest digest.Digest `json:"digest"`
+	// FirstSeen is when the tag was first seen pointing at Digest
+	FirstSeen time.Time `json:"first_seen"`
+	// LastSeen is when the tag was last seen
+	LastSeen time.Time `json:"last_seen"`
+	// Moves are the times the tag was seen pointing at a different digest than before, oldest first
+	Moves []TagMove `json:"moves,omitempty"`
+	// Manifest are the fields of the manifest at Digest, so it need not be fetched again while the digest is unchanged
+	Manifest *ManifestRecord `json:"manifest,omitempty"`
+	// Decision is what the rules last decided for the tag, keep or delete
+	Decision string `json:"decision,omitempty"`
+	// DecidedAt is when the rules last decided
+	DecidedAt time.Time `json:"decided_at,omitempty"`
+}
+
+// TagMove is a tag being repointed from one digest to another
+type TagMove struct {
+	From digest.Digest `json:"from"`
+	To   digest.Digest `json:"to"`
+	At   time.Time     `json:"at"`
+}
+
+// PendingRecord is an image the rules have decided to delete in every run since Since, waiting out its
+// grace period. Images are pending by digest, so a tag pushed again starts over.
+type PendingRecord struct {
+	Repo   string        `json:"repo"`
+	Tag    string        `json:"tag"`
+	Digest digest.Digest `json:"digest"`
+	// Since is when the image was first marked for deletion
+	Since time.Time `json:"since"`
+	// LastMarked is when the image was last marked for deletion
+	LastMarked time.Time `json:"last_marked"`
+}
+
+// ManifestRecord are the fields of a registry.Manifest that come from the registry
+type ManifestRecord struct {
+	LastModified time.Time         `json:"last_modified"`
+	Created      time.Time         `json:"created"`
+	Labels       map[string]string `json:"labels"`
+	Size         int64             `json:"size,omitempty"`
+}
+
+// Open opens, or creates, the state file at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{tagsBucket, pendingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the state file
+func (s *Store) Close() error {
+	if s.db == nil {
+		return ErrStateNotOpen
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func key(repo, tag string) []byte {
+	return []byte(fmt.Sprintf("%s:%s", repo, tag))
+}
+
+// Get returns the record of repo:tag, or nil if it was never seen
+func (s *Store) Get(repo, tag string) (*TagRecord, error) {
+	if s.db == nil {
+		return nil, ErrStateNotOpen
+	}
+	var rec *TagRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = get(tx, repo, tag)
+		return err
+	})
+	return rec, err
+}
+
+func get(tx *bolt.Tx, repo, tag string) (*TagRecord, error) {
+	v := tx.Bucket(tagsBucket).Get(key(repo, tag))
+	if v == nil {
+		return nil, nil
+	}
+	rec := TagRecord{}
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func put(tx *bolt.Tx, rec *TagRecord) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(tagsBucket).Put(key(rec.Repo, rec.Tag), v)
+}
+
+// Records returns the records of every tag ever seen
+func (s *Store) Records() ([]*TagRecord, error) {
+	if s.db == nil {
+		return nil, ErrStateNotOpen
+	}
+	recs := []*TagRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tagsBucket).ForEach(func(k, v []byte) error {
+			rec := TagRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			recs = append(recs, &rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+// Observe records seeing the manifest at tNow, and sets its FirstSeen. If the tag now points at
+// a different digest than it did before, the move is recorded and FirstSeen starts over.
+// Observations from concurrent fetch workers are batched into shared transactions.
+func (s *Store) Observe(m *registry.Manifest, tNow time.Time) error {
+	if s.db == nil {
+		return ErrStateNotOpen
+	}
+	var firstSeen time.Time
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		rec, err := get(tx, m.Name, m.Tag)
+		if err != nil {
+			return err
+		}
+		switch {
+		case rec == nil:
+			rec = &TagRecord{Repo: m.Name, Tag: m.Tag, Digest: m.Digest, FirstSeen: tNow}
+		case rec.Digest != m.Digest:
+			log.Infow("tag moved", "repo", m.Name, "tag", m.Tag, "from", rec.Digest, "to", m.Digest)
+			rec.Moves = append(rec.Moves, TagMove{From: rec.Digest, To: m.Digest, At: tNow})
+			rec.Digest = m.Digest
+			rec.FirstSeen = tNow
+		}
+		rec.LastSeen = tNow
+		rec.Manifest = &ManifestRecord{
+			LastModified: m.LastModified,
+			Created:      m.Created,
+			Labels:       m.Labels,
+			Size:         m.Size,
+		}
+		firstSeen = rec.FirstSeen
+		return put(tx, rec)
+	})
+	if err != nil {
+		return err
+	}
+	m.FirstSeen = firstSeen
+	return nil
+}
+
+// Lookup returns the manifest of repo:tag as last seen, if the tag still points at dgst.
+// The manifest's FirstSeen is set. It is nil if the tag was not seen at that digest.
+func (s *Store) Lookup(repo, tag string, dgst digest.Digest) (*registry.Manifest, error) {
+	rec, err := s.Get(repo, tag)
+	if err != nil || rec == nil || rec.Digest != dgst || rec.Manifest == nil || dgst == "" {
+		return nil, err
+	}
+	m, err := registry.NewManifest(repo, tag, rec.Manifest.LastModified, rec.Manifest.Labels)
+	if err != nil {
+		return nil, err
+	}
+	m.Digest = rec.Digest
+	m.Created = rec.Manifest.Created
+	m.Size = rec.Manifest.Size
+	m.FirstSeen = rec.FirstSeen
+	return m, nil
+}
+
+// RecordDecisions records what the rules decided for each manifest at tNow
+func (s *Store) RecordDecisions(keep []*registry.Manifest, delete []*registry.Manifest, tNow time.Time) error {
+	if s.db == nil {
+		return ErrStateNotOpen
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		for decision, manifests := range map[string][]*registry.Manifest{"keep": keep, "delete": delete} {
+			for _, m := range manifests {
+				rec, err := get(tx, m.Name, m.Tag)
+				if err != nil {
+					return err
+				}
+				if rec == nil {
+					// the manifest was not observed, i.e. the store was added after it was fetched
+					continue
+				}
+				rec.Decision = decision
+				rec.DecidedAt = tNow
+				if err := put(tx, rec); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// PendingKey is how the pending record of a manifest is keyed: repo@digest, or repo:tag for a manifest without a digest
+func PendingKey(m *registry.Manifest) string {
+	if m.Digest == "" {
+		return m.Reference()
+	}
+	return fmt.Sprintf("%s@%s", m.Name, m.Digest)
+}
+
+// MarkPending marks the manifests to delete as pending deletion at tNow, keeping when they were first
+// marked if they already were. The pending images of the repos in seen that are not in delete are
+// unmarked, as they have to be marked in consecutive runs; those still in seen are returned as rescued.
+// Returns the record of each manifest in delete, by PendingKey. If persist is false, nothing is written,
+// and the records are as they would be.
+func (s *Store) MarkPending(delete []*registry.Manifest, seen []*registry.Manifest, tNow time.Time, persist bool) (map[string]*PendingRecord, []*PendingRecord, error) {
+	if s.db == nil {
+		return nil, nil, ErrStateNotOpen
+	}
+	pending := map[string]*PendingRecord{}
+	rescued := []*PendingRecord{}
+	mark := func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		for _, m := range delete {
+			k := PendingKey(m)
+			rec := PendingRecord{}
+			if v := b.Get([]byte(k)); v != nil {
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+			} else {
+				rec = PendingRecord{Repo: m.Name, Tag: m.Tag, Digest: m.Digest, Since: tNow}
+			}
+			rec.LastMarked = tNow
+			pending[k] = &rec
+			if persist {
+				v, err := json.Marshal(rec)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		repos := map[string]bool{}
+		present := map[string]bool{}
+		for _, m := range seen {
+			repos[m.Name] = true
+			present[PendingKey(m)] = true
+		}
+		unmarked := [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			rec := PendingRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if !repos[rec.Repo] || pending[string(k)] != nil {
+				return nil
+			}
+			// images that are gone were deleted some other way; only those still around were rescued
+			if present[string(k)] && persist {
+				log.Infow("image rescued from deletion", "repo", rec.Repo, "tag", rec.Tag, "digest", rec.Digest, "pending_since", rec.Since)
+			}
+			if present[string(k)] {
+				rescued = append(rescued, &rec)
+			}
+			unmarked = append(unmarked, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil || !persist {
+			return err
+		}
+		for _, k := range unmarked {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if persist {
+		err = s.db.Update(mark)
+	} else {
+		err = s.db.View(mark)
+	}
+	return pending, rescued, err
+}
+
+// ClearPending unmarks the manifests, once they are deleted
+func (s *Store) ClearPending(manifests []*registry.Manifest) error {
+	if s.db == nil {
+		return ErrStateNotOpen
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		for _, m := range manifests {
+			if err := tx.Bucket(pendingBucket).Delete([]byte(PendingKey(m))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
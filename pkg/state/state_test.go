@@ -0,0 +1,104 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tumblr/docker-registry-pruner/pkg/registry"
+)
+
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "pruner-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestObserveFirstSeenAndMoves(t *testing.T) {
+	s, cleanup := openTestStore(t)
+	defer cleanup()
+
+	t1 := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(24 * time.Hour)
+	t3 := t2.Add(24 * time.Hour)
+	m, _ := registry.NewManifest("tumblr/fleeble", "v1.0.0", t1.Add(-30*24*time.Hour), map[string]string{"team": "web"})
+	m.Digest = "sha256:aaaa"
+
+	if err := s.Observe(m, t1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Observe(m, t2); err != nil {
+		t.Fatal(err)
+	}
+	if !m.FirstSeen.Equal(t1) {
+		t.Errorf("expected first seen %s to stay %s while the digest is unchanged", m.FirstSeen, t1)
+	}
+
+	// an unchanged digest can be served from the state, without fetching the manifest
+	cached, err := s.Lookup("tumblr/fleeble", "v1.0.0", "sha256:aaaa")
+	if err != nil || cached == nil {
+		t.Fatalf("expected to look up the unchanged manifest, got %v, %v", cached, err)
+	}
+	if !cached.LastModified.Equal(m.LastModified) || cached.Labels["team"] != "web" || !cached.FirstSeen.Equal(t1) {
+		t.Errorf("expected the looked up manifest to match what was observed, got %+v", cached)
+	}
+	if cached, _ := s.Lookup("tumblr/fleeble", "v1.0.0", "sha256:bbbb"); cached != nil {
+		t.Errorf("expected no manifest for a digest the tag was not seen at")
+	}
+
+	// the tag moves, and is first seen again
+	m.Digest = "sha256:bbbb"
+	if err := s.Observe(m, t3); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := s.Get("tumblr/fleeble", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.FirstSeen.Equal(t3) || !rec.LastSeen.Equal(t3) || !m.FirstSeen.Equal(t3) {
+		t.Errorf("expected the moved tag to be first seen at %s, got %+v", t3, rec)
+	}
+	if len(rec.Moves) != 1 || rec.Moves[0].From != "sha256:aaaa" || rec.Moves[0].To != "sha256:bbbb" {
+		t.Errorf("expected the move to be recorded, got %+v", rec.Moves)
+	}
+}
+
+func TestRecordDecisions(t *testing.T) {
+	s, cleanup := openTestStore(t)
+	defer cleanup()
+
+	tNow := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	keep, _ := registry.NewManifest("tumblr/fleeble", "v2.0.0", tNow, nil)
+	delete, _ := registry.NewManifest("tumblr/fleeble", "v1.0.0", tNow, nil)
+	unseen, _ := registry.NewManifest("tumblr/fleeble", "v0.1.0", tNow, nil)
+	s.Observe(keep, tNow)
+	s.Observe(delete, tNow)
+
+	if err := s.RecordDecisions([]*registry.Manifest{keep}, []*registry.Manifest{delete, unseen}, tNow); err != nil {
+		t.Fatal(err)
+	}
+	for tag, expected := range map[string]string{"v2.0.0": "keep", "v1.0.0": "delete"} {
+		rec, _ := s.Get("tumblr/fleeble", tag)
+		if rec.Decision != expected || !rec.DecidedAt.Equal(tNow) {
+			t.Errorf("%s: expected decision %s at %s, got %+v", tag, expected, tNow, rec)
+		}
+	}
+	if rec, _ := s.Get("tumblr/fleeble", "v0.1.0"); rec != nil {
+		t.Errorf("expected no record for a manifest that was never observed, got %+v", rec)
+	}
+	recs, _ := s.Records()
+	if len(recs) != 2 {
+		t.Errorf("expected 2 records, got %d", len(recs))
+	}
+}
@@ -0,0 +1,131 @@
+package undo
+
+// undo keeps the manifest of every image a run deletes, so the deletions can be undone by pushing the
+// manifests back, until the registry garbage collects the blobs they reference.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+var (
+	// ErrRunNotFound is returned when loading a run that saved nothing
+	ErrRunNotFound = fmt.Errorf("no manifests were saved for this run")
+	// ErrBackupNotOpen is returned when saving to a Backup that was closed
+	ErrBackupNotOpen = fmt.Errorf("undo backup is not open")
+
+	entriesFile = "manifests.jsonl"
+)
+
+// Entry is a manifest that was saved before it was deleted
+type Entry struct {
+	Repo      string        `json:"repo"`
+	Tag       string        `json:"tag"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"media_type"`
+	SavedAt   time.Time     `json:"saved_at"`
+}
+
+// Backup is the directory of one run's saved manifests, holding each manifest in a file named by its
+// digest, and an entry for each in manifests.jsonl. It is safe to use from multiple goroutines.
+type Backup struct {
+	mu  sync.Mutex
+	dir string
+	f   *os.File
+}
+
+// RunDir is the directory in dir the manifests of a run are saved to
+func RunDir(dir, runID string) string {
+	return filepath.Join(dir, runID)
+}
+
+// Create makes the directory to save the manifests of a run in, in dir
+func Create(dir, runID string) (*Backup, error) {
+	runDir := RunDir(dir, runID)
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(runDir, entriesFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Backup{dir: runDir, f: f}, nil
+}
+
+// Close closes the backup
+func (b *Backup) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.f == nil {
+		return ErrBackupNotOpen
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
+
+func manifestPath(runDir string, dgst digest.Digest) string {
+	return filepath.Join(runDir, dgst.Algorithm().String()+"-"+dgst.Hex()+".json")
+}
+
+// Save saves the manifest of repo:tag, with the digest it is stored under in the registry
+func (b *Backup) Save(repo, tag string, dgst digest.Digest, mediaType string, payload []byte) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifestPath(b.dir, dgst), payload, 0644); err != nil {
+		return err
+	}
+	d, err := json.Marshal(Entry{Repo: repo, Tag: tag, Digest: dgst, MediaType: mediaType, SavedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.f == nil {
+		return ErrBackupNotOpen
+	}
+	if _, err := b.f.Write(append(d, '\n')); err != nil {
+		return err
+	}
+	// the manifest is only as safe as its entry; make sure it is on disk before the image is deleted
+	return b.f.Sync()
+}
+
+// Load returns the entries saved for a run in dir, in the order they were saved
+func Load(dir, runID string) ([]*Entry, error) {
+	f, err := os.Open(filepath.Join(RunDir(dir, runID), entriesFile))
+	if os.IsNotExist(err) {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []*Entry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, scanner.Err()
+}
+
+// Manifest reads the saved manifest of the entry, from the run in dir
+func (e *Entry) Manifest(dir, runID string) ([]byte, error) {
+	return ioutil.ReadFile(manifestPath(RunDir(dir, runID), e.Digest))
+}
@@ -0,0 +1,67 @@
+package undo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pruner-undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Load(dir, "nope"); err != ErrRunNotFound {
+		t.Errorf("expected %v loading a run that saved nothing, got %v", ErrRunNotFound, err)
+	}
+
+	b, err := Create(dir, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// save from many goroutines at once, as the delete workers do
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf(`{"schemaVersion":2,"tag":"v1.%d.0"}`, i))
+			if err := b.Save("tumblr/fleeble", fmt.Sprintf("v1.%d.0", i), digest.FromBytes(payload), schema2.MediaTypeManifest, payload); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := b.Save("tumblr/fleeble", "bad", "not a digest", schema2.MediaTypeManifest, []byte("{}")); err == nil {
+		t.Errorf("expected an error saving a manifest with an invalid digest")
+	}
+	b.Close()
+	if err := b.Save("tumblr/fleeble", "v2.0.0", digest.FromString("{}"), schema2.MediaTypeManifest, []byte("{}")); err != ErrBackupNotOpen {
+		t.Errorf("expected %v saving to a closed backup, got %v", ErrBackupNotOpen, err)
+	}
+
+	entries, err := Load(dir, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("expected 10 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		payload, err := e.Manifest(dir, "run-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest.FromBytes(payload) != e.Digest || !bytes.Contains(payload, []byte(e.Tag)) || e.MediaType != schema2.MediaTypeManifest {
+			t.Errorf("saved manifest of %s:%s does not match its entry: %s", e.Repo, e.Tag, payload)
+		}
+	}
+}